@@ -23,36 +23,111 @@ import (
 
 	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
 	"github.com/bcwaldon/klondike/src/farva/pkg/gateway"
+	"github.com/bcwaldon/klondike/src/farva/pkg/logger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		render(os.Args[2:])
+		return
+	}
+
 	fs := flag.NewFlagSet("farva-gateway", flag.ExitOnError)
 
 	var cfg gateway.Config
+	var logLevel, logFormat, configFile, fifoPath string
+	var printConfig bool
+	fs.StringVar(&configFile, "config", "", "YAML file mapping flag names to values. Command line flags take precedence over environment variables, which take precedence over the file.")
+	fs.BoolVar(&printConfig, "print-config", false, "Print the effective value of every flag and where it came from, then exit.")
+	fs.StringVar(&logLevel, "log-level", "info", "Log at this level or above: debug, info, warning, error.")
+	fs.StringVar(&logFormat, "log-format", "text", "Format of farva's own logs, either text or json.")
 	fs.DurationVar(&cfg.RefreshInterval, "refresh-interval", 30*time.Second, "Attempt to build and reload a new nginx config at this interval")
+	fs.DurationVar(&cfg.NGINXStatusInterval, "nginx-status-interval", gateway.DefaultConfig.NGINXStatusInterval, "Scrape nginx stub_status for connection metrics at this interval.")
 	fs.StringVar(&cfg.KubeconfigFile, "kubeconfig", "", "Set this to provide an explicit path to a kubeconfig, otherwise the in-cluster config will be used.")
 	fs.BoolVar(&cfg.NGINXDryRun, "nginx-dry-run", false, "Log nginx management commands rather than executing them.")
-	fs.IntVar(&cfg.NGINXHealthPort, "nginx-health-port", gateway.DefaultNGINXConfig.HealthPort, "Port to listen on for nginx health checks.")
+	addConfigFlags(fs, &cfg)
 	fs.IntVar(&cfg.FarvaHealthPort, "farva-health-port", gateway.DefaultConfig.FarvaHealthPort, "Port to listen on for farva health checks.")
-	fs.IntVar(&cfg.HTTPListenPort, "http-listen-port", gateway.DefaultConfig.HTTPListenPort, "Port to listen on for HTTP traffic.")
-	fs.StringVar(&cfg.FifoPath, "fifo-path", gateway.DefaultConfig.FifoPath, "Location of nginx stderr and stdout logging fifo.")
-	fs.StringVar(&cfg.ClusterZone, "cluster-zone", "", "Use this DNS zone for routing of traffic to Kubernetes")
-	fs.StringVar(&cfg.AnnotationPrefix, "annotation-prefix", gateway.DefaultKubernetesReverseProxyConfigGetterConfig.AnnotationPrefix, "Forms the lookup key for additional gateway configuration annotations.")
+	fs.BoolVar(&cfg.LeaderElect, "leader-elect", false, "Elect a single leader among replicas to perform cluster-wide writes. Every replica still serves traffic.")
+	fs.StringVar(&cfg.LeaderElectionConfigMap, "leader-election-configmap", gateway.DefaultConfig.LeaderElectionConfigMap, "ConfigMap, given as namespace/name, used as the leader election lock.")
+	fs.StringVar(&cfg.LeaderElectionID, "leader-election-id", "", "Identity of this replica in leader election. Defaults to the hostname.")
+	fs.DurationVar(&cfg.LeaderElectionLeaseDuration, "leader-election-lease-duration", gateway.DefaultConfig.LeaderElectionLeaseDuration, "How long a leader's lease is honored by other replicas after its last renewal.")
+	fs.DurationVar(&cfg.EndpointDrainPeriod, "endpoint-drain-period", 0, "Keep endpoints that are removed or stop being ready in upstreams, without new requests, for this long. Zero drops them right away.")
+	fs.DurationVar(&cfg.StaticConfigPollInterval, "static-config-poll-interval", gateway.DefaultConfig.StaticConfigPollInterval, "Check the static config file for changes at this interval.")
+	fs.StringVar(&fifoPath, "fifo-path", "", "Deprecated: use --access-log-fifo.")
+	fs.StringVar(&cfg.NGINXConfigMap, "nginx-configmap", "", "Watch this ConfigMap, given as namespace/name, for global nginx tuning overrides.")
 
 	fs.Parse(os.Args[1:])
 
-	if err := flagutil.SetFlagsFromEnv(fs, "FARVA_GATEWAY"); err != nil {
-		log.Fatalf("Failed setting flags from env: %v", err)
+	sources, err := flagutil.Load(fs, "FARVA_GATEWAY", "config")
+	if err != nil {
+		log.Fatalf("Failed loading config: %v", err)
+	}
+	if printConfig {
+		flagutil.PrintFlags(os.Stdout, fs, sources)
+		return
+	}
+
+	if err := logger.Configure(logLevel, logFormat); err != nil {
+		log.Fatalf("Failed configuring logging: %v", err)
+	}
+
+	if sources["fifo-path"] != flagutil.SourceDefault {
+		logger.Log.Warning("--fifo-path is deprecated, use --access-log-fifo instead")
+		if sources["access-log-fifo"] == flagutil.SourceDefault {
+			cfg.AccessLogFifo = fifoPath
+		}
+	}
+
+	if cfg.LeaderElect && cfg.LeaderElectionID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			logger.Log.Fatalf("Failed determining leader election identity: %v", err)
+		}
+		cfg.LeaderElectionID = hostname
 	}
 
 	gw, err := gateway.New(cfg)
 	if err != nil {
-		log.Fatalf("Gateway construction failed: %v", err)
+		logger.Log.Fatalf("Gateway construction failed: %v", err)
 	}
 
 	if err := gw.Run(); err != nil {
-		log.Printf("Gateway operation failed: %v", err)
+		logger.Log.Errorf("Gateway operation failed: %v", err)
 	}
 
-	log.Printf("Gateway shutting down")
+	logger.Log.Info("Gateway shutting down")
+}
+
+// addConfigFlags registers the flags that shape the generated nginx config,
+// shared by the gateway and the render subcommand.
+func addConfigFlags(fs *flag.FlagSet, cfg *gateway.Config) {
+	fs.IntVar(&cfg.NGINXHealthPort, "nginx-health-port", gateway.DefaultNGINXConfig.HealthPort, "Port to listen on for nginx health checks.")
+	fs.IntVar(&cfg.HTTPListenPort, "http-listen-port", gateway.DefaultConfig.HTTPListenPort, "Port to listen on for HTTP traffic.")
+	fs.StringVar(&cfg.AccessLogFifo, "access-log-fifo", gateway.DefaultConfig.AccessLogFifo, "Location of the fifo nginx writes its access log to.")
+	fs.StringVar(&cfg.ErrorLogFifo, "error-log-fifo", gateway.DefaultConfig.ErrorLogFifo, "Location of the fifo nginx writes its error log to.")
+	fs.StringVar(&cfg.ClusterZone, "cluster-zone", "", "Use these comma-separated DNS zones for routing of traffic to Kubernetes. The first zone gives the primary server name.")
+	fs.StringVar(&cfg.HostnameTemplate, "hostname-template", gateway.DefaultKubernetesReverseProxyConfigGetterConfig.HostnameTemplate, "Template of the canonical hostname of an Ingress in each cluster zone, using {{name}}, {{namespace}} and {{zone}}.")
+	fs.StringVar(&cfg.CanonicalHostnamePolicy, "canonical-hostname-policy", gateway.DefaultKubernetesReverseProxyConfigGetterConfig.CanonicalHostnamePolicy, "Whether Ingress rules with a host also get canonical hostnames: always or unless-host.")
+	fs.BoolVar(&cfg.RegexHosts, "regex-hosts", false, "Allow regular expressions, prefixed with ~, as Ingress rule hosts and hostname aliases.")
+	fs.Var(&cfg.DomainOwners, "domain-owner", "Only allow a namespace to claim hostnames in a domain, as domain=namespace. May be repeated to allow several namespaces.")
+	fs.BoolVar(&cfg.NamespaceZones, "namespace-zones", false, "Select the cluster zones of Ingresses from the cluster-zone annotation of their namespace. Requires permission to list namespaces.")
+	fs.StringVar(&cfg.AnnotationPrefix, "annotation-prefix", gateway.DefaultKubernetesReverseProxyConfigGetterConfig.AnnotationPrefix, "Forms the lookup key for additional gateway configuration annotations.")
+	fs.StringVar(&cfg.AccessLogFormat, "access-log-format", gateway.DefaultConfig.AccessLogFormat, "Format of the nginx access log, either main or json.")
+	fs.StringVar(&cfg.IngressClass, "ingress-class", "", "Only handle Ingresses with this kubernetes.io/ingress.class annotation. If empty, all Ingresses are handled.")
+	fs.StringVar(&cfg.UnclassedIngressPolicy, "unclassed-ingress-policy", gateway.DefaultKubernetesReverseProxyConfigGetterConfig.UnclassedIngressPolicy, "Whether to claim or ignore Ingresses without a class when --ingress-class is set.")
+	fs.StringVar(&cfg.Namespaces, "namespaces", "", "Comma-separated list of namespaces to read Ingresses from. If empty, all namespaces are read.")
+	fs.StringVar(&cfg.NamespaceSelector, "namespace-selector", "", "Only read Ingresses from namespaces matching this label selector. Requires permission to list namespaces.")
+	fs.StringVar(&cfg.IngressSelector, "ingress-selector", "", "Only handle Ingresses matching this label selector.")
+	fs.Var(&cfg.ProxySetHeaders, "proxy-set-header", "Header to set on every request to upstreams, as name=value. May be repeated, or given several pairs separated by newlines. Values may use nginx variables.")
+	fs.Var(&cfg.AddHeaders, "add-header", "Header to add to every response, as name=value. May be repeated, or given several pairs separated by newlines. Values may use nginx variables.")
+	fs.StringVar(&cfg.ProxyHideHeaders, "proxy-hide-header", "", "Comma-separated list of upstream response headers to hide from clients.")
+	fs.StringVar(&cfg.ProxyProtocolPorts, "proxy-protocol-ports", "", "Comma-separated list of listener ports that expect the PROXY protocol, such as behind an AWS ELB in TCP mode.")
+	fs.StringVar(&cfg.ForwardedHeadersPorts, "forwarded-headers-ports", "", "Comma-separated list of listener ports on which to pass the client address and protocol to upstreams in X-Forwarded-* headers.")
+	fs.StringVar(&cfg.TrustedProxies, "trusted-proxies", "", "Comma-separated list of CIDRs of load balancers whose PROXY protocol and X-Forwarded-* values are trusted.")
+	fs.StringVar(&cfg.RequestIDHeader, "request-id-header", gateway.DefaultConfig.RequestIDHeader, "Header carrying a unique ID for each request to upstreams, back to clients and into the access log. If empty, request IDs are disabled.")
+	fs.BoolVar(&cfg.RequestIDHonorIncoming, "request-id-honor-incoming", false, "Keep a well-formed request ID sent by one of the trusted proxies instead of generating a new one.")
+	fs.StringVar(&cfg.SnippetDirectives, "snippet-directives", "", "Comma-separated allowlist of nginx directives Ingresses may use in snippet annotations. Snippets are rejected if empty.")
+	fs.StringVar(&cfg.GatewayClass, "gateway-class", "", "Serve HTTPRoutes attached to Gateways of this GatewayClass. If empty, the Gateway API is not used.")
+	fs.StringVar(&cfg.GatewayControllerName, "gateway-controller-name", gateway.DefaultConfig.GatewayControllerName, "Controller name under which the status of Gateways and HTTPRoutes is written.")
+	fs.StringVar(&cfg.StaticConfigFile, "static-config", "", "YAML or JSON file of static routes to merge with those from Ingresses. Watched for changes.")
 }
@@ -0,0 +1,88 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/bcwaldon/klondike/src/farva/pkg/gateway"
+	"github.com/bcwaldon/klondike/src/farva/pkg/logger"
+)
+
+// render implements `farva-gateway render`, which prints the config farva
+// would generate for a set of manifest files without contacting a cluster.
+func render(args []string) {
+	fs := flag.NewFlagSet("farva-gateway render", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: farva-gateway render [flags] FILE|DIR...\n\n")
+		fs.PrintDefaults()
+	}
+
+	cfg := gateway.DefaultConfig
+	var output, logLevel string
+	var validate bool
+	fs.StringVar(&output, "output", "nginx", "What to print: nginx for the rendered nginx.conf, config for the reverse proxy config as JSON, or ingresses for per-Ingress status as JSON.")
+	fs.BoolVar(&validate, "validate", false, "Check the rendered config with `nginx -t`. Requires nginx on the PATH.")
+	fs.StringVar(&logLevel, "log-level", "warning", "Log at this level or above: debug, info, warning, error.")
+	addConfigFlags(fs, &cfg)
+
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch output {
+	case "nginx", "config", "ingresses":
+	default:
+		log.Fatalf("Unknown output %q", output)
+	}
+
+	if err := logger.Configure(logLevel, "text"); err != nil {
+		log.Fatalf("Failed configuring logging: %v", err)
+	}
+
+	rendered, err := gateway.Render(cfg, fs.Args(), validate)
+	if err != nil {
+		if rendered != nil {
+			for _, st := range rendered.Ingresses {
+				if st.Error != "" {
+					fmt.Fprintf(os.Stderr, "%s/%s: %s\n", st.Namespace, st.Name, st.Error)
+				}
+			}
+		}
+		log.Fatalf("Render failed: %v", err)
+	}
+
+	switch output {
+	case "nginx":
+		os.Stdout.Write(rendered.NGINXConfig)
+	case "config":
+		os.Stdout.Write(rendered.ReverseProxyConfig)
+		fmt.Println()
+	case "ingresses":
+		enc, err := json.MarshalIndent(rendered.Ingresses, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed encoding Ingress status: %v", err)
+		}
+		os.Stdout.Write(enc)
+		fmt.Println()
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package flagutil
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/ghodss/yaml"
+)
+
+// Source identifies where the effective value of a flag came from.
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// Sources maps flag names to the Source of their effective value.
+type Sources map[string]Source
+
+// Load fills in the flags of an already parsed FlagSet, in order of
+// decreasing precedence: command line flags, then PREFIX_FLAG_NAME
+// environment variables, then the YAML file named by the configFlag flag,
+// then defaults. configFlag may itself be set on the command line or in the
+// environment, but not in the file.
+func Load(fs *flag.FlagSet, prefix, configFlag string) (Sources, error) {
+	sources := Sources{}
+	fs.VisitAll(func(f *flag.Flag) {
+		sources[f.Name] = SourceDefault
+	})
+	mark := func(src Source) {
+		fs.Visit(func(f *flag.Flag) {
+			if sources[f.Name] == SourceDefault {
+				sources[f.Name] = src
+			}
+		})
+	}
+
+	mark(SourceFlag)
+	if err := SetFlagsFromEnv(fs, prefix); err != nil {
+		return nil, err
+	}
+	mark(SourceEnv)
+
+	if path := fs.Lookup(configFlag).Value.String(); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetFlagsFromYAML(fs, data, configFlag); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		mark(SourceFile)
+	}
+
+	return sources, nil
+}
+
+// SetFlagsFromYAML sets every flag not already set from a YAML document
+// mapping flag names to values. Unknown keys, and any keys named in
+// disallowed, are an error. Lists and maps are applied one element at a
+// time, maps as key=value, for flags that accumulate values.
+func SetFlagsFromYAML(fs *flag.FlagSet, data []byte, disallowed ...string) error {
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range disallowed {
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("key %q may not be set in a config file", name)
+		}
+	}
+	for _, name := range names {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown key %q", name)
+		}
+	}
+
+	set := setFlags(fs)
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		vals, err := yamlFlagValues(values[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for %q: %v", name, err)
+		}
+		for _, val := range vals {
+			if err := fs.Set(name, val); err != nil {
+				return fmt.Errorf("invalid value %q for %q: %v", val, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func yamlFlagValues(v interface{}) ([]string, error) {
+	switch t := v.(type) {
+	case []interface{}:
+		vals := []string{}
+		for _, e := range t {
+			s, err := yamlScalar(e)
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, s)
+		}
+		return vals, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		vals := []string{}
+		for _, k := range keys {
+			s, err := yamlScalar(t[k])
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, k+"="+s)
+		}
+		return vals, nil
+	default:
+		s, err := yamlScalar(v)
+		if err != nil {
+			return nil, err
+		}
+		return []string{s}, nil
+	}
+}
+
+func yamlScalar(v interface{}) (string, error) {
+	switch t := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case bool:
+		return strconv.FormatBool(t), nil
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("expected a scalar, got %T", v)
+	}
+}
+
+// PrintFlags writes the effective value of every flag and its Source.
+func PrintFlags(w io.Writer, fs *flag.FlagSet, sources Sources) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FLAG\tVALUE\tSOURCE")
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(tw, "%s\t%q\t%s\n", f.Name, f.Value.String(), sources[f.Name])
+	})
+	tw.Flush()
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package flagutil
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func newTestFlagSet() (*flag.FlagSet, map[string]*string) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	vals := map[string]*string{}
+	for _, name := range []string{"config", "a", "b", "c", "d"} {
+		vals[name] = fs.String(name, "default-"+name, "")
+	}
+	return fs, vals
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagutil")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("a: file-a\nb: file-b\nc: file-c\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("TEST_B", "env-b")
+	os.Setenv("TEST_C", "")
+	os.Setenv("TEST_A", "env-a")
+	defer func() {
+		for _, k := range []string{"TEST_A", "TEST_B", "TEST_C"} {
+			os.Unsetenv(k)
+		}
+	}()
+
+	fs, vals := newTestFlagSet()
+	if err := fs.Parse([]string{"--config", path, "--a", "flag-a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	sources, err := Load(fs, "TEST", "config")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := map[string]string{}
+	for name, val := range vals {
+		got[name] = *val
+	}
+	want := map[string]string{
+		"config": path,
+		"a":      "flag-a",
+		"b":      "env-b",
+		"c":      "",
+		"d":      "default-d",
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("values diff=%s", diff)
+	}
+
+	wantSources := Sources{
+		"config": SourceFlag,
+		"a":      SourceFlag,
+		"b":      SourceEnv,
+		"c":      SourceEnv,
+		"d":      SourceDefault,
+	}
+	if diff := pretty.Compare(wantSources, sources); diff != "" {
+		t.Errorf("sources diff=%s", diff)
+	}
+}
+
+func TestSetFlagsFromYAML(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	s := fs.String("str", "x", "")
+	n := fs.Int("num", 0, "")
+	b := fs.Bool("enabled", false, "")
+	var kv KVSliceFlag
+	fs.Var(&kv, "kv", "")
+
+	data := "str:\nnum: 3\nenabled: true\nkv:\n  X-Foo: bar\n  X-Baz: qux\n"
+	if err := SetFlagsFromYAML(fs, []byte(data)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if *s != "" || *n != 3 || !*b {
+		t.Errorf("unexpected values s=%q n=%d b=%t", *s, *n, *b)
+	}
+	if diff := pretty.Compare(KVSliceFlag{{"X-Baz", "qux"}, {"X-Foo", "bar"}}, kv); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
+
+func TestSetFlagsFromYAMLError(t *testing.T) {
+	tests := []string{
+		"nope: 1",
+		"config: other.yaml",
+		"num: three",
+		"str: {a: [1, 2]}",
+		"not yaml: [",
+	}
+
+	for i, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.String("str", "", "")
+		fs.Int("num", 0, "")
+		if err := SetFlagsFromYAML(fs, []byte(tt), "config"); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
@@ -22,11 +22,18 @@ import (
 	"strings"
 )
 
+// SetFlagsFromEnv sets every flag not already set, typically on the command
+// line, from the environment variable PREFIX_FLAG_NAME. A variable that is
+// present but empty sets the flag to the empty value.
 func SetFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	set := setFlags(fs)
 	var err error
 	fs.VisitAll(func(f *flag.Flag) {
-		key := prefix + "_" + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
-		if val := os.Getenv(key); val != "" {
+		if set[f.Name] {
+			return
+		}
+		key := EnvKey(prefix, f.Name)
+		if val, ok := os.LookupEnv(key); ok {
 			if serr := fs.Set(f.Name, val); serr != nil {
 				err = fmt.Errorf("invalid value %q for %s: %v", val, key, serr)
 			}
@@ -34,3 +41,17 @@ func SetFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
 	})
 	return err
 }
+
+// EnvKey returns the environment variable consulted for the named flag.
+func EnvKey(prefix, name string) string {
+	return prefix + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// setFlags returns the names of the flags that have been set.
+func setFlags(fs *flag.FlagSet) map[string]bool {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
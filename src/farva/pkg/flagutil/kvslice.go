@@ -41,3 +41,30 @@ func (f *KVSliceFlag) Set(value string) error {
 	}
 	return nil
 }
+
+// KVLinesFlag holds key=value pairs like KVSliceFlag, but pairs are
+// separated by newlines rather than commas, so values may contain commas.
+// Blank lines are ignored.
+type KVLinesFlag [][2]string
+
+func (f *KVLinesFlag) String() string {
+	pairs := []string{}
+	for _, v := range *f {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", v[0], v[1]))
+	}
+	return strings.Join(pairs, "\n")
+}
+
+func (f *KVLinesFlag) Set(value string) error {
+	for _, line := range strings.Split(value, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid value: %v", line)
+		}
+		*f = append(*f, [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return nil
+}
@@ -109,3 +109,56 @@ func TestKVSliceString(t *testing.T) {
 		}
 	}
 }
+
+func TestKVLinesSet(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want [][2]string
+	}{
+		{
+			arg: "foo=bar",
+			want: [][2]string{
+				[2]string{"foo", "bar"},
+			},
+		},
+		{
+			arg: "foo=bar, baz\nping = pong\n",
+			want: [][2]string{
+				[2]string{"foo", "bar, baz"},
+				[2]string{"ping", "pong"},
+			},
+		},
+		{
+			arg: "\n  \nfoo=a=b\n",
+			want: [][2]string{
+				[2]string{"foo", "a=b"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		var f KVLinesFlag
+		if err := f.Set(tt.arg); err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		got := [][2]string(f)
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestKVLinesSetError(t *testing.T) {
+	tests := []string{
+		"foo",
+		"foo=bar\nbaz",
+	}
+
+	for i, tt := range tests {
+		var f KVLinesFlag
+		if err := f.Set(tt); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
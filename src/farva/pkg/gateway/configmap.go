@@ -0,0 +1,235 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	kfields "k8s.io/kubernetes/pkg/fields"
+	kwatch "k8s.io/kubernetes/pkg/watch"
+)
+
+type NGINXConfigGetter interface {
+	NGINXConfig(base NGINXConfig) (NGINXConfig, error)
+}
+
+// parseConfigMapRef splits a "namespace/name" reference to a ConfigMap.
+func parseConfigMapRef(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid ConfigMap reference %q, expected namespace/name", ref)
+	}
+	return parts[0], parts[1], nil
+}
+
+func newNGINXConfigMapGetter(kc *kclient.Client, namespace, name string) *nginxConfigMapGetter {
+	return &nginxConfigMapGetter{
+		kc:        kc,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+type nginxConfigMapGetter struct {
+	kc        *kclient.Client
+	namespace string
+	name      string
+}
+
+func (g *nginxConfigMapGetter) NGINXConfig(base NGINXConfig) (NGINXConfig, error) {
+	cm, err := g.kc.ConfigMaps(g.namespace).Get(g.name)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			kubernetesLog.Infof("nginx ConfigMap %s/%s not found, using defaults", g.namespace, g.name)
+			return base, nil
+		}
+		return base, err
+	}
+
+	return applyNGINXConfigMap(base, cm.Data)
+}
+
+// Watch sends on the returned channel every time the ConfigMap changes. The
+// watch is reestablished whenever the API server closes it.
+func (g *nginxConfigMapGetter) Watch(stop <-chan struct{}) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	opts := kapi.ListOptions{
+		FieldSelector: kfields.OneTermEqualSelector("metadata.name", g.name),
+	}
+
+	go func() {
+		for {
+			w, err := g.kc.ConfigMaps(g.namespace).Watch(opts)
+			if err != nil {
+				kubernetesLog.Errorf("Failed watching nginx ConfigMap %s/%s: %v", g.namespace, g.name, err)
+			} else if !g.forward(w, changed, stop) {
+				return
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	return changed
+}
+
+// forward coalesces events from w onto changed until the watch is closed by
+// the server, in which case it returns true, or stop is closed.
+func (g *nginxConfigMapGetter) forward(w kwatch.Interface, changed chan<- struct{}, stop <-chan struct{}) bool {
+	defer w.Stop()
+	for {
+		select {
+		case <-stop:
+			return false
+		case _, ok := <-w.ResultChan():
+			if !ok {
+				return true
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+var nginxDurationRegexp = regexp.MustCompile(`^[0-9]+(ms|s|m|h|d)?$`)
+
+// mimeTypeRegexp matches a type/subtype MIME type, which nginx reads
+// unquoted.
+var mimeTypeRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9!#&^_.+-]*/[A-Za-z0-9][A-Za-z0-9!#&^_.+-]*$`)
+
+type nginxConfigMapKey func(cfg *NGINXConfig, val string) error
+
+func intKey(field func(*NGINXConfig) *int) nginxConfigMapKey {
+	return func(cfg *NGINXConfig, val string) error {
+		i, err := strconv.Atoi(val)
+		if err != nil || i < 0 {
+			return fmt.Errorf("expected non-negative integer, got %q", val)
+		}
+		*field(cfg) = i
+		return nil
+	}
+}
+
+func boolKey(field func(*NGINXConfig) *bool) nginxConfigMapKey {
+	return func(cfg *NGINXConfig, val string) error {
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("expected boolean, got %q", val)
+		}
+		*field(cfg) = b
+		return nil
+	}
+}
+
+func durationKey(field func(*NGINXConfig) *string) nginxConfigMapKey {
+	return func(cfg *NGINXConfig, val string) error {
+		if !nginxDurationRegexp.MatchString(val) {
+			return fmt.Errorf("expected nginx time value such as 60s, got %q", val)
+		}
+		*field(cfg) = val
+		return nil
+	}
+}
+
+// nginxConfigMapKeys maps each supported ConfigMap key onto the NGINXConfig
+// field it overrides.
+var nginxConfigMapKeys = map[string]nginxConfigMapKey{
+	"worker-processes": func(cfg *NGINXConfig, val string) error {
+		if i, err := strconv.Atoi(val); val != "auto" && (err != nil || i < 1) {
+			return fmt.Errorf("expected \"auto\" or positive integer, got %q", val)
+		}
+		cfg.WorkerProcesses = val
+		return nil
+	},
+	"worker-connections":            intKey(func(c *NGINXConfig) *int { return &c.WorkerConnections }),
+	"worker-rlimit-nofile":          intKey(func(c *NGINXConfig) *int { return &c.WorkerRlimitNofile }),
+	"keepalive":                     intKey(func(c *NGINXConfig) *int { return &c.UpstreamKeepalive }),
+	"keepalive-requests":            intKey(func(c *NGINXConfig) *int { return &c.KeepaliveRequests }),
+	"keepalive-timeout":             durationKey(func(c *NGINXConfig) *string { return &c.KeepaliveTimeout }),
+	"server-names-hash-bucket-size": intKey(func(c *NGINXConfig) *int { return &c.ServerNamesHashBucketSize }),
+	"server-names-hash-max-size":    intKey(func(c *NGINXConfig) *int { return &c.ServerNamesHashMaxSize }),
+	"map-hash-bucket-size":          intKey(func(c *NGINXConfig) *int { return &c.MapHashBucketSize }),
+	"gzip":                          boolKey(func(c *NGINXConfig) *bool { return &c.Gzip }),
+	"gzip-min-length":               intKey(func(c *NGINXConfig) *int { return &c.GzipMinLength }),
+	"gzip-types": func(cfg *NGINXConfig, val string) error {
+		types := strings.Fields(strings.Replace(val, ",", " ", -1))
+		for _, t := range types {
+			if t != "*" && !mimeTypeRegexp.MatchString(t) {
+				return fmt.Errorf("expected MIME types, got %q", t)
+			}
+		}
+		cfg.GzipTypes = types
+		return nil
+	},
+	"proxy-connect-timeout": durationKey(func(c *NGINXConfig) *string { return &c.ProxyConnectTimeout }),
+	"proxy-read-timeout":    durationKey(func(c *NGINXConfig) *string { return &c.ProxyReadTimeout }),
+	"proxy-send-timeout":    durationKey(func(c *NGINXConfig) *string { return &c.ProxySendTimeout }),
+	"client-body-timeout":   durationKey(func(c *NGINXConfig) *string { return &c.ClientBodyTimeout }),
+	"access-log-format": func(cfg *NGINXConfig, val string) error {
+		if val != accessLogFormatMain && val != accessLogFormatJSON {
+			return fmt.Errorf("expected %q or %q, got %q", accessLogFormatMain, accessLogFormatJSON, val)
+		}
+		cfg.AccessLogFormat = val
+		return nil
+	},
+	"log-format": func(cfg *NGINXConfig, val string) error {
+		if strings.ContainsAny(val, "'\\\n") {
+			return fmt.Errorf("log format may not contain single quotes, backslashes or newlines")
+		}
+		cfg.LogFormat = val
+		return nil
+	},
+}
+
+// applyNGINXConfigMap returns a copy of base with the values from a ConfigMap
+// merged on top of it. Unknown keys are ignored with a warning so a newer
+// ConfigMap does not break an older farva, but invalid values are an error.
+func applyNGINXConfigMap(base NGINXConfig, data map[string]string) (NGINXConfig, error) {
+	cfg := base
+
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		set, ok := nginxConfigMapKeys[key]
+		if !ok {
+			kubernetesLog.Warnf("Ignoring unknown nginx ConfigMap key %q", key)
+			continue
+		}
+		if err := set(&cfg, strings.TrimSpace(data[key])); err != nil {
+			return base, fmt.Errorf("invalid value for nginx ConfigMap key %q: %v", key, err)
+		}
+	}
+
+	return cfg, nil
+}
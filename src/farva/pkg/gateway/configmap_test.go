@@ -0,0 +1,192 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestApplyNGINXConfigMap(t *testing.T) {
+	tests := []struct {
+		data map[string]string
+		want func(*NGINXConfig)
+	}{
+		// no data leaves defaults untouched
+		{
+			data: map[string]string{},
+			want: func(*NGINXConfig) {},
+		},
+
+		// typed keys
+		{
+			data: map[string]string{
+				"worker-processes":   "4",
+				"worker-connections": " 4096 ",
+				"keepalive":          "128",
+				"keepalive-timeout":  "30s",
+				"gzip":               "true",
+				"gzip-types":         "text/css, application/json",
+				"log-format":         "$remote_addr $status",
+			},
+			want: func(cfg *NGINXConfig) {
+				cfg.WorkerProcesses = "4"
+				cfg.WorkerConnections = 4096
+				cfg.UpstreamKeepalive = 128
+				cfg.KeepaliveTimeout = "30s"
+				cfg.Gzip = true
+				cfg.GzipTypes = []string{"text/css", "application/json"}
+				cfg.LogFormat = "$remote_addr $status"
+			},
+		},
+
+		// zero leaves the directive at its nginx default
+		{
+			data: map[string]string{
+				"worker-connections": "0",
+				"keepalive":          "0",
+			},
+			want: func(cfg *NGINXConfig) {
+				cfg.WorkerConnections = 0
+				cfg.UpstreamKeepalive = 0
+			},
+		},
+
+		// unknown keys are ignored
+		{
+			data: map[string]string{
+				"not-a-real-key":     "foo",
+				"worker-connections": "1024",
+			},
+			want: func(cfg *NGINXConfig) {
+				cfg.WorkerConnections = 1024
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		want := DefaultNGINXConfig
+		tt.want(&want)
+
+		got, err := applyNGINXConfigMap(DefaultNGINXConfig, tt.data)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := pretty.Compare(want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestApplyNGINXConfigMapError(t *testing.T) {
+	tests := []map[string]string{
+		{"worker-processes": "0"},
+		{"worker-connections": "lots"},
+		{"keepalive": "-1"},
+		{"gzip": "sure"},
+		{"proxy-read-timeout": "1 minute"},
+		{"log-format": "'$status'"},
+		{"log-format": `$status \`},
+		{"gzip-types": "text/html;error_log /tmp/x"},
+		{"gzip-types": "text/html, json"},
+	}
+
+	for i, tt := range tests {
+		if _, err := applyNGINXConfigMap(DefaultNGINXConfig, tt); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestRenderConfigTuning(t *testing.T) {
+	cfg, err := applyNGINXConfigMap(DefaultNGINXConfig, map[string]string{
+		"worker-connections":    "4096",
+		"keepalive":             "16",
+		"gzip":                  "true",
+		"gzip-types":            "text/css",
+		"proxy-connect-timeout": "5s",
+		"log-format":            "$remote_addr $status",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rc := reverseProxyConfig{
+		HTTPUpstreams: []httpReverseProxyUpstream{
+			httpReverseProxyUpstream{
+				Name: "foo",
+				Servers: []reverseProxyUpstreamServer{
+					reverseProxyUpstreamServer{Name: "ping", Host: "ping.example.com", Port: 80},
+				},
+			},
+		},
+	}
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"\n    worker_connections 4096;\n",
+		"\n    log_format  custom  '$remote_addr $status';\n    access_log /dev/stdout custom;\n",
+		"\n    gzip on;\n    gzip_types text/css;\n",
+		"\n    proxy_connect_timeout 5s;\n",
+		"\n        keepalive 16;\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestRenderConfigTuningZero(t *testing.T) {
+	cfg, err := applyNGINXConfigMap(DefaultNGINXConfig, map[string]string{
+		"worker-connections":            "0",
+		"keepalive":                     "0",
+		"server-names-hash-bucket-size": "0",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rc := reverseProxyConfig{
+		HTTPUpstreams: []httpReverseProxyUpstream{
+			httpReverseProxyUpstream{
+				Name: "foo",
+				Servers: []reverseProxyUpstreamServer{
+					reverseProxyUpstreamServer{Name: "ping", Host: "ping.example.com", Port: 80},
+				},
+			},
+		},
+	}
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"\nevents {\n}\n",
+		"\nhttp {\n    log_format",
+		"  # ping\n    }\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+}
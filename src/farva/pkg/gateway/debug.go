@@ -0,0 +1,169 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debugState holds what the Gateway last did so it can be inspected over
+// HTTP without exec-ing into the container.
+type debugState struct {
+	mu sync.Mutex
+
+	lastRefresh         time.Time
+	lastRefreshDuration time.Duration
+	lastRefreshError    error
+
+	// config and rendered are the last successfully applied
+	// reverseProxyConfig and nginx config.
+	config   *reverseProxyConfig
+	rendered []byte
+
+	lastChange time.Time
+	lastDiff   string
+}
+
+func (d *debugState) refreshed(start time.Time, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastRefresh = start
+	d.lastRefreshDuration = time.Since(start)
+	d.lastRefreshError = err
+}
+
+func (d *debugState) applied(rc *reverseProxyConfig, rendered []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.rendered != nil && string(d.rendered) != string(rendered) {
+		d.lastChange = time.Now()
+		d.lastDiff = configDiff(d.rendered, rendered)
+	}
+	d.config = rc
+	d.rendered = rendered
+}
+
+type refreshStatus struct {
+	Time       time.Time `json:"time"`
+	Duration   string    `json:"duration"`
+	Error      string    `json:"error,omitempty"`
+	LastChange time.Time `json:"lastChange"`
+}
+
+func (d *debugState) refreshStatus() refreshStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st := refreshStatus{
+		Time:       d.lastRefresh,
+		Duration:   d.lastRefreshDuration.String(),
+		LastChange: d.lastChange,
+	}
+	if d.lastRefreshError != nil {
+		st.Error = d.lastRefreshError.Error()
+	}
+	return st
+}
+
+// ingressStatusGetter is implemented by ReverseProxyConfigGetters that track
+// the status of each Ingress they process.
+type ingressStatusGetter interface {
+	IngressStatuses() []IngressStatus
+}
+
+// conflictGetter is implemented by ReverseProxyConfigGetters that merge
+// several sources.
+type conflictGetter interface {
+	Conflicts() []HostnameConflict
+}
+
+// newDebugHandler serves read-only views of the Gateway's state under
+// /debug/. Per-Ingress status and hostname conflicts are served if rg
+// tracks them.
+func newDebugHandler(d *debugState, rg ReverseProxyConfigGetter) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/config", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		rc := d.config
+		d.mu.Unlock()
+		writeDebugJSON(w, rc)
+	})
+
+	mux.HandleFunc("/debug/nginx.conf", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		rendered := d.rendered
+		d.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(rendered)
+	})
+
+	mux.HandleFunc("/debug/diff", func(w http.ResponseWriter, r *http.Request) {
+		d.mu.Lock()
+		diff := d.lastDiff
+		d.mu.Unlock()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(diff))
+	})
+
+	mux.HandleFunc("/debug/refresh", func(w http.ResponseWriter, r *http.Request) {
+		writeDebugJSON(w, d.refreshStatus())
+	})
+
+	mux.HandleFunc("/debug/ingresses", func(w http.ResponseWriter, r *http.Request) {
+		statuses := []IngressStatus{}
+		if sg, ok := rg.(ingressStatusGetter); ok {
+			statuses = sg.IngressStatuses()
+		}
+		writeDebugJSON(w, statuses)
+	})
+
+	mux.HandleFunc("/debug/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		conflicts := []HostnameConflict{}
+		if cg, ok := rg.(conflictGetter); ok {
+			conflicts = cg.Conflicts()
+		}
+		writeDebugJSON(w, conflicts)
+	})
+
+	return readOnly(mux)
+}
+
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(enc)
+	w.Write([]byte("\n"))
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeStatusGetter struct {
+	statuses []IngressStatus
+}
+
+func (f *fakeStatusGetter) ReverseProxyConfig() (*reverseProxyConfig, error) {
+	return &reverseProxyConfig{}, nil
+}
+
+func (f *fakeStatusGetter) IngressStatuses() []IngressStatus {
+	return f.statuses
+}
+
+func TestDebugHandler(t *testing.T) {
+	d := &debugState{}
+	d.applied(&reverseProxyConfig{}, []byte("events {}\nhttp {}\n"))
+	d.applied(&reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{Name: "foo.bar.example.com", ListenPort: 7331},
+		},
+	}, []byte("events {}\nhttp { server {} }\n"))
+	d.refreshed(time.Now(), errors.New("boom"))
+
+	h := newDebugHandler(d, &fakeStatusGetter{
+		statuses: []IngressStatus{
+			IngressStatus{Namespace: "bar", Name: "foo", Error: "no such service"},
+		},
+	})
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+		want   string
+	}{
+		{"GET", "/debug/config", 200, `"Name": "foo.bar.example.com"`},
+		{"GET", "/debug/nginx.conf", 200, "http { server {} }"},
+		{"GET", "/debug/diff", 200, "+http { server {} }"},
+		{"GET", "/debug/refresh", 200, `"error": "boom"`},
+		{"GET", "/debug/ingresses", 200, `"error": "no such service"`},
+		{"GET", "/debug/conflicts", 200, "[]"},
+		{"POST", "/debug/refresh", 405, ""},
+		{"GET", "/debug/nope", 404, ""},
+	}
+
+	for i, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("case %d: want code %d, got %d", i, tt.code, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), tt.want) {
+			t.Errorf("case %d: body missing %q:\n%s", i, tt.want, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/kylelemons/godebug/diff"
+)
+
+// configDiffContext is the number of unchanged lines shown around each change.
+const configDiffContext = 2
+
+// configDiff returns a unified-style line diff between two rendered configs
+// that only includes changed lines and a little surrounding context.
+func configDiff(a, b []byte) string {
+	type line struct {
+		op   byte
+		text string
+	}
+
+	var lines []line
+	for _, c := range diff.DiffChunks(strings.Split(string(a), "\n"), strings.Split(string(b), "\n")) {
+		for _, l := range c.Deleted {
+			lines = append(lines, line{'-', l})
+		}
+		for _, l := range c.Added {
+			lines = append(lines, line{'+', l})
+		}
+		for _, l := range c.Equal {
+			lines = append(lines, line{' ', l})
+		}
+	}
+
+	// Mark every line within configDiffContext of a change for output.
+	show := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for j := i - configDiffContext; j <= i+configDiffContext; j++ {
+			if j >= 0 && j < len(lines) {
+				show[j] = true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	skipped := false
+	for i, l := range lines {
+		if !show[i] {
+			skipped = true
+			continue
+		}
+		if skipped && buf.Len() > 0 {
+			buf.WriteString("...\n")
+		}
+		skipped = false
+		fmt.Fprintf(&buf, "%c%s\n", l.op, l.text)
+	}
+	return strings.TrimRight(buf.String(), "\n")
+}
@@ -0,0 +1,55 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"testing"
+)
+
+func TestConfigDiff(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		// identical
+		{
+			a:    "a\nb\nc",
+			b:    "a\nb\nc",
+			want: "",
+		},
+
+		// single change in the middle of a long file
+		{
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n9",
+			want: " 3\n 4\n-5\n+five\n 6\n 7",
+		},
+
+		// separate changes are joined by an ellipsis
+		{
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\nnine",
+			want: "-1\n+one\n 2\n 3\n...\n 7\n 8\n-9\n+nine",
+		},
+	}
+
+	for i, tt := range tests {
+		got := configDiff([]byte(tt.a), []byte(tt.b))
+		if got != tt.want {
+			t.Errorf("case %d: want=\n%s\ngot=\n%s", i, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+func newEndpointDrainer(period time.Duration) *endpointDrainer {
+	return &endpointDrainer{
+		period:   period,
+		now:      time.Now,
+		services: map[string]*drainState{},
+	}
+}
+
+// endpointDrainer keeps endpoints that were removed from a Service, or that
+// stopped being ready, in its upstreams for a grace period. Removed endpoints are
+// marked down and not ready ones backup, so they get no new requests while
+// those in flight finish. Endpoints are only kept while the Service has
+// some ready ones, since nginx needs a primary server.
+type endpointDrainer struct {
+	period time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// services holds the endpoints of each Service port seen at the last
+	// refresh, keyed by namespace/name:port.
+	services map[string]*drainState
+}
+
+type drainState struct {
+	// touched is when the Service was last looked at.
+	touched time.Time
+	servers map[string]*drainingServer
+}
+
+type drainingServer struct {
+	server reverseProxyUpstreamServer
+	// since is when the endpoint stopped being ready, or is zero if it
+	// is ready.
+	since time.Time
+	// drained is set once the grace period of an endpoint that is still
+	// not ready is over, so it isn't drained again.
+	drained bool
+}
+
+// Drain returns the ready servers of a Service port followed by the not
+// ready and removed ones still within the grace period.
+func (d *endpointDrainer) Drain(svcNamespace, svcName string, svcTargetPort int, ready, notReady []reverseProxyUpstreamServer) []reverseProxyUpstreamServer {
+	now := d.now()
+	key := fmt.Sprintf("%s/%s:%d", svcNamespace, svcName, svcTargetPort)
+	log := kubernetesLog.WithFields(logrus.Fields{
+		"service":   svcName,
+		"namespace": svcNamespace,
+		"port":      svcTargetPort,
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	st, ok := d.services[key]
+	if !ok {
+		st = &drainState{servers: map[string]*drainingServer{}}
+		d.services[key] = st
+	}
+	st.touched = now
+
+	servers := map[string]*drainingServer{}
+	for _, s := range ready {
+		addr := serverAddress(s)
+		if prev, ok := st.servers[addr]; ok && !prev.since.IsZero() {
+			log.WithField("endpoint", addr).Info("Endpoint is ready again")
+		}
+		servers[addr] = &drainingServer{server: s}
+	}
+
+	// drain records an endpoint that isn't ready, logging each change of
+	// its state.
+	drain := func(s reverseProxyUpstreamServer, addr, state string) {
+		ds, ok := st.servers[addr]
+		if !ok || ds.since.IsZero() {
+			ds = &drainingServer{since: now}
+			log.WithField("endpoint", addr).Infof("Endpoint %s, draining for %s", state, d.period)
+		} else if ds.server.Down != s.Down && !ds.drained {
+			log.WithField("endpoint", addr).Infof("Endpoint %s, still draining", state)
+		}
+		if !ds.drained && now.Sub(ds.since) >= d.period {
+			ds.drained = true
+			log.WithField("endpoint", addr).Infof("Endpoint %s, finished draining", state)
+		}
+		ds.server = s
+		servers[addr] = ds
+	}
+
+	// Only endpoints that were ready, or already draining, are drained:
+	// new ones that haven't become ready yet must get no requests.
+	backups := []string{}
+	for _, s := range notReady {
+		addr := serverAddress(s)
+		if _, ok := servers[addr]; ok {
+			continue
+		}
+		if _, ok := st.servers[addr]; !ok {
+			continue
+		}
+		s.Backup = true
+		drain(s, addr, "not ready")
+		backups = append(backups, addr)
+	}
+
+	removed := []string{}
+	for addr, ds := range st.servers {
+		if _, ok := servers[addr]; ok {
+			continue
+		}
+		if ds.drained {
+			// Gone for good.
+			continue
+		}
+		s := ds.server
+		s.Backup = false
+		s.Down = true
+		drain(s, addr, "removed")
+		if servers[addr].drained {
+			delete(servers, addr)
+			continue
+		}
+		removed = append(removed, addr)
+	}
+	sort.Strings(removed)
+
+	st.servers = servers
+
+	ups := append([]reverseProxyUpstreamServer{}, ready...)
+	if len(ready) == 0 {
+		return ups
+	}
+	for _, addr := range append(backups, removed...) {
+		if ds := servers[addr]; !ds.drained {
+			ups = append(ups, ds.server)
+		}
+	}
+	return ups
+}
+
+func serverAddress(s reverseProxyUpstreamServer) string {
+	return fmt.Sprintf("%s:%d", s.Host, s.Port)
+}
+
+// Prune forgets Services not looked at for longer than the grace period,
+// whose endpoints would have finished draining anyway.
+func (d *endpointDrainer) Prune() {
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, st := range d.services {
+		if now.Sub(st.touched) > d.period {
+			delete(d.services, key)
+		}
+	}
+}
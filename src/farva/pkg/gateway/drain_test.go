@@ -0,0 +1,248 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+	kapi "k8s.io/kubernetes/pkg/api"
+)
+
+func TestEndpointDrainer(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	d := newEndpointDrainer(10 * time.Second)
+	d.now = func() time.Time { return now }
+
+	a := reverseProxyUpstreamServer{Name: "a", Host: "10.0.0.1", Port: 8080}
+	b := reverseProxyUpstreamServer{Name: "b", Host: "10.0.0.2", Port: 8080}
+	c := reverseProxyUpstreamServer{Name: "c", Host: "10.0.0.3", Port: 8080}
+	backup := func(s reverseProxyUpstreamServer) reverseProxyUpstreamServer {
+		s.Backup = true
+		return s
+	}
+	down := func(s reverseProxyUpstreamServer) reverseProxyUpstreamServer {
+		s.Down = true
+		return s
+	}
+
+	tests := []struct {
+		after    time.Duration
+		ready    []reverseProxyUpstreamServer
+		notReady []reverseProxyUpstreamServer
+		want     []reverseProxyUpstreamServer
+	}{
+		{after: 0, ready: []reverseProxyUpstreamServer{a, b}, want: []reverseProxyUpstreamServer{a, b}},
+
+		// b stops being ready, then goes away, draining from when it
+		// stopped being ready
+		{after: time.Second, ready: []reverseProxyUpstreamServer{a}, notReady: []reverseProxyUpstreamServer{b}, want: []reverseProxyUpstreamServer{a, backup(b)}},
+		{after: 2 * time.Second, ready: []reverseProxyUpstreamServer{a}, want: []reverseProxyUpstreamServer{a, down(b)}},
+		{after: 11 * time.Second, ready: []reverseProxyUpstreamServer{a}, want: []reverseProxyUpstreamServer{a}},
+
+		// c starts up, so it isn't drained before it was ever ready
+		{after: 12 * time.Second, ready: []reverseProxyUpstreamServer{a}, notReady: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{a}},
+		{after: 13 * time.Second, ready: []reverseProxyUpstreamServer{a, c}, want: []reverseProxyUpstreamServer{a, c}},
+
+		// c is not ready for longer than the grace period, and isn't
+		// drained again
+		{after: 14 * time.Second, ready: []reverseProxyUpstreamServer{a}, notReady: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{a, backup(c)}},
+		{after: 24 * time.Second, ready: []reverseProxyUpstreamServer{a}, notReady: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{a}},
+		{after: 25 * time.Second, ready: []reverseProxyUpstreamServer{a}, notReady: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{a}},
+
+		// c becomes ready, and a is removed
+		{after: 26 * time.Second, ready: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{c, down(a)}},
+
+		// without ready endpoints nothing is kept
+		{after: 27 * time.Second, notReady: []reverseProxyUpstreamServer{c}, want: []reverseProxyUpstreamServer{}},
+	}
+
+	for i, tt := range tests {
+		now = start.Add(tt.after)
+		got := d.Drain("shop", "web", 8080, tt.ready, tt.notReady)
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+
+	// Services not looked at for the grace period are forgotten.
+	now = now.Add(11 * time.Second)
+	d.Prune()
+	if len(d.services) != 0 {
+		t.Errorf("expected no Services, got %d", len(d.services))
+	}
+}
+
+const testDrainManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: bar
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses:
+    - ip: 10.0.0.1
+      targetRef: {kind: Pod, name: web-1}
+    ports: [{port: 8080}]
+`
+
+func TestKubernetesEndpointDrain(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testDrainManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.ListenPort = 7331
+	rcg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+	rcg.drainer = newEndpointDrainer(time.Minute)
+
+	if _, err := rcg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The pod stops being ready, then is replaced by a ready one.
+	ep := objs.endpoints["bar/web"]
+	ep.Subsets[0].NotReadyAddresses = ep.Subsets[0].Addresses
+	ep.Subsets[0].Addresses = nil
+	objs.endpoints["bar/web"] = ep
+	if _, err := rcg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ep.Subsets[0].Addresses = []kapi.EndpointAddress{
+		{IP: "10.0.0.2", TargetRef: &kapi.ObjectReference{Kind: "Pod", Name: "web-2"}},
+	}
+	ep.Subsets[0].NotReadyAddresses = nil
+	objs.endpoints["bar/web"] = ep
+	rc, err := rcg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := `
+pid /var/run/nginx.pid;
+error_log /dev/stderr;
+daemon on;
+worker_processes auto;
+
+events {
+    worker_connections 512;
+}
+
+http {
+    server_names_hash_bucket_size 128;
+    log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+                      '$status $body_bytes_sent "$http_referer" '
+                      '"$http_user_agent" "$http_x_forwarded_for"';
+    access_log /dev/stdout main;
+
+    proxy_http_version 1.1;
+    proxy_set_header Connection "";
+
+    # Override the Host header with the value of the
+    # X-Forwarded-Host header only if it is provided.
+    # This allows the upstream service with the most
+    # accurate value for the Host header without having
+    # to be aware they are behind a proxy.
+    map $http_x_forwarded_host $host_value {
+        default $http_host;
+        ~.+ $http_x_forwarded_host;
+    }
+    proxy_set_header Host $host_value;
+
+
+    server {
+        listen 7331;
+        server_name foo.bar.example.com;
+        set $farva_ingress_name "foo";
+        set $farva_ingress_namespace "bar";
+        
+        location / {
+            
+            set $farva_upstream "bar__foo__web__80";
+            proxy_pass http://bar__foo__web__80;
+        }
+
+    }
+
+
+
+    server {
+        listen 7332;
+        server_name localhost;
+
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
+        access_log off;
+        allow 127.0.0.1;
+        deny all;
+
+        location /nginx_status {
+          stub_status on;
+        }
+    }
+
+
+
+    upstream bar__foo__web__80 {
+
+        server 10.0.0.2:8080;  # web-2
+        server 10.0.0.1:8080 down;  # web-1
+        keepalive 64;
+    }
+
+}
+
+stream {
+
+
+}
+`
+	got, err := renderConfig(&DefaultNGINXConfig, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want != string(got) {
+		wantPretty := strings.Replace(want, " ", "÷", -1)
+		gotPretty := strings.Replace(string(got), " ", "÷", -1)
+		t.Errorf("unexpected output: want=%sgot=%s", wantPretty, gotPretty)
+	}
+}
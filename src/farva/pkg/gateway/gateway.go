@@ -17,30 +17,114 @@ package gateway
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
 	"github.com/bcwaldon/klondike/src/farva/pkg/health"
 	"github.com/bcwaldon/klondike/src/farva/pkg/logger"
 	"github.com/bcwaldon/klondike/src/farva/pkg/logpipe"
+	"github.com/bcwaldon/klondike/src/farva/pkg/metrics"
+	klabels "k8s.io/kubernetes/pkg/labels"
 )
 
+var gatewayLog = logger.Component("gateway")
+
 type Config struct {
-	RefreshInterval  time.Duration
-	KubeconfigFile   string
-	ClusterZone      string
-	NGINXDryRun      bool
-	NGINXHealthPort  int
-	HTTPListenPort   int
-	FarvaHealthPort  int
-	AnnotationPrefix string
-	FifoPath         string
+	RefreshInterval     time.Duration
+	NGINXStatusInterval time.Duration
+	KubeconfigFile      string
+	ClusterZone         string
+	NGINXDryRun         bool
+	NGINXHealthPort     int
+	HTTPListenPort      int
+	FarvaHealthPort     int
+	AnnotationPrefix    string
+	AccessLogFifo       string
+	ErrorLogFifo        string
+	NGINXConfigMap      string
+	AccessLogFormat     string
+
+	IngressClass           string
+	UnclassedIngressPolicy string
+
+	// HostnameTemplate derives the canonical hostname of an Ingress in each
+	// of the comma-separated zones in ClusterZone.
+	HostnameTemplate        string
+	CanonicalHostnamePolicy string
+	NamespaceZones          bool
+	RegexHosts              bool
+
+	// DomainOwners lists domain suffixes and the namespaces allowed to
+	// claim hostnames in them.
+	DomainOwners flagutil.KVSliceFlag
+
+	Namespaces        string
+	NamespaceSelector string
+	IngressSelector   string
+
+	// ProxySetHeaders, AddHeaders and ProxyHideHeaders are applied to
+	// every server.
+	ProxySetHeaders  flagutil.KVLinesFlag
+	AddHeaders       flagutil.KVLinesFlag
+	ProxyHideHeaders string
+
+	// ProxyProtocolPorts and ForwardedHeadersPorts are comma-separated
+	// lists of listener ports, and TrustedProxies a comma-separated list
+	// of CIDRs.
+	ProxyProtocolPorts    string
+	ForwardedHeadersPorts string
+	TrustedProxies        string
+
+	// RequestIDHeader names the header used to propagate request IDs, or
+	// is empty to disable them.
+	RequestIDHeader        string
+	RequestIDHonorIncoming bool
+
+	// SnippetDirectives is a comma-separated allowlist of nginx directives
+	// that may be used in snippet annotations.
+	SnippetDirectives string
+
+	// EndpointDrainPeriod is how long endpoints that are removed or stop
+	// being ready stay in upstreams without getting new requests. Zero drops
+	// them right away.
+	EndpointDrainPeriod time.Duration
+
+	// GatewayClass, if set, enables the Gateway API: HTTPRoutes attached
+	// to Gateways of this class are served, and their status is written
+	// as GatewayControllerName.
+	GatewayClass          string
+	GatewayControllerName string
+
+	// StaticConfigFile, if set, names a YAML or JSON file of routes to
+	// hosts outside of Kubernetes, merged with the Ingress-derived config.
+	StaticConfigFile         string
+	StaticConfigPollInterval time.Duration
+
+	LeaderElect                 bool
+	LeaderElectionConfigMap     string
+	LeaderElectionID            string
+	LeaderElectionLeaseDuration time.Duration
 }
 
 var DefaultConfig = Config{
-	HTTPListenPort:  7331,
-	FarvaHealthPort: 7333,
-	FifoPath:        "/nginx.fifo",
+	NGINXStatusInterval: 15 * time.Second,
+	HTTPListenPort:      7331,
+	FarvaHealthPort:     7333,
+	AccessLogFifo:       "/nginx-access.fifo",
+	ErrorLogFifo:        "/nginx-error.fifo",
+	AccessLogFormat:     accessLogFormatMain,
+
+	GatewayControllerName: DefaultGatewayControllerName,
+
+	StaticConfigPollInterval: 5 * time.Second,
+
+	LeaderElectionConfigMap:     "kube-system/farva-leader",
+	LeaderElectionLeaseDuration: 15 * time.Second,
 }
 
 func DefaultHTTPReverseProxyServers(cfg *Config) []httpReverseProxyServer {
@@ -69,41 +153,303 @@ func DefaultReverseProxyConfig(cfg *Config) *reverseProxyConfig {
 	}
 }
 
+// newKubernetesReverseProxyConfigGetterConfig translates the Ingress
+// selection and naming options of cfg.
+func newKubernetesReverseProxyConfigGetterConfig(cfg Config) (*kubernetesReverseProxyConfigGetterConfig, error) {
+	krc := &kubernetesReverseProxyConfigGetterConfig{
+		AnnotationPrefix: cfg.AnnotationPrefix,
+		ListenPort:       cfg.HTTPListenPort,
+
+		ClusterZones:            splitCSV(cfg.ClusterZone),
+		HostnameTemplate:        cfg.HostnameTemplate,
+		CanonicalHostnamePolicy: cfg.CanonicalHostnamePolicy,
+		NamespaceZones:          cfg.NamespaceZones,
+		RegexHosts:              cfg.RegexHosts,
+
+		IngressClass:           cfg.IngressClass,
+		UnclassedIngressPolicy: cfg.UnclassedIngressPolicy,
+	}
+	if krc.HostnameTemplate == "" {
+		krc.HostnameTemplate = DefaultHostnameTemplate
+	}
+	if err := parseHostnameTemplate(krc.HostnameTemplate); err != nil {
+		return nil, fmt.Errorf("invalid hostname template %q: %v", krc.HostnameTemplate, err)
+	}
+	if krc.CanonicalHostnamePolicy == "" {
+		krc.CanonicalHostnamePolicy = CanonicalHostnamePolicyAlways
+	}
+	var err error
+	if krc.DomainOwners, err = parseDomainOwners(cfg.DomainOwners); err != nil {
+		return nil, err
+	}
+	if cfg.Namespaces != "" {
+		krc.Namespaces = splitCSV(cfg.Namespaces)
+	}
+	if cfg.NamespaceSelector != "" {
+		if krc.NamespaceSelector, err = klabels.Parse(cfg.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %v", err)
+		}
+	}
+	if cfg.IngressSelector != "" {
+		if krc.IngressSelector, err = klabels.Parse(cfg.IngressSelector); err != nil {
+			return nil, fmt.Errorf("invalid Ingress selector: %v", err)
+		}
+	}
+	if cfg.SnippetDirectives != "" {
+		krc.SnippetDirectives = map[string]bool{}
+		for _, d := range splitCSV(cfg.SnippetDirectives) {
+			krc.SnippetDirectives[strings.ToLower(d)] = true
+		}
+	}
+	switch krc.UnclassedIngressPolicy {
+	case UnclassedIngressPolicyClaim, UnclassedIngressPolicyIgnore:
+	default:
+		return nil, fmt.Errorf("invalid unclassed Ingress policy %q", krc.UnclassedIngressPolicy)
+	}
+	switch krc.CanonicalHostnamePolicy {
+	case CanonicalHostnamePolicyAlways, CanonicalHostnamePolicyUnlessHost:
+	default:
+		return nil, fmt.Errorf("invalid canonical hostname policy %q", krc.CanonicalHostnamePolicy)
+	}
+	return krc, nil
+}
+
+// newGatewayNGINXConfig builds the NGINXConfig described by cfg, before any
+// ConfigMap overrides are applied.
+func newGatewayNGINXConfig(cfg Config) (NGINXConfig, error) {
+	nginxCfg := newNGINXConfig(cfg.NGINXHealthPort, cfg.ClusterZone, cfg.ErrorLogFifo, cfg.AccessLogFifo)
+	switch cfg.AccessLogFormat {
+	case accessLogFormatMain, accessLogFormatJSON:
+		nginxCfg.AccessLogFormat = cfg.AccessLogFormat
+	default:
+		return nginxCfg, fmt.Errorf("invalid access log format %q", cfg.AccessLogFormat)
+	}
+
+	var err error
+	if nginxCfg.ProxySetHeaders, err = parseHeaders(cfg.ProxySetHeaders); err != nil {
+		return nginxCfg, fmt.Errorf("invalid proxy header: %v", err)
+	}
+	if nginxCfg.AddHeaders, err = parseHeaders(cfg.AddHeaders); err != nil {
+		return nginxCfg, fmt.Errorf("invalid response header: %v", err)
+	}
+	if nginxCfg.ProxyHideHeaders, err = parseHeaderNames(splitCSV(cfg.ProxyHideHeaders)); err != nil {
+		return nginxCfg, fmt.Errorf("invalid hidden header: %v", err)
+	}
+
+	if nginxCfg.ProxyProtocolPorts, err = parsePorts(cfg.ProxyProtocolPorts); err != nil {
+		return nginxCfg, fmt.Errorf("invalid PROXY protocol ports: %v", err)
+	}
+	if nginxCfg.ProxyProtocol(nginxCfg.HealthPort) {
+		return nginxCfg, fmt.Errorf("PROXY protocol can't be enabled on the nginx health port %d", nginxCfg.HealthPort)
+	}
+	if nginxCfg.ForwardedHeadersPorts, err = parsePorts(cfg.ForwardedHeadersPorts); err != nil {
+		return nginxCfg, fmt.Errorf("invalid forwarded headers ports: %v", err)
+	}
+	if nginxCfg.TrustedProxies, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		return nginxCfg, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	if cfg.RequestIDHeader != "" {
+		if err := validateHeaderName(cfg.RequestIDHeader); err != nil {
+			return nginxCfg, fmt.Errorf("invalid request ID header: %v", err)
+		}
+	}
+	if cfg.RequestIDHeader != "" && cfg.RequestIDHonorIncoming && len(nginxCfg.TrustedProxies) == 0 {
+		return nginxCfg, fmt.Errorf("honoring incoming request IDs requires trusted proxies")
+	}
+	nginxCfg.RequestIDHeader = cfg.RequestIDHeader
+	nginxCfg.RequestIDHonorIncoming = cfg.RequestIDHonorIncoming
+	return nginxCfg, nil
+}
+
+// mergeConfigSources merges the config of HTTPRoutes, if gg is not nil, and
+// of the static config file, if any, after the Ingress-derived config, so
+// Ingresses win hostname conflicts, then HTTPRoutes.
+func mergeConfigSources(cfg Config, kg *kubernetesReverseProxyConfigGetter, gg *gatewayAPIReverseProxyConfigGetter) ReverseProxyConfigGetter {
+	sources := []namedReverseProxyConfigGetter{{"kubernetes", kg}}
+	if gg != nil {
+		sources = append(sources, namedReverseProxyConfigGetter{gatewayAPISource, gg})
+	}
+	if cfg.StaticConfigFile != "" {
+		sources = append(sources, namedReverseProxyConfigGetter{"static", newStaticReverseProxyConfigGetter(cfg.StaticConfigFile, cfg.HTTPListenPort)})
+	}
+	if len(sources) == 1 {
+		return kg
+	}
+	return newMultiReverseProxyConfigGetter(sources...)
+}
+
+func parsePorts(csv string) ([]int, error) {
+	ports := []int{}
+	if csv == "" {
+		return ports, nil
+	}
+	for _, s := range splitCSV(csv) {
+		port, err := strconv.Atoi(s)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %q", s)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parseCIDRs accepts CIDRs or single addresses.
+func parseCIDRs(csv string) ([]string, error) {
+	cidrs := []string{}
+	if csv == "" {
+		return cidrs, nil
+	}
+	for _, s := range splitCSV(csv) {
+		if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		cidrs = append(cidrs, s)
+	}
+	return cidrs, nil
+}
+
 func New(cfg Config) (*Gateway, error) {
 	kc, err := newKubernetesClient(cfg.KubeconfigFile)
 	if err != nil {
 		return nil, err
 	}
 
-	krc := &kubernetesReverseProxyConfigGetterConfig{
-		AnnotationPrefix: cfg.AnnotationPrefix,
-		ClusterZone:      cfg.ClusterZone,
-		ListenPort:       cfg.HTTPListenPort,
+	krc, err := newKubernetesReverseProxyConfigGetterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	nginxCfg, err := newGatewayNGINXConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	kg := newReverseProxyConfigGetter(kc, krc)
+	if !cfg.NGINXDryRun && len(krc.SnippetDirectives) > 0 {
+		kg.snippets = newSnippetValidator(nginxCfg)
+	}
+	if cfg.EndpointDrainPeriod > 0 {
+		kg.drainer = newEndpointDrainer(cfg.EndpointDrainPeriod)
+	}
+	var gg *gatewayAPIReverseProxyConfigGetter
+	if cfg.GatewayClass != "" {
+		if cfg.GatewayControllerName == "" {
+			return nil, fmt.Errorf("the Gateway API requires a controller name")
+		}
+		gc := newGatewayAPIClient(kc, cfg.GatewayControllerName)
+		gg = newGatewayAPIReverseProxyConfigGetter(gc, kg, cfg.GatewayClass, cfg.GatewayControllerName)
+		gg.status = gc
+	}
+	rg := mergeConfigSources(cfg, kg, gg)
+
+	// The IngressClass of this farva may name the nginx ConfigMap in its
+	// parameters. It is only read at startup.
+	configMap := cfg.NGINXConfigMap
+	if configMap == "" && cfg.IngressClass != "" {
+		configMap = ingressClassConfigMap(kc, cfg.IngressClass)
+	}
+
+	var cg *nginxConfigMapGetter
+	if configMap != "" {
+		namespace, name, err := parseConfigMapRef(configMap)
+		if err != nil {
+			return nil, err
+		}
+		cg = newNGINXConfigMapGetter(kc, namespace, name)
+	}
+
+	var le *leaderElector
+	if cfg.LeaderElect {
+		namespace, name, err := parseConfigMapRef(cfg.LeaderElectionConfigMap)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.LeaderElectionID == "" {
+			return nil, fmt.Errorf("leader election requires an identity")
+		}
+		if cfg.LeaderElectionLeaseDuration < 3*time.Second {
+			return nil, fmt.Errorf("leader election lease duration must be at least 3s")
+		}
+		le = newLeaderElector(kc.ConfigMaps(namespace), name, cfg.LeaderElectionID, cfg.LeaderElectionLeaseDuration)
 	}
-	rg := newReverseProxyConfigGetter(kc, krc)
 
-	nginxCfg := newNGINXConfig(cfg.NGINXHealthPort, cfg.ClusterZone, cfg.FifoPath, cfg.FifoPath)
 	var nm NGINXManager
 	if cfg.NGINXDryRun {
 		nm = newLoggingNGINXManager()
 	} else {
 		nm = newNGINXManager(nginxCfg)
 	}
-	logger.Log.Infof("Using nginx config: %+v", nginxCfg)
+	gatewayLog.Debugf("Using nginx config: %+v", nginxCfg)
 
 	gw := Gateway{
-		cfg: cfg,
-		rg:  rg,
-		nm:  nm,
+		cfg:      cfg,
+		nginxCfg: nginxCfg,
+		rg:       rg,
+		nm:       nm,
+		le:       le,
+		debug:    &debugState{},
+	}
+	if cg != nil {
+		gw.cg = cg
+	}
+	if gg != nil {
+		gg.isLeader = gw.isLeader
+		gw.gg = gg
 	}
 
 	return &gw, nil
 }
 
 type Gateway struct {
-	cfg Config
-	rg  ReverseProxyConfigGetter
-	nm  NGINXManager
+	cfg      Config
+	nginxCfg NGINXConfig
+	rg       ReverseProxyConfigGetter
+	cg       NGINXConfigGetter
+	nm       NGINXManager
+
+	// goodNGINXCfg is the last NGINXConfig cg produced without error. It
+	// stays in use while the ConfigMap is invalid.
+	goodNGINXCfg *NGINXConfig
+
+	// le is nil when leader election is disabled, in which case every
+	// replica considers itself the leader.
+	le *leaderElector
+
+	// gg, if not nil, writes the status of Gateway API objects once
+	// their config has been applied.
+	gg *gatewayAPIReverseProxyConfigGetter
+
+	debug *debugState
+}
+
+// isLeader reports whether this replica may perform cluster-wide writes such
+// as Ingress status or events. Every replica renders its own nginx config
+// regardless of leadership.
+func (gw *Gateway) isLeader() bool {
+	if gw.le == nil {
+		return true
+	}
+	return gw.le.IsLeader()
+}
+
+// currentNGINXConfig merges any runtime overrides on top of the NGINXConfig
+// the Gateway was constructed with. If the overrides are invalid, the last
+// valid NGINXConfig is used, or the one the Gateway was constructed with.
+func (gw *Gateway) currentNGINXConfig() NGINXConfig {
+	if gw.cg == nil {
+		return gw.nginxCfg
+	}
+	nc, err := gw.cg.NGINXConfig(gw.nginxCfg)
+	if err != nil {
+		if gw.goodNGINXCfg == nil {
+			gatewayLog.Errorf("Failed loading nginx ConfigMap, using defaults: %v", err)
+			return gw.nginxCfg
+		}
+		gatewayLog.Errorf("Failed loading nginx ConfigMap, keeping the last valid one: %v", err)
+		return *gw.goodNGINXCfg
+	}
+	gw.goodNGINXCfg = &nc
+	return nc
 }
 
 func (gw *Gateway) start() error {
@@ -114,8 +460,9 @@ func (gw *Gateway) start() error {
 		return nil
 	}
 
+	nc := gw.currentNGINXConfig()
 	rc := DefaultReverseProxyConfig(&gw.cfg)
-	if err := gw.nm.SetConfig(rc); err != nil {
+	if err := gw.setConfig(&nc, rc); err != nil {
 		return err
 	}
 
@@ -129,18 +476,23 @@ func (gw *Gateway) start() error {
 }
 
 func (gw *Gateway) startHTTPServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/", health.NewHandler())
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/debug/", newDebugHandler(gw.debug, gw.rg))
+
 	s := &http.Server{
 		Addr:    fmt.Sprintf(":%d", gw.cfg.FarvaHealthPort),
-		Handler: health.NewHandler(),
+		Handler: mux,
 	}
 
 	go func() {
-		logger.Log.Fatal(s.ListenAndServe())
+		gatewayLog.Fatal(s.ListenAndServe())
 	}()
 }
 
 func (gw *Gateway) nginxIsRunning() (bool, error) {
-	logger.Log.Info("Checking if nginx is running")
+	gatewayLog.Debug("Checking if nginx is running")
 	st, err := gw.nm.Status()
 	if err != nil {
 		return false, err
@@ -149,7 +501,7 @@ func (gw *Gateway) nginxIsRunning() (bool, error) {
 }
 
 func (gw *Gateway) refresh() error {
-	logger.Log.Info("Refreshing nginx config")
+	gatewayLog.Debug("Refreshing nginx config")
 	rc, err := gw.rg.ReverseProxyConfig()
 	if err != nil {
 		return err
@@ -157,37 +509,107 @@ func (gw *Gateway) refresh() error {
 
 	rc.HTTPServers = append(rc.HTTPServers, DefaultHTTPReverseProxyServers(&gw.cfg)...)
 
-	if err := gw.nm.SetConfig(rc); err != nil {
+	nc := gw.currentNGINXConfig()
+	err = gw.setConfig(&nc, rc)
+	if gw.gg != nil {
+		var conflicts []HostnameConflict
+		if cg, ok := gw.rg.(conflictGetter); ok {
+			conflicts = cg.Conflicts()
+		}
+		gw.gg.WriteStatus(conflicts, err)
+	}
+	return err
+}
+
+// setConfig hands the config to the NGINXManager and, if it was accepted,
+// records it for the debug endpoints.
+func (gw *Gateway) setConfig(nc *NGINXConfig, rc *reverseProxyConfig) error {
+	if err := gw.nm.SetConfig(nc, rc); err != nil {
 		return err
 	}
+
+	rendered, err := renderConfig(nc, rc)
+	if err != nil {
+		gatewayLog.Errorf("Failed rendering nginx config for debugging: %v", err)
+		return nil
+	}
+	gw.debug.applied(rc, rendered)
 	return nil
 }
 
 func (gw *Gateway) Run() error {
 
-	fifoLogger := logpipe.NewLogPipe(gw.cfg.FifoPath)
-	if err := fifoLogger.Start(); err != nil {
-		logger.Log.Fatalf(
-			"Could not start fifo logger, exiting since this will cause NGINX to block: %s",
-			err,
-		)
+	accessLog := logpipe.NewAccessLogPipe(gw.cfg.AccessLogFifo, func(fields logrus.Fields) {
+		metrics.ObserveAccess(fields)
+	})
+	errorLog := logpipe.NewErrorLogPipe(gw.cfg.ErrorLogFifo)
+	metrics.RegisterLogPipeDropped("access", accessLog.Dropped)
+	metrics.RegisterLogPipeDropped("error", errorLog.Dropped)
+
+	for _, lp := range []*logpipe.LogPipe{accessLog, errorLog} {
+		if err := lp.Start(); err != nil {
+			gatewayLog.Fatalf(
+				"Could not start fifo logger, exiting since this will cause NGINX to block: %s",
+				err,
+			)
+		}
+		defer lp.Stop()
 	}
 
 	if err := gw.start(); err != nil {
 		return err
 	}
 
-	logger.Log.Info("Gateway started successfully, entering refresh loop")
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if !gw.cfg.NGINXDryRun {
+		ss := newStubStatusScraper(gw.cfg.NGINXHealthPort, gw.cfg.NGINXStatusInterval)
+		health.Register("nginx", ss.HealthStatus)
+		go ss.Run(stop)
+	}
+
+	if gw.le != nil {
+		health.Register("leader", gw.le.HealthStatus)
+		go gw.le.Run(stop)
+	} else {
+		metrics.SetLeader(true)
+	}
+
+	gatewayLog.Info("Gateway started successfully, entering refresh loop")
 
 	ticker := time.NewTicker(gw.cfg.RefreshInterval)
 
+	// A nil channel blocks forever, so without a ConfigMap or static
+	// config the loop below only ever wakes up on the ticker.
+	var configMapChanged, staticChanged <-chan struct{}
+	if w, ok := gw.cg.(*nginxConfigMapGetter); ok {
+		configMapChanged = w.Watch(stop)
+	}
+	if m, ok := gw.rg.(*multiReverseProxyConfigGetter); ok {
+		for _, src := range m.sources {
+			if w, ok := src.ReverseProxyConfigGetter.(*staticReverseProxyConfigGetter); ok {
+				staticChanged = w.Watch(stop, gw.cfg.StaticConfigPollInterval)
+			}
+		}
+	}
+
 	for {
-		if err := gw.refresh(); err != nil {
-			logger.Log.Infof("Failed refreshing Gateway: %v", err)
+		start := time.Now()
+		err := gw.refresh()
+		if err != nil {
+			gatewayLog.Errorf("Failed refreshing Gateway: %v", err)
 		}
+		gw.debug.refreshed(start, err)
 
 		//NOTE(bcwaldon): receive from the ticker at the
 		// end of the loop to emulate do-while semantics.
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-configMapChanged:
+			gatewayLog.Info("nginx ConfigMap changed, refreshing early")
+		case <-staticChanged:
+			gatewayLog.Info("Static config changed, refreshing early")
+		}
 	}
 }
@@ -0,0 +1,84 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeNGINXConfigGetter struct {
+	workerConnections int
+	err               error
+}
+
+func (g *fakeNGINXConfigGetter) NGINXConfig(base NGINXConfig) (NGINXConfig, error) {
+	if g.err != nil {
+		return NGINXConfig{}, g.err
+	}
+	base.WorkerConnections = g.workerConnections
+	return base, nil
+}
+
+type fakeNGINXManager struct {
+	applied []int
+}
+
+func (m *fakeNGINXManager) Status() (string, error) { return nginxStatusRunning, nil }
+func (m *fakeNGINXManager) Start() error            { return nil }
+
+func (m *fakeNGINXManager) SetConfig(nc *NGINXConfig, rc *reverseProxyConfig) error {
+	m.applied = append(m.applied, nc.WorkerConnections)
+	return nil
+}
+
+func TestGatewayRefreshInvalidConfigMap(t *testing.T) {
+	cg := &fakeNGINXConfigGetter{err: errors.New("invalid worker-connections")}
+	nm := &fakeNGINXManager{}
+	gw := &Gateway{
+		nginxCfg: DefaultNGINXConfig,
+		rg:       &fakeReverseProxyConfigGetter{},
+		cg:       cg,
+		nm:       nm,
+		debug:    &debugState{},
+	}
+
+	// An invalid ConfigMap falls back to the defaults, then to the last
+	// valid ConfigMap, without holding up the rest of the config.
+	for _, step := range []struct {
+		workerConnections int
+		err               error
+	}{
+		{err: cg.err},
+		{workerConnections: 1024},
+		{err: cg.err},
+	} {
+		cg.workerConnections, cg.err = step.workerConnections, step.err
+		if err := gw.refresh(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := []int{DefaultNGINXConfig.WorkerConnections, 1024, 1024}
+	if len(nm.applied) != len(want) {
+		t.Fatalf("want %v, got %v", want, nm.applied)
+	}
+	for i := range want {
+		if want[i] != nm.applied[i] {
+			t.Errorf("refresh %d: want worker connections %d, got %d", i, want[i], nm.applied[i])
+		}
+	}
+}
@@ -0,0 +1,308 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// Group versions of the Gateway API, newest first.
+var gatewayAPIGroupVersions = []string{
+	"gateway.networking.k8s.io/v1",
+	"gateway.networking.k8s.io/v1beta1",
+}
+
+const gatewayAPIGroup = "gateway.networking.k8s.io"
+
+func isGatewayAPIGroupVersion(gv string) bool {
+	return strings.HasPrefix(gv, gatewayAPIGroup+"/")
+}
+
+// DefaultGatewayControllerName identifies farva in the status of Gateway API
+// objects.
+const DefaultGatewayControllerName = "klondike.io/farva"
+
+// gatewayObject decodes the parts of a Gateway that farva uses.
+type gatewayObject struct {
+	ObjectMeta kapi.ObjectMeta `json:"metadata"`
+	Spec       struct {
+		GatewayClassName string            `json:"gatewayClassName"`
+		Listeners        []gatewayListener `json:"listeners"`
+	} `json:"spec"`
+	Status gatewayStatus `json:"status"`
+}
+
+type gatewayListener struct {
+	Name          string  `json:"name"`
+	Hostname      *string `json:"hostname"`
+	Port          int     `json:"port"`
+	Protocol      string  `json:"protocol"`
+	AllowedRoutes *struct {
+		Namespaces *struct {
+			From string `json:"from"`
+		} `json:"namespaces"`
+	} `json:"allowedRoutes"`
+}
+
+// allowsNamespace reports whether routes in namespace may attach to the
+// listener of a Gateway in gatewayNamespace. Namespaces selected by label
+// are not supported.
+func (l *gatewayListener) allowsNamespace(namespace, gatewayNamespace string) bool {
+	from := "Same"
+	if l.AllowedRoutes != nil && l.AllowedRoutes.Namespaces != nil && l.AllowedRoutes.Namespaces.From != "" {
+		from = l.AllowedRoutes.Namespaces.From
+	}
+	switch from {
+	case "All":
+		return true
+	case "Same":
+		return namespace == gatewayNamespace
+	}
+	return false
+}
+
+type gatewayStatus struct {
+	Conditions []gatewayCondition      `json:"conditions,omitempty"`
+	Listeners  []gatewayListenerStatus `json:"listeners,omitempty"`
+}
+
+type gatewayListenerStatus struct {
+	Name           string             `json:"name"`
+	SupportedKinds []gatewayRouteKind `json:"supportedKinds"`
+	AttachedRoutes int                `json:"attachedRoutes"`
+	Conditions     []gatewayCondition `json:"conditions"`
+}
+
+type gatewayRouteKind struct {
+	Group string `json:"group"`
+	Kind  string `json:"kind"`
+}
+
+type gatewayCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+// httpRouteObject decodes an HTTPRoute.
+type httpRouteObject struct {
+	ObjectMeta kapi.ObjectMeta `json:"metadata"`
+	Spec       struct {
+		ParentRefs []gatewayParentRef `json:"parentRefs"`
+		Hostnames  []string           `json:"hostnames"`
+		Rules      []httpRouteRule    `json:"rules"`
+	} `json:"spec"`
+	Status struct {
+		Parents []httpRouteParentStatus `json:"parents,omitempty"`
+	} `json:"status"`
+}
+
+type gatewayParentRef struct {
+	Group       *string `json:"group,omitempty"`
+	Kind        *string `json:"kind,omitempty"`
+	Namespace   *string `json:"namespace,omitempty"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName,omitempty"`
+	Port        *int    `json:"port,omitempty"`
+}
+
+type httpRouteParentStatus struct {
+	ParentRef      gatewayParentRef   `json:"parentRef"`
+	ControllerName string             `json:"controllerName"`
+	Conditions     []gatewayCondition `json:"conditions"`
+}
+
+type httpRouteRule struct {
+	Matches     []httpRouteMatch      `json:"matches"`
+	Filters     []httpRouteFilter     `json:"filters"`
+	BackendRefs []httpRouteBackendRef `json:"backendRefs"`
+}
+
+type httpRouteMatch struct {
+	Path *struct {
+		Type  *string `json:"type"`
+		Value *string `json:"value"`
+	} `json:"path"`
+	Headers     []httpRouteValueMatch `json:"headers"`
+	QueryParams []httpRouteValueMatch `json:"queryParams"`
+	Method      *string               `json:"method"`
+}
+
+type httpRouteValueMatch struct {
+	Type  *string `json:"type"`
+	Name  string  `json:"name"`
+	Value string  `json:"value"`
+}
+
+type httpRouteFilter struct {
+	Type                  string                   `json:"type"`
+	RequestHeaderModifier *httpRouteHeaderModifier `json:"requestHeaderModifier"`
+}
+
+type httpRouteHeaderModifier struct {
+	Set    []httpHeader `json:"set"`
+	Add    []httpHeader `json:"add"`
+	Remove []string     `json:"remove"`
+}
+
+type httpRouteBackendRef struct {
+	Group     *string           `json:"group"`
+	Kind      *string           `json:"kind"`
+	Name      string            `json:"name"`
+	Namespace *string           `json:"namespace"`
+	Port      *int              `json:"port"`
+	Weight    *int              `json:"weight"`
+	Filters   []httpRouteFilter `json:"filters"`
+}
+
+// gatewayAPIObjectGetter lists the Gateway API objects of every namespace.
+type gatewayAPIObjectGetter interface {
+	ListGateways() ([]gatewayObject, error)
+	ListHTTPRoutes() ([]httpRouteObject, error)
+}
+
+// gatewayAPIStatusWriter replaces the status farva owns in Gateway API
+// objects.
+type gatewayAPIStatusWriter interface {
+	UpdateGatewayStatus(gw *gatewayObject, status gatewayStatus) error
+	UpdateHTTPRouteStatus(route *httpRouteObject, parents []httpRouteParentStatus) error
+}
+
+// gatewayAPIClient reads and writes Gateway API objects from the newest
+// group version served by the cluster.
+type gatewayAPIClient struct {
+	api            rawAPI
+	gvs            *groupVersions
+	controllerName string
+}
+
+func newGatewayAPIClient(kc *kclient.Client, controllerName string) *gatewayAPIClient {
+	return &gatewayAPIClient{
+		api:            rawAPI{kc},
+		gvs:            &groupVersions{kind: "Gateway API objects", all: gatewayAPIGroupVersions},
+		controllerName: controllerName,
+	}
+}
+
+func (c *gatewayAPIClient) ListGateways() ([]gatewayObject, error) {
+	var list struct {
+		Items []gatewayObject `json:"items"`
+	}
+	if err := c.list("gateways", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *gatewayAPIClient) ListHTTPRoutes() ([]httpRouteObject, error) {
+	var list struct {
+		Items []httpRouteObject `json:"items"`
+	}
+	if err := c.list("httproutes", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// list decodes the objects of resource in every namespace.
+func (c *gatewayAPIClient) list(resource string, into interface{}) error {
+	return c.gvs.do(func(gv string) error {
+		return c.api.list(gv, kapi.NamespaceAll, resource, nil, into)
+	})
+}
+
+// UpdateGatewayStatus replaces the conditions and listener statuses of a
+// Gateway, keeping any other status such as its addresses.
+func (c *gatewayAPIClient) UpdateGatewayStatus(gw *gatewayObject, status gatewayStatus) error {
+	return c.updateStatus("gateways", gw.ObjectMeta, func(current map[string]interface{}) {
+		current["conditions"] = status.Conditions
+		current["listeners"] = status.Listeners
+	})
+}
+
+// UpdateHTTPRouteStatus replaces the parent statuses written by this
+// controller, keeping those of other controllers.
+func (c *gatewayAPIClient) UpdateHTTPRouteStatus(route *httpRouteObject, parents []httpRouteParentStatus) error {
+	return c.updateStatus("httproutes", route.ObjectMeta, func(current map[string]interface{}) {
+		kept := []interface{}{}
+		existing, _ := current["parents"].([]interface{})
+		for _, p := range existing {
+			if m, ok := p.(map[string]interface{}); ok && m["controllerName"] == c.controllerName {
+				continue
+			}
+			kept = append(kept, p)
+		}
+		for _, p := range parents {
+			kept = append(kept, p)
+		}
+		current["parents"] = kept
+	})
+}
+
+// updateStatus reads the current object so that fields farva doesn't know
+// survive, applies update to its status and writes it to the status
+// subresource. A conflict is left for the next refresh.
+func (c *gatewayAPIClient) updateStatus(resource string, meta kapi.ObjectMeta, update func(status map[string]interface{})) error {
+	gv := c.gvs.get()
+	if gv == "" {
+		return fmt.Errorf("no Gateway API group version found")
+	}
+
+	var obj map[string]interface{}
+	if err := c.api.get(gv, meta.Namespace, resource, meta.Name, &obj); err != nil {
+		return err
+	}
+	status, _ := obj["status"].(map[string]interface{})
+	if status == nil {
+		status = map[string]interface{}{}
+	}
+	update(status)
+	obj["status"] = status
+	return c.api.putStatus(gv, meta.Namespace, resource, meta.Name, obj)
+}
+
+// setCondition returns cond with the transition time carried over from the
+// condition of the same type in existing if its status is unchanged.
+func setCondition(existing []gatewayCondition, cond gatewayCondition, now time.Time) gatewayCondition {
+	for _, c := range existing {
+		if c.Type == cond.Type && c.Status == cond.Status {
+			cond.LastTransitionTime = c.LastTransitionTime
+			return cond
+		}
+	}
+	cond.LastTransitionTime = now.UTC().Format(time.RFC3339)
+	return cond
+}
+
+// ownParentStatuses returns the parent statuses of route written by
+// controllerName.
+func ownParentStatuses(route *httpRouteObject, controllerName string) []httpRouteParentStatus {
+	own := []httpRouteParentStatus{}
+	for _, p := range route.Status.Parents {
+		if p.ControllerName == controllerName {
+			own = append(own, p)
+		}
+	}
+	return own
+}
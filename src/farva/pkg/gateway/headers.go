@@ -0,0 +1,75 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Header names are limited to characters that need no quoting in nginx.
+var headerNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+func validateHeaderName(name string) error {
+	if !headerNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	return nil
+}
+
+// validateHeaderValue rejects values that would break out of the double
+// quoted nginx string they are rendered into. nginx variables such as
+// $request_id are interpolated.
+func validateHeaderValue(value string) error {
+	if strings.ContainsAny(value, "\"\\") {
+		return fmt.Errorf("header value %q may not contain quotes or backslashes", value)
+	}
+	for _, r := range value {
+		if r < ' ' || r == 0x7f {
+			return fmt.Errorf("header value %q may not contain control characters", value)
+		}
+	}
+	return nil
+}
+
+func parseHeaders(kv [][2]string) ([]httpHeader, error) {
+	headers := []httpHeader{}
+	for _, pair := range kv {
+		if err := validateHeaderName(pair[0]); err != nil {
+			return nil, err
+		}
+		if err := validateHeaderValue(pair[1]); err != nil {
+			return nil, err
+		}
+		headers = append(headers, httpHeader{Name: pair[0], Value: pair[1]})
+	}
+	return headers, nil
+}
+
+func parseHeaderNames(names []string) ([]string, error) {
+	valid := []string{}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := validateHeaderName(name); err != nil {
+			return nil, err
+		}
+		valid = append(valid, name)
+	}
+	return valid, nil
+}
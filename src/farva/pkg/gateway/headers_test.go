@@ -0,0 +1,247 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		kv flagutil.KVLinesFlag
+		ok bool
+	}{
+		{flagutil.KVLinesFlag{{"Strict-Transport-Security", "max-age=31536000; includeSubDomains"}}, true},
+		{flagutil.KVLinesFlag{{"X-Upstream", "$farva_upstream"}}, true},
+		{flagutil.KVLinesFlag{{"X-Empty", ""}}, true},
+		{flagutil.KVLinesFlag{{"Cache-Control", "no-store, no-cache"}}, true},
+		{flagutil.KVLinesFlag{{"X Bad", "value"}}, false},
+		{flagutil.KVLinesFlag{{"", "value"}}, false},
+		{flagutil.KVLinesFlag{{"X-Foo;", "value"}}, false},
+		{flagutil.KVLinesFlag{{"X-Foo", `va"lue`}}, false},
+		{flagutil.KVLinesFlag{{"X-Foo", "a\nb"}}, false},
+	}
+
+	for i, tt := range tests {
+		_, err := parseHeaders(tt.kv)
+		if tt.ok && err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+		} else if !tt.ok && err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestGetAnnotationHeaders(t *testing.T) {
+	tests := []struct {
+		val  string
+		want []httpHeader
+	}{
+		{
+			val:  "X-Frame-Options=DENY",
+			want: []httpHeader{httpHeader{Name: "X-Frame-Options", Value: "DENY"}},
+		},
+		{
+			val: "Cache-Control=no-store, no-cache\nContent-Security-Policy=default-src 'self'; img-src *\n",
+			want: []httpHeader{
+				httpHeader{Name: "Cache-Control", Value: "no-store, no-cache"},
+				httpHeader{Name: "Content-Security-Policy", Value: "default-src 'self'; img-src *"},
+			},
+		},
+		{
+			val:  " ",
+			want: nil,
+		},
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	for i, tt := range tests {
+		ing := newTestIngress("default", "foo", map[string]string{krc.annotationKey(AddHeadersKey): tt.val})
+		got, err := krc.getAnnotationHeaders(&ing.Ingress, AddHeadersKey)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestRenderConfigHeaders(t *testing.T) {
+	cfg := DefaultNGINXConfig
+	cfg.ProxySetHeaders = []httpHeader{httpHeader{Name: "X-Gateway", Value: "farva"}}
+	cfg.AddHeaders = []httpHeader{httpHeader{Name: "Strict-Transport-Security", Value: "max-age=31536000"}}
+	cfg.ProxyHideHeaders = []string{"X-Powered-By"}
+
+	rc := reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{
+				Name:       "foo.example.com",
+				ListenPort: 80,
+				Locations: []httpReverseProxyLocation{
+					httpReverseProxyLocation{Path: "/", Upstream: "foo"},
+				},
+				ProxySetHeaders: []httpHeader{httpHeader{Name: "X-Upstream", Value: "$farva_upstream"}},
+			},
+			httpReverseProxyServer{
+				Name:       "bar.example.com",
+				ListenPort: 80,
+				Locations: []httpReverseProxyLocation{
+					httpReverseProxyLocation{Path: "/", Upstream: "bar"},
+				},
+				AddHeaders: []httpHeader{httpHeader{Name: "X-Frame-Options", Value: "DENY"}},
+			},
+		},
+	}
+
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		// global headers in the http block
+		"\n    proxy_set_header Host $host_value;\n    proxy_set_header X-Gateway \"farva\";\n    proxy_hide_header X-Powered-By;\n    add_header Strict-Transport-Security \"max-age=31536000\" always;\n",
+		// a server with its own proxy headers repeats the global ones
+		"\n        server_name foo.example.com;\n        proxy_set_header Connection \"\";\n        proxy_set_header Host $host_value;\n        proxy_set_header X-Gateway \"farva\";\n        proxy_set_header X-Upstream \"$farva_upstream\";\n",
+		// a server with its own response headers repeats the global ones
+		"\n        server_name bar.example.com;\n        add_header Strict-Transport-Security \"max-age=31536000\" always;\n        add_header X-Frame-Options \"DENY\" always;\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestRenderConfigForwardedHeaders(t *testing.T) {
+	cfg := DefaultNGINXConfig
+	cfg.ProxyProtocolPorts = []int{80}
+	cfg.ForwardedHeadersPorts = []int{80, 81}
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+
+	rc := reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{Name: "pp.example.com", ListenPort: 80},
+			httpReverseProxyServer{Name: "xff.example.com", ListenPort: 81},
+			httpReverseProxyServer{Name: "plain.example.com", ListenPort: 82},
+		},
+	}
+
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"\n    geo $realip_remote_addr $farva_trusted_proxy {\n        default 0;\n        10.0.0.0/8 1;\n    }\n",
+		"\n    map \"$farva_trusted_proxy:$http_x_forwarded_for\" $farva_forwarded_for {\n        default $realip_remote_addr;\n        \"~^1:(?<forwarded_for>.+)$\" \"$forwarded_for, $realip_remote_addr\";\n    }\n",
+		"\n    map \"$farva_trusted_proxy:$http_x_forwarded_for\" $farva_proxy_protocol_forwarded_for {\n        default $realip_remote_addr;\n        \"1:\" $proxy_protocol_addr;\n",
+		"\n    map $remote_addr $farva_forwarded_node {\n        default $remote_addr;\n        \"~:\" \"[$remote_addr]\";\n    }\n",
+		"\n        listen 80 proxy_protocol;\n        server_name pp.example.com;\n        set_real_ip_from 10.0.0.0/8;\n        real_ip_header proxy_protocol;\n",
+		"\n        proxy_set_header X-Forwarded-For $farva_proxy_protocol_forwarded_for;\n",
+		"\n        listen 81;\n        server_name xff.example.com;\n        set_real_ip_from 10.0.0.0/8;\n        real_ip_header X-Forwarded-For;\n        real_ip_recursive on;\n        proxy_set_header Connection \"\";\n        proxy_set_header Host $host_value;\n        proxy_set_header X-Real-IP $remote_addr;\n        proxy_set_header X-Forwarded-For $farva_forwarded_for;\n",
+		"\n        proxy_set_header Forwarded 'for=\"$farva_forwarded_node\";proto=$farva_forwarded_proto;host=\"$host\"';\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+
+	plain := string(got)[strings.Index(string(got), "server_name plain.example.com;"):]
+	plain = plain[:strings.Index(plain, "}")]
+	if strings.Contains(plain, "real_ip") || strings.Contains(plain, "proxy_set_header") {
+		t.Errorf("listener without forwarded headers got them:\n%s", plain)
+	}
+}
+
+func TestParsePortsAndCIDRs(t *testing.T) {
+	if _, err := parsePorts("80, 443"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, bad := range []string{"http", "0", "70000"} {
+		if _, err := parsePorts(bad); err == nil {
+			t.Errorf("expected error for port %q", bad)
+		}
+	}
+	if _, err := parseCIDRs("10.0.0.0/8,192.168.1.1,fd00::/8"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := parseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("expected error for invalid CIDR")
+	}
+}
+
+func TestRenderConfigRequestID(t *testing.T) {
+	cfg := DefaultNGINXConfig
+	cfg.RequestIDHeader = "X-Correlation-ID"
+	cfg.RequestIDHonorIncoming = true
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	cfg.AccessLogFormat = accessLogFormatJSON
+
+	rc := reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{
+				Name:       "foo.example.com",
+				ListenPort: 80,
+				AddHeaders: []httpHeader{httpHeader{Name: "X-Frame-Options", Value: "DENY"}},
+			},
+		},
+	}
+
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"\n    geo $realip_remote_addr $farva_trusted_proxy {\n        default 0;\n        10.0.0.0/8 1;\n    }\n",
+		"\n    map \"$farva_trusted_proxy:$http_x_correlation_id\" $farva_request_id {\n        default $request_id;\n        # Keep a well-formed ID sent by a trusted proxy.\n        \"~^1:(?<incoming_request_id>[A-Za-z0-9._:-]{1,128})$\" $incoming_request_id;\n    }\n",
+		"\n    proxy_set_header X-Correlation-ID $farva_request_id;\n    add_header X-Correlation-ID $farva_request_id always;\n",
+		"\n                      '\"request_id\":\"$farva_request_id\",'\n",
+		"\n        add_header X-Correlation-ID $farva_request_id always;\n        add_header X-Frame-Options \"DENY\" always;\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestNewGatewayNGINXConfigRequestID(t *testing.T) {
+	cfg, err := newGatewayNGINXConfig(DefaultConfig)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.RequestIDHeader != "" {
+		t.Errorf("request IDs enabled by default with header %q", cfg.RequestIDHeader)
+	}
+
+	gcfg := DefaultConfig
+	gcfg.RequestIDHeader = "X-Request-ID"
+	gcfg.RequestIDHonorIncoming = true
+	if _, err := newGatewayNGINXConfig(gcfg); err == nil {
+		t.Errorf("expected error honoring incoming request IDs without trusted proxies")
+	}
+
+	gcfg.TrustedProxies = "10.0.0.0/8"
+	if _, err := newGatewayNGINXConfig(gcfg); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultHostnameTemplate derives hostnames of the form
+// name.namespace.zone, as farva always has.
+const DefaultHostnameTemplate = "{{name}}.{{namespace}}.{{zone}}"
+
+// ClusterZoneKey is the Namespace annotation selecting which of the
+// configured cluster zones its Ingresses get canonical hostnames in.
+const ClusterZoneKey = "cluster-zone"
+
+const (
+	// CanonicalHostnamePolicyAlways gives every Ingress a canonical
+	// hostname, in addition to any hosts of its rules.
+	CanonicalHostnamePolicyAlways = "always"
+	// CanonicalHostnamePolicyUnlessHost only gives canonical hostnames to
+	// rules without a host.
+	CanonicalHostnamePolicyUnlessHost = "unless-host"
+)
+
+// SubdomainHeaderKey is the Ingress annotation naming a header in which the
+// subdomain matched by a wildcard hostname is passed to upstreams.
+const SubdomainHeaderKey = "subdomain-header"
+
+var (
+	exactHostnameRE = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?(\.[A-Za-z0-9_]([A-Za-z0-9_-]*[A-Za-z0-9_])?)*$`)
+
+	// Regex hostnames are written to server_name unquoted, so can't
+	// contain anything that would end the directive.
+	regexHostnameRE = regexp.MustCompile(`^~[^\s;{}'"]+$`)
+)
+
+func isWildcardHostname(h string) bool {
+	return strings.HasPrefix(h, "*.")
+}
+
+func isRegexHostname(h string) bool {
+	return strings.HasPrefix(h, "~")
+}
+
+// validateHostname checks a hostname from an Ingress rule or alias. It may
+// be an exact name, a wildcard such as *.example.com, or, if allowRegex, a
+// regular expression prefixed with ~ as accepted by nginx.
+func validateHostname(h string, allowRegex bool) error {
+	switch {
+	case isRegexHostname(h):
+		if !allowRegex {
+			return fmt.Errorf("regex hostname %q is not allowed", h)
+		}
+		if !regexHostnameRE.MatchString(h) {
+			return fmt.Errorf("invalid regex hostname %q", h)
+		}
+		if _, err := regexp.Compile(h[1:]); err != nil {
+			return fmt.Errorf("invalid regex hostname %q: %v", h, err)
+		}
+	case isWildcardHostname(h):
+		if !exactHostnameRE.MatchString(h[2:]) || !strings.Contains(h[2:], ".") {
+			return fmt.Errorf("invalid wildcard hostname %q", h)
+		}
+	default:
+		if !exactHostnameRE.MatchString(h) {
+			return fmt.Errorf("invalid hostname %q", h)
+		}
+	}
+	return nil
+}
+
+// subdomainPattern returns a regex capturing the subdomain matched by a
+// wildcard hostname.
+func subdomainPattern(wildcard string) string {
+	return "^(.+)" + regexp.QuoteMeta(wildcard[1:]) + "$"
+}
+
+var hostnameTemplateVar = regexp.MustCompile(`{{\s*([^}]*?)\s*}}`)
+
+// parseHostnameTemplate checks that tmpl only refers to known variables and
+// includes the Ingress name, so that each Ingress gets its own hostname.
+func parseHostnameTemplate(tmpl string) error {
+	hasName := false
+	for _, m := range hostnameTemplateVar.FindAllStringSubmatch(tmpl, -1) {
+		switch m[1] {
+		case "name":
+			hasName = true
+		case "namespace", "zone":
+		default:
+			return fmt.Errorf("unknown variable %q", m[1])
+		}
+	}
+	if strings.Contains(hostnameTemplateVar.ReplaceAllString(tmpl, ""), "{{") {
+		return fmt.Errorf("unterminated variable")
+	}
+	if !hasName {
+		return fmt.Errorf("must include {{name}}")
+	}
+	return nil
+}
+
+// renderHostname fills in a template accepted by parseHostnameTemplate.
+func renderHostname(tmpl, name, namespace, zone string) string {
+	return hostnameTemplateVar.ReplaceAllStringFunc(tmpl, func(v string) string {
+		switch hostnameTemplateVar.FindStringSubmatch(v)[1] {
+		case "name":
+			return name
+		case "namespace":
+			return namespace
+		default:
+			return zone
+		}
+	})
+}
+
+// canonicalHostnames returns the hostnames of an Ingress in each of zones,
+// in order.
+func (krc *kubernetesReverseProxyConfigGetterConfig) canonicalHostnames(name, namespace string, zones []string) []string {
+	hostnames := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		hostnames = append(hostnames, renderHostname(krc.HostnameTemplate, name, namespace, zone))
+	}
+	return hostnames
+}
+
+// namespaceZones returns the zones selected by the annotation of a
+// Namespace, which must each be one of the configured zones, or nil if
+// the Namespace has no such annotation.
+func (krc *kubernetesReverseProxyConfigGetterConfig) namespaceZones(annotations map[string]string) ([]string, error) {
+	val, ok := annotations[krc.annotationKey(ClusterZoneKey)]
+	if !ok || strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+
+	zones := splitCSV(val)
+	for _, zone := range zones {
+		found := false
+		for _, z := range krc.ClusterZones {
+			if z == zone {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("namespace annotation %s: unknown cluster zone %q", krc.annotationKey(ClusterZoneKey), zone)
+		}
+	}
+	return zones, nil
+}
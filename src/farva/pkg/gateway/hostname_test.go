@@ -0,0 +1,393 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseHostnameTemplate(t *testing.T) {
+	tests := []struct {
+		tmpl string
+		ok   bool
+	}{
+		{tmpl: DefaultHostnameTemplate, ok: true},
+		{tmpl: "{{name}}-{{namespace}}.{{zone}}", ok: true},
+		{tmpl: "{{ name }}.{{zone}}", ok: true},
+		{tmpl: "{{namespace}}.{{zone}}", ok: false},
+		{tmpl: "{{name}}.{{cluster}}", ok: false},
+		{tmpl: "{{name}}.{{zone", ok: false},
+	}
+
+	for i, tt := range tests {
+		err := parseHostnameTemplate(tt.tmpl)
+		if tt.ok != (err == nil) {
+			t.Errorf("case %d: expected ok=%t, got err=%v", i, tt.ok, err)
+		}
+	}
+}
+
+func TestRenderHostname(t *testing.T) {
+	got := renderHostname("{{name}}-{{ namespace }}.{{zone}}", "web", "prod", "k8s.example.com")
+	if want := "web-prod.k8s.example.com"; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "web.prod.k8s.example.com", CanonicalHostname("web", "prod", "k8s.example.com"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+const testHostnameManifest = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: bar
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: baz
+  annotations:
+    klondike.gateway/cluster-zone: b.example.com
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: bar
+  annotations:
+    klondike.gateway/hostname-aliases: foo.example.org
+spec:
+  rules:
+  - http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+  - host: foo.example.net
+    http:
+      paths:
+      - path: /net
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: qux
+  namespace: baz
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{port: 8080}]
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: baz}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: baz}
+  subsets:
+  - addresses: [{ip: 10.0.1.1}]
+    ports: [{port: 8080}]
+`
+
+func TestKubernetesServerNames(t *testing.T) {
+	tests := []struct {
+		policy         string
+		namespaceZones bool
+		want           [][]string
+	}{
+		// every hostname is served by a single server holding the paths
+		// of all rules it applies to
+		{
+			policy: CanonicalHostnamePolicyAlways,
+			want: [][]string{
+				{"foo-bar.a.example.com", "foo-bar.b.example.com", "foo.example.org"},
+				{"foo.example.net"},
+				{"qux-baz.a.example.com", "qux-baz.b.example.com"},
+			},
+		},
+		{
+			policy: CanonicalHostnamePolicyUnlessHost,
+			want: [][]string{
+				{"foo-bar.a.example.com", "foo-bar.b.example.com"},
+				{"foo.example.org"},
+				{"foo.example.net"},
+				{"qux-baz.a.example.com", "qux-baz.b.example.com"},
+			},
+		},
+		{
+			policy:         CanonicalHostnamePolicyAlways,
+			namespaceZones: true,
+			want: [][]string{
+				{"foo-bar.a.example.com", "foo-bar.b.example.com", "foo.example.org"},
+				{"foo.example.net"},
+				{"qux-baz.b.example.com"},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		objs := newManifestObjectGetter()
+		if err := objs.load(strings.NewReader(testHostnameManifest)); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		krc := DefaultKubernetesReverseProxyConfigGetterConfig
+		krc.ClusterZones = []string{"a.example.com", "b.example.com"}
+		krc.HostnameTemplate = "{{name}}-{{namespace}}.{{zone}}"
+		krc.CanonicalHostnamePolicy = tt.policy
+		krc.NamespaceZones = tt.namespaceZones
+
+		rc, err := newReverseProxyConfigGetterFromObjects(objs, &krc).ReverseProxyConfig()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+
+		got := [][]string{}
+		for _, srv := range rc.HTTPServers {
+			got = append(got, append([]string{srv.Name}, srv.AltNames...))
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestKubernetesNamespaceZonesUnknown(t *testing.T) {
+	objs := newManifestObjectGetter()
+	manifest := strings.Replace(testHostnameManifest, "cluster-zone: b.example.com", "cluster-zone: c.example.com", 1)
+	if err := objs.load(strings.NewReader(manifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"a.example.com"}
+	krc.NamespaceZones = true
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+
+	// The Ingress in baz is disabled because of its namespace.
+	if _, err := rg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, st := range rg.IngressStatuses() {
+		if st.Namespace == "baz" && !st.Disabled {
+			t.Errorf("expected Ingress in namespace baz to be disabled: %+v", st)
+		}
+	}
+}
+
+func TestValidateHostname(t *testing.T) {
+	tests := []struct {
+		hostname   string
+		allowRegex bool
+		ok         bool
+	}{
+		{hostname: "www.example.com", ok: true},
+		{hostname: "localhost", ok: true},
+		{hostname: "*.preview.example.com", ok: true},
+		{hostname: `~^(www|api)\.example\.com$`, allowRegex: true, ok: true},
+		{hostname: `~^(www|api)\.example\.com$`, ok: false},
+		{hostname: "*.com", ok: false},
+		{hostname: "www.*.example.com", ok: false},
+		{hostname: "-www.example.com", ok: false},
+		{hostname: "example.com; include /etc/passwd", ok: false},
+		{hostname: "~^a{2}$", allowRegex: true, ok: false},
+		{hostname: "~^(a$", allowRegex: true, ok: false},
+	}
+
+	for i, tt := range tests {
+		err := validateHostname(tt.hostname, tt.allowRegex)
+		if tt.ok != (err == nil) {
+			t.Errorf("case %d: expected ok=%t, got err=%v", i, tt.ok, err)
+		}
+	}
+}
+
+const testSubdomainManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: bar
+  annotations:
+    klondike.gateway/hostname-aliases: "*.preview.example.com, www.example.com"
+    klondike.gateway/subdomain-header: X-Preview-Branch
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{port: 8080}]
+`
+
+func TestKubernetesSubdomainHeader(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testSubdomainManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.ListenPort = 7331
+	rc, err := newReverseProxyConfigGetterFromObjects(objs, &krc).ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	srv := rc.HTTPServers[0]
+	if diff := pretty.Compare([]string{`^(.+)\.preview\.example\.com$`}, srv.SubdomainPatterns); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+	if diff := pretty.Compare([]httpHeader{{Name: "X-Preview-Branch", Value: "$farva_subdomain"}}, srv.ProxySetHeaders); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	want := `
+pid /var/run/nginx.pid;
+error_log /dev/stderr;
+daemon on;
+worker_processes auto;
+
+events {
+    worker_connections 512;
+}
+
+http {
+    server_names_hash_bucket_size 128;
+    log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+                      '$status $body_bytes_sent "$http_referer" '
+                      '"$http_user_agent" "$http_x_forwarded_for"';
+    access_log /dev/stdout main;
+
+    proxy_http_version 1.1;
+    proxy_set_header Connection "";
+
+    # Override the Host header with the value of the
+    # X-Forwarded-Host header only if it is provided.
+    # This allows the upstream service with the most
+    # accurate value for the Host header without having
+    # to be aware they are behind a proxy.
+    map $http_x_forwarded_host $host_value {
+        default $http_host;
+        ~.+ $http_x_forwarded_host;
+    }
+    proxy_set_header Host $host_value;
+
+
+    server {
+        listen 7331;
+        server_name foo.bar.example.com *.preview.example.com www.example.com;
+        set $farva_ingress_name "foo";
+        set $farva_ingress_namespace "bar";
+        set $farva_subdomain "";
+        if ($host ~* "^(.+)\.preview\.example\.com$") {
+            set $farva_subdomain $1;
+        }
+        proxy_set_header Connection "";
+        proxy_set_header Host $host_value;
+        proxy_set_header X-Preview-Branch "$farva_subdomain";
+        
+        location / {
+            
+            set $farva_upstream "bar__foo__web__80";
+            proxy_pass http://bar__foo__web__80;
+        }
+
+    }
+
+
+
+    server {
+        listen 7332;
+        server_name localhost;
+
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
+        access_log off;
+        allow 127.0.0.1;
+        deny all;
+
+        location /nginx_status {
+          stub_status on;
+        }
+    }
+
+
+
+    upstream bar__foo__web__80 {
+
+        server 10.0.0.1:8080;  # 10.0.0.1
+        keepalive 64;
+    }
+
+}
+
+stream {
+
+
+}
+`
+	got, err := renderConfig(&DefaultNGINXConfig, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want != string(got) {
+		wantPretty := strings.Replace(want, " ", "÷", -1)
+		gotPretty := strings.Replace(string(got), " ", "÷", -1)
+		t.Errorf("unexpected output: want=%sgot=%s", wantPretty, gotPretty)
+	}
+}
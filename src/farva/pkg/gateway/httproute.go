@@ -0,0 +1,1075 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+)
+
+// Reasons used in the status conditions of Gateway API objects.
+const (
+	reasonAccepted                   = "Accepted"
+	reasonProgrammed                 = "Programmed"
+	reasonResolvedRefs               = "ResolvedRefs"
+	reasonInvalid                    = "Invalid"
+	reasonUnsupportedProtocol        = "UnsupportedProtocol"
+	reasonUnsupportedValue           = "UnsupportedValue"
+	reasonNotAllowedByListeners      = "NotAllowedByListeners"
+	reasonNoMatchingListenerHostname = "NoMatchingListenerHostname"
+	reasonNoMatchingParent           = "NoMatchingParent"
+	reasonInvalidKind                = "InvalidKind"
+	reasonRefNotPermitted            = "RefNotPermitted"
+	reasonBackendNotFound            = "BackendNotFound"
+	reasonHostnameConflict           = "HostnameConflict"
+)
+
+// gatewayAPISource names the Gateway API source of the merged config.
+const gatewayAPISource = "gateway-api"
+
+var queryParamNameRE = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func newGatewayAPIReverseProxyConfigGetter(objs gatewayAPIObjectGetter, kg *kubernetesReverseProxyConfigGetter, class, controllerName string) *gatewayAPIReverseProxyConfigGetter {
+	return &gatewayAPIReverseProxyConfigGetter{
+		objs:           objs,
+		kg:             kg,
+		class:          class,
+		controllerName: controllerName,
+	}
+}
+
+// gatewayAPIReverseProxyConfigGetter generates servers from the HTTPRoutes
+// attached to the Gateways of a GatewayClass. Services and endpoints are
+// read through the Ingress getter.
+type gatewayAPIReverseProxyConfigGetter struct {
+	objs           gatewayAPIObjectGetter
+	kg             *kubernetesReverseProxyConfigGetter
+	class          string
+	controllerName string
+
+	// status, if not nil, receives the status of Gateways and HTTPRoutes
+	// whenever isLeader, if set, allows it.
+	status   gatewayAPIStatusWriter
+	isLeader func() bool
+
+	// now is replaced in tests.
+	now func() time.Time
+
+	mu sync.Mutex
+	// last is the most recent config generated without error, served
+	// while the Gateway API can't be read.
+	last *reverseProxyConfig
+	// pending is the status computed with last, written by WriteStatus.
+	pending *gatewayAPIStatus
+}
+
+// gatewayAPIStatus is the status of Gateway API objects computed during a
+// refresh, before the config it describes is applied.
+type gatewayAPIStatus struct {
+	gateways []gatewayObject
+	ours     map[string]*gatewayObject
+	attached map[string]map[string]int
+	routes   []httpRouteObject
+	parents  [][]httpRouteParentStatus
+	// servers holds, for each parent status of each route, the keys of
+	// the servers the route was attached to, by listener name.
+	servers [][]map[string][]string
+}
+
+// gatewayRuleConfig is an HTTPRoute rule translated for one location match.
+type gatewayRuleConfig struct {
+	matches []gatewayMatchConfig
+	route   httpRoute
+	set     []httpHeader
+	add     []httpHeader
+	remove  []string
+}
+
+type gatewayMatchConfig struct {
+	locs       []httpReverseProxyLocation
+	conditions []httpRouteCondition
+	rank       routeRank
+}
+
+// routeRank orders the matches sharing a location by the precedence the
+// Gateway API gives them.
+type routeRank struct {
+	// path is the length of a prefix path, or higher than any for an
+	// exact one.
+	path    int
+	method  int
+	headers int
+	queries int
+	// seq counts matches from the oldest route, so lower wins.
+	seq int
+}
+
+func (r routeRank) less(o routeRank) bool {
+	switch {
+	case r.path != o.path:
+		return r.path < o.path
+	case r.method != o.method:
+		return r.method < o.method
+	case r.headers != o.headers:
+		return r.headers < o.headers
+	case r.queries != o.queries:
+		return r.queries < o.queries
+	}
+	return r.seq > o.seq
+}
+
+// translatedHTTPRoute is an HTTPRoute translated independently of the
+// Gateways it attaches to.
+type translatedHTTPRoute struct {
+	rules     []gatewayRuleConfig
+	upstreams []httpReverseProxyUpstream
+
+	// unsupported, if set, explains why the route can't be accepted.
+	unsupported string
+	// refReason and refMessage explain why a backend couldn't be
+	// resolved. Rules with such backends return 500.
+	refReason  string
+	refMessage string
+}
+
+// ReverseProxyConfig generates servers from the HTTPRoutes of our Gateways.
+// If the Gateway API can't be read, for instance because its CRDs aren't
+// installed, the last config generated is served instead, so that the
+// other sources are still refreshed.
+func (g *gatewayAPIReverseProxyConfigGetter) ReverseProxyConfig() (*reverseProxyConfig, error) {
+	rc, status, err := g.reverseProxyConfig()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil {
+		kubernetesLog.Errorf("Failed generating config from the Gateway API, keeping the last one: %v", err)
+		g.pending = nil
+		if g.last == nil {
+			return &reverseProxyConfig{}, nil
+		}
+		return g.last, nil
+	}
+	g.last = rc
+	g.pending = status
+	return rc, nil
+}
+
+func (g *gatewayAPIReverseProxyConfigGetter) reverseProxyConfig() (*reverseProxyConfig, *gatewayAPIStatus, error) {
+	gateways, err := g.objs.ListGateways()
+	if err != nil {
+		return nil, nil, err
+	}
+	routes, err := g.objs.ListHTTPRoutes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ours := map[string]*gatewayObject{}
+	attached := map[string]map[string]int{}
+	for i := range gateways {
+		gw := &gateways[i]
+		if gw.Spec.GatewayClassName != g.class {
+			continue
+		}
+		key := gw.ObjectMeta.Namespace + "/" + gw.ObjectMeta.Name
+		ours[key] = gw
+		attached[key] = map[string]int{}
+	}
+
+	sort.Sort(httpRoutesByAge(routes))
+
+	b := newGatewayConfigBuilder()
+	parents := make([][]httpRouteParentStatus, len(routes))
+	servers := make([][]map[string][]string, len(routes))
+	seq := 0
+	for i := range routes {
+		route := &routes[i]
+		log := kubernetesLog.WithFields(logrus.Fields{
+			"httproute": route.ObjectMeta.Name,
+			"namespace": route.ObjectMeta.Namespace,
+		})
+
+		tr, err := g.translate(route, &seq)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		upstreamsAdded := false
+		for _, ref := range route.Spec.ParentRefs {
+			if !isGatewayParentRef(ref) {
+				continue
+			}
+			namespace := route.ObjectMeta.Namespace
+			if ref.Namespace != nil && *ref.Namespace != "" {
+				namespace = *ref.Namespace
+			}
+			key := namespace + "/" + ref.Name
+			gw, ok := ours[key]
+			if !ok {
+				continue
+			}
+
+			attachedTo := map[string][]string{}
+			accepted := g.attach(b, route, tr, ref, gw, attachedTo)
+			for name := range attachedTo {
+				attached[key][name]++
+			}
+			if accepted.Status == "True" && !upstreamsAdded {
+				b.upstreams = append(b.upstreams, tr.upstreams...)
+				upstreamsAdded = true
+			}
+			if accepted.Status != "True" {
+				log.WithField("gateway", key).Infof("HTTPRoute not accepted: %s", accepted.Message)
+			}
+
+			resolved := gatewayCondition{Type: "ResolvedRefs", Status: "True", Reason: reasonResolvedRefs}
+			if tr.refReason != "" {
+				resolved = gatewayCondition{Type: "ResolvedRefs", Status: "False", Reason: tr.refReason, Message: tr.refMessage}
+			}
+			parents[i] = append(parents[i], httpRouteParentStatus{
+				ParentRef:      ref,
+				ControllerName: g.controllerName,
+				Conditions:     []gatewayCondition{accepted, resolved},
+			})
+			servers[i] = append(servers[i], attachedTo)
+		}
+	}
+
+	rc, err := b.reverseProxyConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	status := &gatewayAPIStatus{
+		gateways: gateways,
+		ours:     ours,
+		attached: attached,
+		routes:   routes,
+		parents:  parents,
+		servers:  servers,
+	}
+	return rc, status, nil
+}
+
+func isGatewayParentRef(ref gatewayParentRef) bool {
+	return (ref.Group == nil || *ref.Group == gatewayAPIGroup) && (ref.Kind == nil || *ref.Kind == "Gateway")
+}
+
+// attach adds the servers of route for every listener of gw it may attach
+// to, recording their keys in attached by listener name, and returns the
+// Accepted condition of the route for that parent.
+func (g *gatewayAPIReverseProxyConfigGetter) attach(b *gatewayConfigBuilder, route *httpRouteObject, tr *translatedHTTPRoute, ref gatewayParentRef, gw *gatewayObject, attached map[string][]string) gatewayCondition {
+	notAccepted := func(reason, format string, args ...interface{}) gatewayCondition {
+		return gatewayCondition{Type: "Accepted", Status: "False", Reason: reason, Message: fmt.Sprintf(format, args...)}
+	}
+	if tr.unsupported != "" {
+		return notAccepted(reasonUnsupportedValue, "%s", tr.unsupported)
+	}
+
+	namespace := route.ObjectMeta.Namespace
+	listeners := []*gatewayListener{}
+	for i := range gw.Spec.Listeners {
+		l := &gw.Spec.Listeners[i]
+		if ref.SectionName != nil && *ref.SectionName != l.Name {
+			continue
+		}
+		if ref.Port != nil && *ref.Port != l.Port {
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return notAccepted(reasonNoMatchingParent, "no listener matches the parentRef")
+	}
+
+	allowed := []*gatewayListener{}
+	for _, l := range listeners {
+		if l.Protocol == "HTTP" && l.allowsNamespace(namespace, gw.ObjectMeta.Namespace) {
+			allowed = append(allowed, l)
+		}
+	}
+	if len(allowed) == 0 {
+		return notAccepted(reasonNotAllowedByListeners, "no HTTP listener allows routes from namespace %s", namespace)
+	}
+
+	problems := []string{}
+	added := false
+	for _, l := range allowed {
+		listenerHostname := ""
+		if l.Hostname != nil {
+			listenerHostname = strings.ToLower(*l.Hostname)
+		}
+		hostnames := intersectHostnames(listenerHostname, route.Spec.Hostnames)
+		if len(hostnames) == 0 {
+			continue
+		}
+
+		for _, h := range hostnames {
+			if err := g.kg.krc.DomainOwners.check(h, namespace); err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			for _, rule := range tr.rules {
+				b.add(l.Port, h, rule)
+			}
+			attached[l.Name] = append(attached[l.Name], gatewayServerKey(h, l.Port))
+			added = true
+		}
+	}
+
+	if !added {
+		if len(problems) > 0 {
+			return notAccepted(reasonNotAllowedByListeners, "%s", strings.Join(problems, "; "))
+		}
+		if len(route.Spec.Hostnames) == 0 {
+			return notAccepted(reasonNoMatchingListenerHostname, "neither the listener nor the HTTPRoute has a hostname")
+		}
+		return notAccepted(reasonNoMatchingListenerHostname, "no hostname of the HTTPRoute matches a listener")
+	}
+	return gatewayCondition{Type: "Accepted", Status: "True", Reason: reasonAccepted, Message: strings.Join(problems, "; ")}
+}
+
+// intersectHostnames returns the hostnames served for a route attached to
+// a listener: those of the route that the listener hostname covers, or the
+// listener hostname where a route wildcard covers it.
+func intersectHostnames(listener string, routeHostnames []string) []string {
+	if len(routeHostnames) == 0 {
+		if listener == "" {
+			return nil
+		}
+		return []string{listener}
+	}
+
+	hostnames := []string{}
+	seen := map[string]bool{}
+	for _, h := range routeHostnames {
+		h = strings.ToLower(h)
+		switch {
+		case listener == "" || h == listener || hostnameCovers(listener, h):
+		case hostnameCovers(h, listener):
+			h = listener
+		default:
+			continue
+		}
+		if !seen[h] {
+			seen[h] = true
+			hostnames = append(hostnames, h)
+		}
+	}
+	return hostnames
+}
+
+func hostnameCovers(wildcard, h string) bool {
+	return isWildcardHostname(wildcard) && strings.HasSuffix(h, wildcard[1:])
+}
+
+// translate builds the locations and upstreams of every rule of route.
+// Only errors talking to the API are returned; problems with the route
+// itself are recorded in the result.
+func (g *gatewayAPIReverseProxyConfigGetter) translate(route *httpRouteObject, seq *int) (*translatedHTTPRoute, error) {
+	tr := &translatedHTTPRoute{}
+
+	for _, h := range route.Spec.Hostnames {
+		if err := validateHostname(strings.ToLower(h), false); err != nil {
+			tr.unsupported = err.Error()
+			return tr, nil
+		}
+	}
+
+	for ri, rule := range route.Spec.Rules {
+		rc, err := translateHTTPRouteRule(&rule, seq)
+		if err != nil {
+			tr.unsupported = fmt.Sprintf("rule %d: %v", ri, err)
+			return tr, nil
+		}
+
+		up := httpReverseProxyUpstream{
+			Name: strings.Join([]string{"gateway", route.ObjectMeta.Namespace, route.ObjectMeta.Name, fmt.Sprint(ri)}, "__"),
+		}
+		reason, message, err := g.resolveBackends(route, &rule, &up)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case reason != "":
+			if tr.refReason == "" {
+				tr.refReason, tr.refMessage = reason, message
+			}
+			rc.route.StaticCode = 500
+		case len(up.Servers) == 0:
+			rc.route.StaticCode = 503
+		default:
+			rc.route.Upstream = up.Name
+			tr.upstreams = append(tr.upstreams, up)
+		}
+		tr.rules = append(tr.rules, *rc)
+	}
+
+	return tr, nil
+}
+
+// translateHTTPRouteRule translates the matches and filters of rule.
+func translateHTTPRouteRule(rule *httpRouteRule, seq *int) (*gatewayRuleConfig, error) {
+	rc := &gatewayRuleConfig{}
+
+	for _, f := range rule.Filters {
+		if f.Type != "RequestHeaderModifier" || f.RequestHeaderModifier == nil {
+			return nil, fmt.Errorf("filter type %s is not supported", f.Type)
+		}
+		m := f.RequestHeaderModifier
+		for _, h := range m.Set {
+			if err := validateRouteHeader(h.Name, h.Value); err != nil {
+				return nil, err
+			}
+			rc.set = append(rc.set, h)
+		}
+		for _, h := range m.Add {
+			if err := validateRouteHeader(h.Name, h.Value); err != nil {
+				return nil, err
+			}
+			rc.add = append(rc.add, h)
+		}
+		for _, name := range m.Remove {
+			if err := validateRouteHeader(name, ""); err != nil {
+				return nil, err
+			}
+			rc.remove = append(rc.remove, name)
+		}
+	}
+
+	for _, b := range rule.BackendRefs {
+		if len(b.Filters) > 0 {
+			return nil, fmt.Errorf("backendRef filters are not supported")
+		}
+	}
+
+	matches := rule.Matches
+	if len(matches) == 0 {
+		matches = []httpRouteMatch{{}}
+	}
+	for _, m := range matches {
+		mc, err := translateHTTPRouteMatch(&m)
+		if err != nil {
+			return nil, err
+		}
+		mc.rank.seq = *seq
+		*seq++
+		rc.matches = append(rc.matches, *mc)
+	}
+
+	return rc, nil
+}
+
+func translateHTTPRouteMatch(m *httpRouteMatch) (*gatewayMatchConfig, error) {
+	mc := &gatewayMatchConfig{}
+
+	pathType, path := "PathPrefix", "/"
+	if m.Path != nil {
+		if m.Path.Type != nil {
+			pathType = *m.Path.Type
+		}
+		if m.Path.Value != nil {
+			path = *m.Path.Value
+		}
+	}
+	var err error
+	switch pathType {
+	case "Exact":
+		mc.locs, err = pathLocations(path, PathTypeExact)
+		mc.rank.path = 1 << 30
+	case "PathPrefix":
+		mc.locs, err = pathLocations(path, PathTypePrefix)
+		mc.rank.path = len(strings.TrimRight(path, "/"))
+	case "RegularExpression":
+		mc.locs, err = pathLocations(path, PathTypeImplementationSpecific)
+	default:
+		return nil, fmt.Errorf("path match type %s is not supported", pathType)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Method != nil {
+		if !exactHostnameRE.MatchString(*m.Method) {
+			return nil, fmt.Errorf("invalid method %q", *m.Method)
+		}
+		mc.conditions = append(mc.conditions, httpRouteCondition{Variable: "$request_method", Operator: "=", Value: *m.Method})
+		mc.rank.method = 1
+	}
+
+	for _, h := range m.Headers {
+		if err := validateHeaderName(h.Name); err != nil {
+			return nil, err
+		}
+		cond, err := valueMatchCondition(headerVariable(h.Name), h)
+		if err != nil {
+			return nil, err
+		}
+		mc.conditions = append(mc.conditions, cond)
+	}
+	mc.rank.headers = len(m.Headers)
+
+	for _, q := range m.QueryParams {
+		if !queryParamNameRE.MatchString(q.Name) {
+			return nil, fmt.Errorf("query parameter name %q is not supported", q.Name)
+		}
+		cond, err := valueMatchCondition("$arg_"+q.Name, q)
+		if err != nil {
+			return nil, err
+		}
+		mc.conditions = append(mc.conditions, cond)
+	}
+	mc.rank.queries = len(m.QueryParams)
+
+	return mc, nil
+}
+
+// valueMatchCondition translates a header or query parameter match on
+// variable. Exact values are compared as literal strings, so may not
+// contain nginx variables.
+func valueMatchCondition(variable string, m httpRouteValueMatch) (httpRouteCondition, error) {
+	matchType := "Exact"
+	if m.Type != nil {
+		matchType = *m.Type
+	}
+	cond := httpRouteCondition{Variable: variable, Value: m.Value}
+	switch matchType {
+	case "Exact":
+		if err := validateHeaderValue(m.Value); err != nil {
+			return cond, err
+		}
+		if strings.Contains(m.Value, "$") {
+			return cond, fmt.Errorf("value %q of %s may not contain $", m.Value, m.Name)
+		}
+		cond.Operator = "="
+	case "RegularExpression":
+		if strings.ContainsAny(m.Value, "\"\n\r") || strings.HasSuffix(m.Value, "\\") {
+			return cond, fmt.Errorf("invalid regular expression %q for %s", m.Value, m.Name)
+		}
+		if _, err := regexp.Compile(m.Value); err != nil {
+			return cond, fmt.Errorf("invalid regular expression %q for %s: %v", m.Value, m.Name, err)
+		}
+		cond.Operator = "~"
+	default:
+		return cond, fmt.Errorf("match type %s is not supported", matchType)
+	}
+	return cond, nil
+}
+
+func headerVariable(name string) string {
+	return "$http_" + strings.ToLower(strings.Replace(name, "-", "_", -1))
+}
+
+// validateRouteHeader checks a header modified by a route. Values are
+// literal, so may not refer to nginx variables.
+func validateRouteHeader(name, value string) error {
+	if err := validateHeaderName(name); err != nil {
+		return err
+	}
+	switch strings.ToLower(name) {
+	case "host", "connection":
+		return fmt.Errorf("header %s may not be modified", name)
+	}
+	if err := validateHeaderValue(value); err != nil {
+		return err
+	}
+	if strings.Contains(value, "$") {
+		return fmt.Errorf("header value %q may not contain $", value)
+	}
+	return nil
+}
+
+// resolveBackends fills up with the endpoints of the Services of rule,
+// weighted as requested, and how to reach them. If a backend can't be resolved, the reason and a
+// message are returned and up is left empty.
+func (g *gatewayAPIReverseProxyConfigGetter) resolveBackends(route *httpRouteObject, rule *httpRouteRule, up *httpReverseProxyUpstream) (string, string, error) {
+	namespace := route.ObjectMeta.Namespace
+
+	type weighted struct {
+		weight  int
+		servers []reverseProxyUpstreamServer
+	}
+	backends := []weighted{}
+	scheme, host, first := "", "", true
+
+	for _, ref := range rule.BackendRefs {
+		if (ref.Group != nil && *ref.Group != "") || (ref.Kind != nil && *ref.Kind != "Service") {
+			return reasonInvalidKind, fmt.Sprintf("backendRef %s is not a Service", ref.Name), nil
+		}
+		if ref.Namespace != nil && *ref.Namespace != namespace {
+			return reasonRefNotPermitted, fmt.Sprintf("backendRef %s/%s is in another namespace", *ref.Namespace, ref.Name), nil
+		}
+		if ref.Port == nil {
+			return reasonBackendNotFound, fmt.Sprintf("backendRef %s has no port", ref.Name), nil
+		}
+		weight := 1
+		if ref.Weight != nil {
+			weight = *ref.Weight
+		}
+		if weight == 0 {
+			continue
+		}
+
+		svc, err := g.kg.objs.GetService(namespace, ref.Name)
+		if kerrors.IsNotFound(err) {
+			return reasonBackendNotFound, fmt.Sprintf("Service %s not found", ref.Name), nil
+		} else if err != nil {
+			return "", "", err
+		}
+		var servers []reverseProxyUpstreamServer
+		svcScheme, svcHost := "", ""
+		if svc.ExternalName != "" {
+			if svcScheme, svcHost, err = g.kg.krc.externalNameOptions(svc); err != nil {
+				return reasonUnsupportedProtocol, err.Error(), nil
+			}
+			servers = g.kg.externalNameServers(svc, *ref.Port)
+		} else {
+			targetPort, err := serviceTargetPort(svc, *ref.Port)
+			if err != nil {
+				return reasonBackendNotFound, fmt.Sprintf("Service %s has no TCP port %d", ref.Name, *ref.Port), nil
+			}
+			servers, err = g.kg.getServiceEndpoints(namespace, ref.Name, targetPort)
+			if err != nil && !kerrors.IsNotFound(err) {
+				return "", "", err
+			}
+		}
+		// The backends of a rule share an upstream, so they must be
+		// reached the same way.
+		if !first && (svcScheme != scheme || svcHost != host) {
+			return reasonUnsupportedProtocol, fmt.Sprintf("backendRef %s is reached with another scheme or Host header than the other backends", ref.Name), nil
+		}
+		scheme, host, first = svcScheme, svcHost, false
+		if len(servers) > 0 {
+			backends = append(backends, weighted{weight: weight, servers: servers})
+		}
+	}
+	up.Scheme, up.HostHeader = scheme, host
+
+	if len(backends) == 1 {
+		up.Servers = backends[0].servers
+		return "", "", nil
+	}
+
+	// Each backend gets its share of requests spread evenly over its
+	// servers, not counting draining ones.
+	serving := func(servers []reverseProxyUpstreamServer) int {
+		n := 0
+		for _, s := range servers {
+			if !s.Down && !s.Backup {
+				n++
+			}
+		}
+		return n
+	}
+	total := 1
+	for _, b := range backends {
+		total = lcm(total, serving(b.servers))
+	}
+	weights := []int{}
+	for _, b := range backends {
+		for range b.servers {
+			weights = append(weights, b.weight*total/serving(b.servers))
+		}
+	}
+	divisor := 0
+	for _, w := range weights {
+		divisor = gcd(divisor, w)
+	}
+	i := 0
+	for _, b := range backends {
+		for _, s := range b.servers {
+			s.Weight = weights[i] / divisor
+			up.Servers = append(up.Servers, s)
+			i++
+		}
+	}
+	return "", "", nil
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func lcm(a, b int) int {
+	return a / gcd(a, b) * b
+}
+
+// httpRoutesByAge orders HTTPRoutes from oldest to newest, falling back to
+// namespace and name, which is the order of their precedence.
+type httpRoutesByAge []httpRouteObject
+
+func (s httpRoutesByAge) Len() int      { return len(s) }
+func (s httpRoutesByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s httpRoutesByAge) Less(i, j int) bool {
+	ti, tj := s[i].ObjectMeta.CreationTimestamp, s[j].ObjectMeta.CreationTimestamp
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	if s[i].ObjectMeta.Namespace != s[j].ObjectMeta.Namespace {
+		return s[i].ObjectMeta.Namespace < s[j].ObjectMeta.Namespace
+	}
+	return s[i].ObjectMeta.Name < s[j].ObjectMeta.Name
+}
+
+func newGatewayConfigBuilder() *gatewayConfigBuilder {
+	return &gatewayConfigBuilder{servers: map[string]*gatewayServer{}}
+}
+
+// gatewayConfigBuilder merges the rules of every attached route into one
+// server per listener port and hostname.
+type gatewayConfigBuilder struct {
+	servers   map[string]*gatewayServer
+	order     []string
+	upstreams []httpReverseProxyUpstream
+}
+
+type gatewayServer struct {
+	srv       httpReverseProxyServer
+	locations map[string]*gatewayLocation
+	order     []string
+	// headers maps the lower-cased name of each header modified by a
+	// route to its index in srv.RouteHeaders.
+	headers map[string]int
+}
+
+type gatewayLocation struct {
+	loc    httpReverseProxyLocation
+	routes []rankedRoute
+}
+
+type rankedRoute struct {
+	rank  routeRank
+	route httpRoute
+}
+
+type rankedRoutes []rankedRoute
+
+func (s rankedRoutes) Len() int           { return len(s) }
+func (s rankedRoutes) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s rankedRoutes) Less(i, j int) bool { return s[i].rank.less(s[j].rank) }
+
+func gatewayServerKey(hostname string, port int) string {
+	return fmt.Sprintf("%s:%d", hostname, port)
+}
+
+func (b *gatewayConfigBuilder) add(port int, hostname string, rule gatewayRuleConfig) {
+	key := gatewayServerKey(hostname, port)
+	s, ok := b.servers[key]
+	if !ok {
+		s = &gatewayServer{
+			srv: httpReverseProxyServer{
+				Name:       hostname,
+				AltNames:   []string{},
+				ListenPort: port,
+				Locations:  []httpReverseProxyLocation{},
+			},
+			locations: map[string]*gatewayLocation{},
+			headers:   map[string]int{},
+		}
+		b.servers[key] = s
+		b.order = append(b.order, key)
+	}
+
+	route := rule.route
+	for _, h := range rule.set {
+		route.Headers = append(route.Headers, httpRouteHeader{Variable: s.headerVariable(h.Name), Value: h.Value})
+	}
+	for _, h := range rule.add {
+		v := s.headerVariable(h.Name)
+		route.Headers = append(route.Headers,
+			httpRouteHeader{Variable: v, Value: headerVariable(h.Name) + ", " + h.Value},
+			httpRouteHeader{Variable: v, Value: h.Value, IfEmpty: headerVariable(h.Name)},
+		)
+	}
+	for _, name := range rule.remove {
+		route.Headers = append(route.Headers, httpRouteHeader{Variable: s.headerVariable(name)})
+	}
+
+	for _, m := range rule.matches {
+		r := route
+		r.Conditions = m.conditions
+		for _, loc := range m.locs {
+			locKey := loc.Match + " " + loc.Path
+			l, ok := s.locations[locKey]
+			if !ok {
+				l = &gatewayLocation{loc: loc}
+				s.locations[locKey] = l
+				s.order = append(s.order, locKey)
+			}
+			l.loc.implied = l.loc.implied && loc.implied
+			l.routes = append(l.routes, rankedRoute{rank: m.rank, route: r})
+		}
+	}
+}
+
+// headerVariable returns the variable holding the value of a request header
+// passed to upstreams, which routes may change.
+func (s *gatewayServer) headerVariable(name string) string {
+	key := strings.ToLower(name)
+	i, ok := s.headers[key]
+	if !ok {
+		i = len(s.srv.RouteHeaders)
+		s.headers[key] = i
+		s.srv.RouteHeaders = append(s.srv.RouteHeaders, httpHeader{Name: name, Value: headerVariable(name)})
+		s.srv.ProxySetHeaders = append(s.srv.ProxySetHeaders, httpHeader{Name: name, Value: fmt.Sprintf("$farva_route_header_%d", i)})
+	}
+	return fmt.Sprintf("$farva_route_header_%d", i)
+}
+
+func (b *gatewayConfigBuilder) reverseProxyConfig() (*reverseProxyConfig, error) {
+	rc := &reverseProxyConfig{HTTPUpstreams: b.upstreams}
+
+	for _, key := range b.order {
+		s := b.servers[key]
+
+		// nginx picks the longest prefix location, so each location
+		// also holds the routes of the shorter prefixes covering it, to
+		// fall back to when its own don't match.
+		for _, locKey := range s.order {
+			l := s.locations[locKey]
+			routes := l.routes
+			if l.loc.Match != locationMatchRegex {
+				for _, otherKey := range s.order {
+					other := s.locations[otherKey]
+					if other == l || other.loc.Match != locationMatchPrefix || !strings.HasPrefix(l.loc.Path, other.loc.Path) {
+						continue
+					}
+					routes = append(routes, other.routes...)
+				}
+			}
+
+			// Routes are evaluated in order and the last match wins.
+			sorted := append(rankedRoutes{}, routes...)
+			sort.Stable(sorted)
+			loc := l.loc
+			for _, r := range sorted {
+				loc.Routes = append(loc.Routes, r.route)
+			}
+			s.srv.Locations = append(s.srv.Locations, loc)
+		}
+
+		var err error
+		if s.srv.Locations, err = orderLocations(s.srv.Locations); err != nil {
+			return nil, fmt.Errorf("server %s: %v", s.srv.Name, err)
+		}
+		rc.HTTPServers = append(rc.HTTPServers, s.srv)
+	}
+
+	return rc, nil
+}
+
+// WriteStatus updates the status of our Gateways and of HTTPRoutes whose
+// status from this controller changed, as computed by the last call to
+// ReverseProxyConfig, once its config has been applied with applyErr.
+// Servers dropped from the merged config for a hostname conflict are
+// taken away from their routes, which aren't accepted if none is left.
+// If the config failed to apply, our Gateways aren't programmed and the
+// status of HTTPRoutes is left alone.
+func (g *gatewayAPIReverseProxyConfigGetter) WriteStatus(conflicts []HostnameConflict, applyErr error) {
+	g.mu.Lock()
+	st := g.pending
+	g.pending = nil
+	g.mu.Unlock()
+	if st == nil || g.status == nil || (g.isLeader != nil && !g.isLeader()) {
+		return
+	}
+
+	now := time.Now()
+	if g.now != nil {
+		now = g.now()
+	}
+
+	dropped := map[string]HostnameConflict{}
+	for _, c := range conflicts {
+		if c.Dropped == gatewayAPISource {
+			dropped[gatewayServerKey(c.Hostname, c.ListenPort)] = c
+		}
+	}
+	for i := range st.parents {
+		for j := range st.parents[i] {
+			st.dropConflicts(i, j, dropped)
+		}
+	}
+
+	for i := range st.gateways {
+		gw := &st.gateways[i]
+		key := gw.ObjectMeta.Namespace + "/" + gw.ObjectMeta.Name
+		if st.ours[key] == nil {
+			continue
+		}
+		status := gatewayStatusFor(gw, st.attached[key], applyErr, now)
+		if reflect.DeepEqual(status, gw.Status) {
+			continue
+		}
+		if err := g.status.UpdateGatewayStatus(gw, status); err != nil {
+			kubernetesLog.WithField("gateway", key).Errorf("Failed updating Gateway status: %v", err)
+		}
+	}
+	if applyErr != nil {
+		return
+	}
+
+	for i := range st.routes {
+		route := &st.routes[i]
+		existing := ownParentStatuses(route, g.controllerName)
+		desired := []httpRouteParentStatus{}
+		for _, p := range st.parents[i] {
+			var old []gatewayCondition
+			for _, e := range existing {
+				if reflect.DeepEqual(e.ParentRef, p.ParentRef) {
+					old = e.Conditions
+				}
+			}
+			for j, c := range p.Conditions {
+				c.ObservedGeneration = route.ObjectMeta.Generation
+				p.Conditions[j] = setCondition(old, c, now)
+			}
+			desired = append(desired, p)
+		}
+		if reflect.DeepEqual(desired, existing) {
+			continue
+		}
+		if err := g.status.UpdateHTTPRouteStatus(route, desired); err != nil {
+			kubernetesLog.WithFields(logrus.Fields{
+				"httproute": route.ObjectMeta.Name,
+				"namespace": route.ObjectMeta.Namespace,
+			}).Errorf("Failed updating HTTPRoute status: %v", err)
+		}
+	}
+}
+
+// dropConflicts takes the servers in dropped away from parent j of route i,
+// and from the routes attached to its listeners, and updates its Accepted
+// condition.
+func (st *gatewayAPIStatus) dropConflicts(i, j int, dropped map[string]HostnameConflict) {
+	route := &st.routes[i]
+	p := &st.parents[i][j]
+	if p.Conditions[0].Status != "True" {
+		return
+	}
+
+	namespace := route.ObjectMeta.Namespace
+	if p.ParentRef.Namespace != nil && *p.ParentRef.Namespace != "" {
+		namespace = *p.ParentRef.Namespace
+	}
+	gwKey := namespace + "/" + p.ParentRef.Name
+
+	problems := []string{}
+	remaining := 0
+	for name, keys := range st.servers[i][j] {
+		kept := 0
+		for _, key := range keys {
+			if c, ok := dropped[key]; ok {
+				problems = append(problems, fmt.Sprintf("hostname %s is claimed by %s", c.Hostname, c.Kept))
+			} else {
+				kept++
+			}
+		}
+		if kept == 0 {
+			st.attached[gwKey][name]--
+		}
+		remaining += kept
+	}
+	if len(problems) == 0 {
+		return
+	}
+
+	sort.Strings(problems)
+	if p.Conditions[0].Message != "" {
+		problems = append([]string{p.Conditions[0].Message}, problems...)
+	}
+	message := strings.Join(problems, "; ")
+	if remaining == 0 {
+		p.Conditions[0] = gatewayCondition{Type: "Accepted", Status: "False", Reason: reasonHostnameConflict, Message: message}
+	} else {
+		p.Conditions[0].Message = message
+	}
+}
+
+// gatewayStatusFor returns the status of a Gateway of our class. Only HTTP
+// listeners are programmed, and none if applyErr is set.
+func gatewayStatusFor(gw *gatewayObject, attached map[string]int, applyErr error, now time.Time) gatewayStatus {
+	condition := func(existing []gatewayCondition, typ string, ok bool, reason, message string) gatewayCondition {
+		c := gatewayCondition{Type: typ, Status: "True", Reason: reason, Message: message, ObservedGeneration: gw.ObjectMeta.Generation}
+		if !ok {
+			c.Status = "False"
+		}
+		return setCondition(existing, c, now)
+	}
+
+	status := gatewayStatus{Listeners: []gatewayListenerStatus{}}
+	programmed := false
+	for _, l := range gw.Spec.Listeners {
+		var existing []gatewayCondition
+		for _, ls := range gw.Status.Listeners {
+			if ls.Name == l.Name {
+				existing = ls.Conditions
+			}
+		}
+
+		ls := gatewayListenerStatus{
+			Name:           l.Name,
+			SupportedKinds: []gatewayRouteKind{},
+			AttachedRoutes: attached[l.Name],
+		}
+		if l.Protocol == "HTTP" {
+			programmed = true
+			ls.SupportedKinds = append(ls.SupportedKinds, gatewayRouteKind{Group: gatewayAPIGroup, Kind: "HTTPRoute"})
+			ls.Conditions = []gatewayCondition{
+				condition(existing, "Accepted", true, reasonAccepted, ""),
+				condition(existing, "Programmed", true, reasonProgrammed, ""),
+				condition(existing, "ResolvedRefs", true, reasonResolvedRefs, ""),
+			}
+		} else {
+			message := fmt.Sprintf("protocol %s is not supported", l.Protocol)
+			ls.Conditions = []gatewayCondition{
+				condition(existing, "Accepted", false, reasonUnsupportedProtocol, message),
+				condition(existing, "Programmed", false, reasonInvalid, message),
+				condition(existing, "ResolvedRefs", true, reasonResolvedRefs, ""),
+			}
+		}
+		status.Listeners = append(status.Listeners, ls)
+	}
+
+	if applyErr != nil {
+		status.Conditions = []gatewayCondition{
+			condition(gw.Status.Conditions, "Accepted", true, reasonAccepted, ""),
+			condition(gw.Status.Conditions, "Programmed", false, reasonInvalid, fmt.Sprintf("the config failed to apply: %v", applyErr)),
+		}
+	} else if programmed {
+		status.Conditions = []gatewayCondition{
+			condition(gw.Status.Conditions, "Accepted", true, reasonAccepted, ""),
+			condition(gw.Status.Conditions, "Programmed", true, reasonProgrammed, ""),
+		}
+	} else {
+		status.Conditions = []gatewayCondition{
+			condition(gw.Status.Conditions, "Accepted", true, reasonAccepted, ""),
+			condition(gw.Status.Conditions, "Programmed", false, reasonInvalid, "the Gateway has no HTTP listener"),
+		}
+	}
+	return status
+}
@@ -0,0 +1,582 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testGatewayAPIManifest = `
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: public
+  namespace: infra
+  generation: 2
+spec:
+  gatewayClassName: farva
+  listeners:
+  - name: http
+    port: 7331
+    protocol: HTTP
+    hostname: "*.example.com"
+    allowedRoutes:
+      namespaces:
+        from: All
+  - name: tls
+    port: 443
+    protocol: HTTPS
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: Gateway
+metadata:
+  name: other
+  namespace: infra
+spec:
+  gatewayClassName: someone-else
+  listeners:
+  - name: http
+    port: 80
+    protocol: HTTP
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: shop
+  namespace: shop
+  creationTimestamp: 2020-01-01T00:00:00Z
+spec:
+  parentRefs:
+  - name: public
+    namespace: infra
+    sectionName: http
+  hostnames: [shop.example.com]
+  rules:
+  - matches:
+    - path: {type: PathPrefix, value: /api}
+      headers:
+      - name: X-Canary
+        value: "yes"
+    backendRefs:
+    - name: canary
+      port: 80
+  - filters:
+    - type: RequestHeaderModifier
+      requestHeaderModifier:
+        set: [{name: X-Env, value: prod}]
+        add: [{name: X-Via, value: farva}]
+        remove: [X-Debug]
+    backendRefs:
+    - name: web
+      port: 80
+      weight: 3
+    - name: web-v2
+      port: 80
+      weight: 1
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: shop-exact
+  namespace: shop
+  creationTimestamp: 2020-01-02T00:00:00Z
+spec:
+  parentRefs:
+  - name: public
+    namespace: infra
+  hostnames: [shop.example.com]
+  rules:
+  - matches:
+    - path: {type: Exact, value: /api}
+    backendRefs:
+    - name: web
+      port: 80
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: elsewhere
+  namespace: shop
+  creationTimestamp: 2020-01-03T00:00:00Z
+spec:
+  parentRefs:
+  - name: public
+    namespace: infra
+  hostnames: [shop.example.org]
+  rules:
+  - backendRefs:
+    - name: web
+      port: 80
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: missing
+  namespace: shop
+  creationTimestamp: 2020-01-04T00:00:00Z
+spec:
+  parentRefs:
+  - name: public
+    namespace: infra
+  hostnames: [missing.example.com]
+  rules:
+  - backendRefs:
+    - name: nope
+      port: 80
+---
+apiVersion: gateway.networking.k8s.io/v1
+kind: HTTPRoute
+metadata:
+  name: ignored
+  namespace: shop
+spec:
+  parentRefs:
+  - name: other
+    namespace: infra
+  hostnames: [ignored.example.com]
+  rules:
+  - backendRefs:
+    - name: web
+      port: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: shop}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: shop}
+  subsets:
+  - addresses:
+    - ip: 10.0.0.1
+      targetRef: {kind: Pod, name: web-1}
+    - ip: 10.0.0.2
+      targetRef: {kind: Pod, name: web-2}
+    ports: [{port: 8080}]
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web-v2, namespace: shop}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web-v2, namespace: shop}
+  subsets:
+  - addresses:
+    - ip: 10.0.1.1
+      targetRef: {kind: Pod, name: web-v2-1}
+    ports: [{port: 8080}]
+- apiVersion: v1
+  kind: Service
+  metadata: {name: canary, namespace: shop}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+`
+
+func newTestGatewayAPIGetter(t *testing.T) (*manifestObjectGetter, *gatewayAPIReverseProxyConfigGetter) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testGatewayAPIManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	kg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+	return objs, newGatewayAPIReverseProxyConfigGetter(objs, kg, "farva", DefaultGatewayControllerName)
+}
+
+func TestGatewayAPIReverseProxyConfig(t *testing.T) {
+	_, gg := newTestGatewayAPIGetter(t)
+	rc, err := gg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	headers := []httpRouteHeader{
+		httpRouteHeader{Variable: "$farva_route_header_0", Value: "prod"},
+		httpRouteHeader{Variable: "$farva_route_header_1", Value: "$http_x_via, farva"},
+		httpRouteHeader{Variable: "$farva_route_header_1", Value: "farva", IfEmpty: "$http_x_via"},
+		httpRouteHeader{Variable: "$farva_route_header_2"},
+	}
+	catchAll := httpRoute{Upstream: "gateway__shop__shop__1", Headers: headers}
+	canary := httpRoute{
+		Conditions: []httpRouteCondition{
+			httpRouteCondition{Variable: "$http_x_canary", Operator: "=", Value: "yes"},
+		},
+		StaticCode: 503,
+	}
+	exact := httpRoute{Upstream: "gateway__shop__shop-exact__0"}
+
+	want := []httpReverseProxyServer{
+		httpReverseProxyServer{
+			Name:       "shop.example.com",
+			AltNames:   []string{},
+			ListenPort: 7331,
+			Locations: []httpReverseProxyLocation{
+				// The longer prefix and the exact match take precedence
+				// over the catch-all, which is kept to fall back to.
+				httpReverseProxyLocation{Path: "/api", Match: "=", Routes: []httpRoute{catchAll, canary, exact}},
+				httpReverseProxyLocation{Path: "/api/", Routes: []httpRoute{catchAll, canary}},
+				httpReverseProxyLocation{Path: "/", Routes: []httpRoute{catchAll}},
+			},
+			RouteHeaders: []httpHeader{
+				httpHeader{Name: "X-Env", Value: "$http_x_env"},
+				httpHeader{Name: "X-Via", Value: "$http_x_via"},
+				httpHeader{Name: "X-Debug", Value: "$http_x_debug"},
+			},
+			ProxySetHeaders: []httpHeader{
+				httpHeader{Name: "X-Env", Value: "$farva_route_header_0"},
+				httpHeader{Name: "X-Via", Value: "$farva_route_header_1"},
+				httpHeader{Name: "X-Debug", Value: "$farva_route_header_2"},
+			},
+		},
+		httpReverseProxyServer{
+			Name:       "missing.example.com",
+			AltNames:   []string{},
+			ListenPort: 7331,
+			Locations: []httpReverseProxyLocation{
+				httpReverseProxyLocation{Path: "/", Routes: []httpRoute{httpRoute{StaticCode: 500}}},
+			},
+		},
+	}
+	if diff := pretty.Compare(want, rc.HTTPServers); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	// Each backend gets its weighted share spread over its endpoints.
+	wantUpstreams := []httpReverseProxyUpstream{
+		httpReverseProxyUpstream{
+			Name: "gateway__shop__shop__1",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "web-1", Host: "10.0.0.1", Port: 8080, Weight: 3},
+				reverseProxyUpstreamServer{Name: "web-2", Host: "10.0.0.2", Port: 8080, Weight: 3},
+				reverseProxyUpstreamServer{Name: "web-v2-1", Host: "10.0.1.1", Port: 8080, Weight: 2},
+			},
+		},
+		httpReverseProxyUpstream{
+			Name: "gateway__shop__shop-exact__0",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "web-1", Host: "10.0.0.1", Port: 8080},
+				reverseProxyUpstreamServer{Name: "web-2", Host: "10.0.0.2", Port: 8080},
+			},
+		},
+	}
+	if diff := pretty.Compare(wantUpstreams, rc.HTTPUpstreams); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	got, err := renderConfig(&DefaultNGINXConfig, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		`set $farva_route_header_1 "$http_x_via";`,
+		`proxy_set_header X-Via "$farva_route_header_1";`,
+		`if ($http_x_canary = "yes") {`,
+		`if ($farva_match = "x") {`,
+		`set $farva_guard "$farva_route:$http_x_via";`,
+		`proxy_pass http://$farva_upstream;`,
+		`server 10.0.1.1:8080 weight=2;  # web-v2-1`,
+		`server 10.0.0.1:8080;  # web-1`,
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("expected %q in config", want)
+		}
+	}
+}
+
+type fakeGatewayAPIStatusWriter struct {
+	gateways map[string]gatewayStatus
+	routes   map[string][]httpRouteParentStatus
+}
+
+func (w *fakeGatewayAPIStatusWriter) UpdateGatewayStatus(gw *gatewayObject, status gatewayStatus) error {
+	w.gateways[gw.ObjectMeta.Name] = status
+	gw.Status = status
+	return nil
+}
+
+func (w *fakeGatewayAPIStatusWriter) UpdateHTTPRouteStatus(route *httpRouteObject, parents []httpRouteParentStatus) error {
+	w.routes[route.ObjectMeta.Name] = parents
+	route.Status.Parents = parents
+	return nil
+}
+
+func TestGatewayAPIStatus(t *testing.T) {
+	_, gg := newTestGatewayAPIGetter(t)
+	now := time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	gg.now = func() time.Time { return now }
+
+	leader := false
+	gg.isLeader = func() bool { return leader }
+	w := &fakeGatewayAPIStatusWriter{gateways: map[string]gatewayStatus{}, routes: map[string][]httpRouteParentStatus{}}
+	gg.status = w
+
+	// Only the leader writes status.
+	if _, err := gg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gg.WriteStatus(nil, nil)
+	if len(w.gateways) != 0 || len(w.routes) != 0 {
+		t.Fatalf("expected no status writes, got %d and %d", len(w.gateways), len(w.routes))
+	}
+
+	leader = true
+	if _, err := gg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gg.WriteStatus(nil, nil)
+
+	conditions := func(route string) []string {
+		got := []string{}
+		for _, p := range w.routes[route] {
+			for _, c := range p.Conditions {
+				got = append(got, c.Type+"="+c.Status+"/"+c.Reason)
+			}
+		}
+		return got
+	}
+	tests := []struct {
+		route string
+		want  []string
+	}{
+		{route: "shop", want: []string{"Accepted=True/Accepted", "ResolvedRefs=True/ResolvedRefs"}},
+		{route: "shop-exact", want: []string{"Accepted=True/Accepted", "ResolvedRefs=True/ResolvedRefs"}},
+		{route: "elsewhere", want: []string{"Accepted=False/NoMatchingListenerHostname", "ResolvedRefs=True/ResolvedRefs"}},
+		{route: "missing", want: []string{"Accepted=True/Accepted", "ResolvedRefs=False/BackendNotFound"}},
+		{route: "ignored", want: []string{}},
+	}
+	for i, tt := range tests {
+		if diff := pretty.Compare(tt.want, conditions(tt.route)); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+
+	status, ok := w.gateways["public"]
+	if !ok || len(w.gateways) != 1 {
+		t.Fatalf("expected status of Gateway public only, got %v", w.gateways)
+	}
+	listeners := []string{}
+	for _, ls := range status.Listeners {
+		listeners = append(listeners, ls.Name+"="+ls.Conditions[0].Status+"/"+ls.Conditions[0].Reason)
+	}
+	if diff := pretty.Compare([]string{"http=True/Accepted", "tls=False/UnsupportedProtocol"}, listeners); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+	if got := status.Listeners[0].AttachedRoutes; got != 3 {
+		t.Errorf("expected 3 routes attached to listener http, got %d", got)
+	}
+	if got := status.Conditions[0].ObservedGeneration; got != 2 {
+		t.Errorf("expected observed generation 2, got %d", got)
+	}
+
+	// Unchanged status isn't written again, even later.
+	now = now.Add(time.Hour)
+	w.gateways = map[string]gatewayStatus{}
+	w.routes = map[string][]httpRouteParentStatus{}
+	if _, err := gg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gg.WriteStatus(nil, nil)
+	if len(w.gateways) != 0 || len(w.routes) != 0 {
+		t.Errorf("expected no status writes, got %d and %d", len(w.gateways), len(w.routes))
+	}
+}
+
+func TestGatewayAPIStatusAfterApply(t *testing.T) {
+	conflict := HostnameConflict{Hostname: "shop.example.com", ListenPort: 7331, Kept: "kubernetes", Dropped: gatewayAPISource}
+
+	tests := []struct {
+		conflicts []HostnameConflict
+		applyErr  error
+
+		programmed string
+		attached   int
+		routes     map[string]string
+	}{
+		// Routes whose only server was dropped for a hostname conflict
+		// aren't accepted or attached.
+		{
+			conflicts:  []HostnameConflict{conflict},
+			programmed: "True",
+			attached:   1,
+			routes: map[string]string{
+				"shop":       "False/HostnameConflict",
+				"shop-exact": "False/HostnameConflict",
+				"elsewhere":  "False/NoMatchingListenerHostname",
+				"missing":    "True/Accepted",
+			},
+		},
+
+		// Conflicts between Ingresses don't concern HTTPRoutes.
+		{
+			conflicts:  []HostnameConflict{{Hostname: "shop.example.com", ListenPort: 7331, Kept: "shop/a", Dropped: "shop/b"}},
+			programmed: "True",
+			attached:   3,
+			routes: map[string]string{
+				"shop":       "True/Accepted",
+				"shop-exact": "True/Accepted",
+				"elsewhere":  "False/NoMatchingListenerHostname",
+				"missing":    "True/Accepted",
+			},
+		},
+
+		// A config that failed to apply isn't programmed, and leaves
+		// the routes alone.
+		{
+			applyErr:   errors.New("nginx: [emerg] unexpected end of file"),
+			programmed: "False",
+			attached:   3,
+			routes:     map[string]string{},
+		},
+	}
+
+	for i, tt := range tests {
+		_, gg := newTestGatewayAPIGetter(t)
+		w := &fakeGatewayAPIStatusWriter{gateways: map[string]gatewayStatus{}, routes: map[string][]httpRouteParentStatus{}}
+		gg.status = w
+
+		if _, err := gg.ReverseProxyConfig(); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		gg.WriteStatus(tt.conflicts, tt.applyErr)
+
+		status := w.gateways["public"]
+		if got := status.Conditions[1].Status; tt.programmed != got {
+			t.Errorf("case %d: want Programmed=%s, got %s", i, tt.programmed, got)
+		}
+		if got := status.Listeners[0].AttachedRoutes; tt.attached != got {
+			t.Errorf("case %d: want %d routes attached, got %d", i, tt.attached, got)
+		}
+
+		routes := map[string]string{}
+		for name, parents := range w.routes {
+			if len(parents) > 0 {
+				routes[name] = parents[0].Conditions[0].Status + "/" + parents[0].Conditions[0].Reason
+			}
+		}
+		if diff := pretty.Compare(tt.routes, routes); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+
+		// Status is only written once per config.
+		w.gateways = map[string]gatewayStatus{}
+		gg.WriteStatus(nil, nil)
+		if len(w.gateways) != 0 {
+			t.Errorf("case %d: expected no status writes", i)
+		}
+	}
+}
+
+type failingGatewayAPIObjectGetter struct {
+	gatewayAPIObjectGetter
+	err error
+}
+
+func (g *failingGatewayAPIObjectGetter) ListGateways() ([]gatewayObject, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	return g.gatewayAPIObjectGetter.ListGateways()
+}
+
+func TestGatewayAPIListError(t *testing.T) {
+	objs, gg := newTestGatewayAPIGetter(t)
+	failing := &failingGatewayAPIObjectGetter{gatewayAPIObjectGetter: objs, err: errors.New("the server could not find the requested resource")}
+	gg.objs = failing
+
+	// Without a previous config, the Gateway API contributes nothing.
+	rc, err := gg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := pretty.Compare(&reverseProxyConfig{}, rc); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	failing.err = nil
+	want, err := gg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Afterwards, the last config is kept and no status is written.
+	failing.err = errors.New("connection refused")
+	w := &fakeGatewayAPIStatusWriter{gateways: map[string]gatewayStatus{}, routes: map[string][]httpRouteParentStatus{}}
+	gg.status = w
+	rc, err = gg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := pretty.Compare(want, rc); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+	gg.WriteStatus(nil, nil)
+	if len(w.gateways) != 0 || len(w.routes) != 0 {
+		t.Errorf("expected no status writes, got %d and %d", len(w.gateways), len(w.routes))
+	}
+}
+
+func TestIntersectHostnames(t *testing.T) {
+	tests := []struct {
+		listener string
+		route    []string
+		want     []string
+	}{
+		{listener: "", route: nil, want: nil},
+		{listener: "a.example.com", route: nil, want: []string{"a.example.com"}},
+		{listener: "", route: []string{"a.example.com"}, want: []string{"a.example.com"}},
+		{listener: "*.example.com", route: []string{"a.example.com", "a.example.org", "*.b.example.com"}, want: []string{"a.example.com", "*.b.example.com"}},
+		{listener: "a.example.com", route: []string{"*.example.com", "A.example.com"}, want: []string{"a.example.com"}},
+		{listener: "a.example.com", route: []string{"b.example.com"}, want: []string{}},
+	}
+
+	for i, tt := range tests {
+		if diff := pretty.Compare(tt.want, intersectHostnames(tt.listener, tt.route)); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestTranslateHTTPRouteMatchError(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []httpRouteMatch{
+		// unknown path type
+		httpRouteMatch{Path: &struct {
+			Type  *string `json:"type"`
+			Value *string `json:"value"`
+		}{Type: str("Glob"), Value: str("/*")}},
+		// header value with a variable
+		httpRouteMatch{Headers: []httpRouteValueMatch{httpRouteValueMatch{Name: "X-Env", Value: "$host"}}},
+		// query parameter not usable as an nginx variable
+		httpRouteMatch{QueryParams: []httpRouteValueMatch{httpRouteValueMatch{Name: "a-b", Value: "c"}}},
+		// invalid regular expression
+		httpRouteMatch{Headers: []httpRouteValueMatch{httpRouteValueMatch{Type: str("RegularExpression"), Name: "X-Env", Value: "("}}},
+	}
+
+	for i, tt := range tests {
+		if _, err := translateHTTPRouteMatch(&tt); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
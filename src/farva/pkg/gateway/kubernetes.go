@@ -16,8 +16,11 @@ limitations under the License.
 package gateway
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
+	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
 	"github.com/bcwaldon/klondike/src/farva/pkg/logger"
 	kapi "k8s.io/kubernetes/pkg/api"
 	kextensions "k8s.io/kubernetes/pkg/apis/extensions"
@@ -25,21 +28,137 @@ import (
 	kclient "k8s.io/kubernetes/pkg/client/unversioned"
 	kclientcmd "k8s.io/kubernetes/pkg/client/unversioned/clientcmd"
 	kclientcmdapi "k8s.io/kubernetes/pkg/client/unversioned/clientcmd/api"
+	klabels "k8s.io/kubernetes/pkg/labels"
 	"strings"
+	"sync"
 )
 
+var kubernetesLog = logger.Component("kubernetes")
+
 type kubernetesReverseProxyConfigGetterConfig struct {
 	AnnotationPrefix string
-	ClusterZone      string
 	ListenPort       int
+
+	// ClusterZones are the DNS zones in which Ingresses get canonical
+	// hostnames, derived from HostnameTemplate. The first zone gives the
+	// primary server name.
+	ClusterZones     []string
+	HostnameTemplate string
+	// CanonicalHostnamePolicy decides whether rules with their own host
+	// also get canonical hostnames.
+	CanonicalHostnamePolicy string
+	// NamespaceZones enables the cluster zone annotation on Namespaces,
+	// which requires permission to list namespaces.
+	NamespaceZones bool
+
+	// RegexHosts allows regular expressions as rule hosts and aliases.
+	RegexHosts bool
+
+	// DomainOwners, if not nil, restricts which namespaces may claim
+	// hostnames in particular domains.
+	DomainOwners domainOwners
+
+	// IngressClass restricts farva to Ingresses of this class. If empty,
+	// every Ingress is handled regardless of its class.
+	IngressClass string
+	// UnclassedIngressPolicy decides whether Ingresses without a class are
+	// handled when IngressClass is set.
+	UnclassedIngressPolicy string
+
+	// Namespaces, if not empty, restricts farva to Ingresses in these
+	// namespaces. Only namespace-scoped API access is needed in this case
+	// unless NamespaceSelector is also set.
+	Namespaces []string
+	// NamespaceSelector, if not nil, restricts farva to Ingresses in
+	// namespaces with matching labels.
+	NamespaceSelector klabels.Selector
+	// IngressSelector, if not nil, restricts farva to Ingresses with
+	// matching labels.
+	IngressSelector klabels.Selector
+
+	// SnippetDirectives is the set of nginx directives allowed in snippet
+	// annotations. Snippets are rejected if it is empty.
+	SnippetDirectives map[string]bool
 }
 
 const HostnameAliasKey = "hostname-aliases"
 
+// Annotations adding headers to an Ingress, in addition to the global ones.
+// Set and add headers are given as name=value pairs, one per line, so that
+// values may contain commas. Hidden headers are separated by commas.
+const (
+	ProxySetHeadersKey  = "proxy-set-headers"
+	AddHeadersKey       = "add-headers"
+	ProxyHideHeadersKey = "proxy-hide-headers"
+)
+
+// IngressClassKey is the well-known annotation used to assign an Ingress to
+// a particular controller.
+const IngressClassKey = "kubernetes.io/ingress.class"
+
+const (
+	UnclassedIngressPolicyClaim  = "claim"
+	UnclassedIngressPolicyIgnore = "ignore"
+)
+
+// handlesIngress reports whether the Ingress belongs to this farva based on
+// its class. The class annotation takes precedence over ingressClassName.
+func (krc *kubernetesReverseProxyConfigGetterConfig) handlesIngress(ing *ingress) bool {
+	if krc.IngressClass == "" {
+		return true
+	}
+
+	class, ok := ing.ObjectMeta.Annotations[IngressClassKey]
+	if !ok || class == "" {
+		class = ing.ClassName
+	}
+	if class == "" {
+		return krc.UnclassedIngressPolicy == UnclassedIngressPolicyClaim
+	}
+	return class == krc.IngressClass
+}
+
 func (krc *kubernetesReverseProxyConfigGetterConfig) annotationKey(name string) string {
 	return fmt.Sprintf("%s/%s", krc.AnnotationPrefix, name)
 }
 
+// getAnnotationHeaders parses name=value pairs, one per line, at a given
+// annotation field.
+func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationHeaders(ing *kextensions.Ingress, name string) ([]httpHeader, error) {
+	val, ok := ing.ObjectMeta.Annotations[krc.annotationKey(name)]
+	if !ok || strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+
+	var kv flagutil.KVLinesFlag
+	if err := kv.Set(val); err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", krc.annotationKey(name), err)
+	}
+	headers, err := parseHeaders(kv)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", krc.annotationKey(name), err)
+	}
+	return headers, nil
+}
+
+// getAnnotationSnippet parses the nginx directives at a given annotation
+// field, which must all be in the SnippetDirectives allowlist.
+func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationSnippet(ing *kextensions.Ingress, name string) ([]string, error) {
+	val, ok := ing.ObjectMeta.Annotations[krc.annotationKey(name)]
+	if !ok || strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+	if len(krc.SnippetDirectives) == 0 {
+		return nil, fmt.Errorf("annotation %s: snippets are disabled", krc.annotationKey(name))
+	}
+
+	directives, err := parseSnippet(val, krc.SnippetDirectives)
+	if err != nil {
+		return nil, fmt.Errorf("annotation %s: %v", krc.annotationKey(name), err)
+	}
+	return directives, nil
+}
+
 // Gets a list of strings at a given annotation field.
 func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationStringList(ing *kextensions.Ingress, name string) []string {
 	anno := ing.ObjectMeta.GetAnnotations()
@@ -54,7 +173,11 @@ func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationStringList(ing
 }
 
 var DefaultKubernetesReverseProxyConfigGetterConfig = kubernetesReverseProxyConfigGetterConfig{
-	AnnotationPrefix: "klondike.gateway",
+	AnnotationPrefix:        "klondike.gateway",
+	UnclassedIngressPolicy:  UnclassedIngressPolicyClaim,
+	ClusterZones:            []string{""},
+	HostnameTemplate:        DefaultHostnameTemplate,
+	CanonicalHostnamePolicy: CanonicalHostnamePolicyAlways,
 }
 
 func splitCSV(csv string) []string {
@@ -92,172 +215,617 @@ func getKubernetesClientConfig(kubeconfig string) (*krestclient.Config, error) {
 	}
 }
 
-func newReverseProxyConfigGetter(kc *kclient.Client, krc *kubernetesReverseProxyConfigGetterConfig) ReverseProxyConfigGetter {
-	return &kubernetesReverseProxyConfigGetter{
-		kc:  kc,
-		krc: krc,
+// kubernetesObjectGetter is the subset of the Kubernetes API needed to build
+// a reverseProxyConfig. It is satisfied by a live cluster or by a set of
+// manifest files.
+type kubernetesObjectGetter interface {
+	ListNamespaces(opts kapi.ListOptions) (*kapi.NamespaceList, error)
+	ListIngresses(namespace string, opts kapi.ListOptions) ([]ingress, error)
+	GetService(namespace, name string) (*service, error)
+	GetEndpoints(namespace, name string) (*kapi.Endpoints, error)
+}
+
+type clientObjectGetter struct {
+	kc        *kclient.Client
+	ingresses *ingressLister
+}
+
+func (g *clientObjectGetter) ListNamespaces(opts kapi.ListOptions) (*kapi.NamespaceList, error) {
+	return g.kc.Namespaces().List(opts)
+}
+
+func (g *clientObjectGetter) ListIngresses(namespace string, opts kapi.ListOptions) ([]ingress, error) {
+	return g.ingresses.List(namespace, opts)
+}
+
+func (g *clientObjectGetter) GetService(namespace, name string) (*service, error) {
+	var svc service
+	if err := (rawAPI{g.kc}).get("v1", namespace, "services", name, &svc); err != nil {
+		return nil, err
 	}
+	return &svc, nil
 }
 
-type kubernetesReverseProxyConfigGetter struct {
-	kc  *kclient.Client
-	krc *kubernetesReverseProxyConfigGetterConfig
+func (g *clientObjectGetter) GetEndpoints(namespace, name string) (*kapi.Endpoints, error) {
+	return g.kc.Endpoints(namespace).Get(name)
 }
 
-func (rcg *kubernetesReverseProxyConfigGetter) getServiceTargetPort(svcNamespace, svcName string, svcPort int) (int, error) {
-	svc, err := rcg.kc.Services(svcNamespace).Get(svcName)
-	if err != nil {
-		return 0, err
+func newReverseProxyConfigGetter(kc *kclient.Client, krc *kubernetesReverseProxyConfigGetterConfig) *kubernetesReverseProxyConfigGetter {
+	objs := &clientObjectGetter{
+		kc:        kc,
+		ingresses: newIngressLister(kc),
 	}
+	return newReverseProxyConfigGetterFromObjects(objs, krc)
+}
 
-	for _, port := range svc.Spec.Ports {
-		if port.Port != svcPort || port.Protocol != kapi.ProtocolTCP {
-			continue
-		} else {
-			return port.TargetPort.IntValue(), nil
-		}
+func newReverseProxyConfigGetterFromObjects(objs kubernetesObjectGetter, krc *kubernetesReverseProxyConfigGetterConfig) *kubernetesReverseProxyConfigGetter {
+	return &kubernetesReverseProxyConfigGetter{
+		objs: objs,
+		krc:  krc,
 	}
+}
+
+type kubernetesReverseProxyConfigGetter struct {
+	objs kubernetesObjectGetter
+	krc  *kubernetesReverseProxyConfigGetterConfig
+
+	// snippets, if not nil, validates the config of each Ingress with
+	// snippets before it is merged.
+	snippets *snippetValidator
+
+	// drainer, if not nil, keeps endpoints that are removed or not ready
+	// in upstreams for a while.
+	drainer *endpointDrainer
+
+	// lookupHost resolves the external names of Services. It defaults to
+	// the LookupHost method of net.DefaultResolver.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
 
-	return 0, fmt.Errorf("coult not find port matching %d for service %s in namespace %s", svcPort, svcName, svcNamespace)
+	mu        sync.Mutex
+	statuses  []IngressStatus
+	conflicts []HostnameConflict
+}
+
+// invalidIngressError is returned when an Ingress itself is invalid, as
+// opposed to errors talking to the API. Only the offending Ingress is
+// disabled.
+type invalidIngressError struct {
+	err error
+}
+
+func (e *invalidIngressError) Error() string {
+	return e.err.Error()
+}
+
+// IngressStatus records the outcome of processing a single Ingress during
+// the most recent refresh.
+type IngressStatus struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Ignored   bool     `json:"ignored,omitempty"`
+	Disabled  bool     `json:"disabled,omitempty"`
+	Hostnames []string `json:"hostnames,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+// IngressStatuses returns the status of every Ingress seen during the most
+// recent call to ReverseProxyConfig.
+func (rcg *kubernetesReverseProxyConfigGetter) IngressStatuses() []IngressStatus {
+	rcg.mu.Lock()
+	defer rcg.mu.Unlock()
+	return rcg.statuses
+}
+
+// Conflicts returns the hostnames dropped from Ingresses during the most
+// recent refresh because an older Ingress claimed them.
+func (rcg *kubernetesReverseProxyConfigGetter) Conflicts() []HostnameConflict {
+	rcg.mu.Lock()
+	defer rcg.mu.Unlock()
+	return rcg.conflicts
 }
 
 func (rcg *kubernetesReverseProxyConfigGetter) getServiceEndpoints(svcNamespace, svcName string, svcTargetPort int) ([]reverseProxyUpstreamServer, error) {
-	endpoints, err := rcg.kc.Endpoints(svcNamespace).Get(svcName)
+	endpoints, err := rcg.objs.GetEndpoints(svcNamespace, svcName)
 	if err != nil {
 		return nil, err
 	}
 
 	ups := []reverseProxyUpstreamServer{}
+	notReady := []reverseProxyUpstreamServer{}
 
 	for _, sub := range endpoints.Subsets {
 		if sub.Ports[0].Port != svcTargetPort || sub.Ports[0].Protocol != kapi.ProtocolTCP {
-			logger.Log.WithFields(logrus.Fields{
+			kubernetesLog.WithFields(logrus.Fields{
+				"service":               svcName,
+				"namespace":             svcNamespace,
 				"SourcePort":            sub.Ports[0].Port,
 				"SourceProtocol":        sub.Ports[0].Protocol,
 				"ServiceTargetPort":     svcTargetPort,
 				"ServiceTargetProtocol": kapi.ProtocolTCP,
-			}).Info("Ignoring endpoint")
+			}).Debug("Ignoring endpoint")
 			continue
 		}
 
 		//NOTE(bcwaldon): addresses may not be guaranteed to be in the same
 		// order every time we make this API call. Probably want to sort.
 		for _, addr := range sub.Addresses {
+			// Endpoints of Services without a selector needn't
+			// refer to a Pod.
+			name := addr.IP
+			if addr.TargetRef != nil {
+				name = addr.TargetRef.Name
+			}
 			up := reverseProxyUpstreamServer{
-				Name: addr.TargetRef.Name,
+				Name: name,
 				Host: addr.IP,
 				Port: sub.Ports[0].Port,
 			}
-			logger.Log.WithFields(logrus.Fields{
-				"Name": addr.TargetRef.Name,
-				"Host": addr.IP,
-				"Port": sub.Ports[0].Port,
-			}).Info("Adding upstream")
+			kubernetesLog.WithFields(logrus.Fields{
+				"service":   svcName,
+				"namespace": svcNamespace,
+				"Name":      name,
+				"Host":      addr.IP,
+				"Port":      sub.Ports[0].Port,
+			}).Debug("Adding upstream")
 			ups = append(ups, up)
 		}
+
+		for _, addr := range sub.NotReadyAddresses {
+			name := addr.IP
+			if addr.TargetRef != nil {
+				name = addr.TargetRef.Name
+			}
+			notReady = append(notReady, reverseProxyUpstreamServer{
+				Name: name,
+				Host: addr.IP,
+				Port: sub.Ports[0].Port,
+			})
+		}
 	}
 
+	if rcg.drainer != nil {
+		return rcg.drainer.Drain(svcNamespace, svcName, svcTargetPort, ups, notReady), nil
+	}
 	return ups, nil
 }
 
+// namespaces returns the namespaces to read Ingresses from, or a single
+// kapi.NamespaceAll if farva isn't scoped to particular namespaces.
+func (rcg *kubernetesReverseProxyConfigGetter) namespaces() ([]string, error) {
+	if rcg.krc.NamespaceSelector == nil {
+		if len(rcg.krc.Namespaces) == 0 {
+			return []string{kapi.NamespaceAll}, nil
+		}
+		return rcg.krc.Namespaces, nil
+	}
+
+	nsList, err := rcg.objs.ListNamespaces(kapi.ListOptions{LabelSelector: rcg.krc.NamespaceSelector})
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := map[string]bool{}
+	for _, ns := range rcg.krc.Namespaces {
+		allowed[ns] = true
+	}
+
+	namespaces := []string{}
+	for _, ns := range nsList.Items {
+		if len(allowed) > 0 && !allowed[ns.ObjectMeta.Name] {
+			continue
+		}
+		namespaces = append(namespaces, ns.ObjectMeta.Name)
+	}
+	return namespaces, nil
+}
+
+func (rcg *kubernetesReverseProxyConfigGetter) listIngresses() ([]ingress, error) {
+	namespaces, err := rcg.namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := kapi.ListOptions{}
+	if rcg.krc.IngressSelector != nil {
+		opts.LabelSelector = rcg.krc.IngressSelector
+	}
+
+	ingresses := []ingress{}
+	for _, ns := range namespaces {
+		items, err := rcg.objs.ListIngresses(ns, opts)
+		if err != nil {
+			return nil, err
+		}
+		ingresses = append(ingresses, items...)
+	}
+	return ingresses, nil
+}
+
 func (rcg *kubernetesReverseProxyConfigGetter) ReverseProxyConfig() (*reverseProxyConfig, error) {
 	rp := reverseProxyConfig{}
 
-	ingressList, err := rcg.kc.Ingress(kapi.NamespaceAll).List(kapi.ListOptions{})
+	ingresses, err := rcg.listIngresses()
+	if err != nil {
+		return nil, err
+	}
+
+	zones, err := rcg.zones()
 	if err != nil {
 		return nil, err
 	}
 
+	// Every Ingress is processed even after one fails so that the status of
+	// each is known, but any failure still fails the whole refresh.
+	var firstErr error
+	statuses := make([]IngressStatus, 0, len(ingresses))
+
+	// Older Ingresses claim their hostnames and paths first.
+	sortIngressesByAge(ingresses)
+	servers := newIngressServers(rcg.krc)
+	conflicts := []HostnameConflict{}
+
 	// NOTE(bcwaldon): treat Ingress objects w/o rules as HTTP for now. This will
 	// eventually be treated as a TCP-only service.
-	for _, ing := range ingressList.Items {
-		if ing.Spec.Backend != nil {
-			ing.Spec.Rules = []kextensions.IngressRule{
-				kextensions.IngressRule{
-					IngressRuleValue: kextensions.IngressRuleValue{
-						HTTP: &kextensions.HTTPIngressRuleValue{
-							Paths: []kextensions.HTTPIngressPath{
-								kextensions.HTTPIngressPath{
-									Path:    "/",
-									Backend: *ing.Spec.Backend,
-								},
-							},
-						},
-					},
-				},
+	for _, ing := range ingresses {
+		status := IngressStatus{
+			Namespace: ing.ObjectMeta.Namespace,
+			Name:      ing.ObjectMeta.Name,
+		}
+
+		if !rcg.krc.handlesIngress(&ing) {
+			kubernetesLog.WithFields(logrus.Fields{
+				"ingress":   ing.ObjectMeta.Name,
+				"namespace": ing.ObjectMeta.Namespace,
+				"class":     ing.ObjectMeta.Annotations[IngressClassKey],
+			}).Debug("Ignoring Ingress of another class")
+			status.Ignored = true
+			statuses = append(statuses, status)
+			continue
+		}
+
+		ingRP := reverseProxyConfig{}
+		ingZones, err := zones(ing.ObjectMeta.Namespace)
+		if err == nil && ing.Unsupported != "" {
+			err = &invalidIngressError{errors.New(ing.Unsupported)}
+		}
+		if err == nil {
+			err = rcg.addHTTPIngressToReverseProxyConfig(&ingRP, &ing, ingZones)
+		}
+		if err == nil && rcg.snippets != nil && hasSnippets(&ingRP) {
+			if verr := rcg.snippets.Validate(&ingRP); verr != nil {
+				err = &invalidIngressError{verr}
 			}
 		}
 
-		if err := rcg.addHTTPIngressToReverseProxyConfig(&rp, &ing); err != nil {
-			return nil, fmt.Errorf("failed building reverse proxy config for ingress %s in namespace %s: %v", ing.ObjectMeta.Name, ing.ObjectMeta.Name, err)
+		switch err.(type) {
+		case nil:
+			canonical := rcg.krc.canonicalHostnames(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace, ingZones)
+			hostnames, ingConflicts, problems := servers.add(&ing.Ingress, canonical, &ingRP)
+			conflicts = append(conflicts, ingConflicts...)
+			if len(problems) > 0 {
+				status.Error = strings.Join(problems, "; ")
+				status.Disabled = len(ingRP.HTTPServers) > 0 && len(hostnames) == 0
+			}
+
+			rp.HTTPUpstreams = append(rp.HTTPUpstreams, ingRP.HTTPUpstreams...)
+			status.Hostnames = append(status.Hostnames, hostnames...)
+		case *invalidIngressError:
+			kubernetesLog.WithFields(logrus.Fields{
+				"ingress":   ing.ObjectMeta.Name,
+				"namespace": ing.ObjectMeta.Namespace,
+			}).Errorf("Disabling invalid Ingress: %v", err)
+			status.Error = err.Error()
+			status.Disabled = true
+		default:
+			status.Error = err.Error()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed building reverse proxy config for ingress %s in namespace %s: %v", ing.ObjectMeta.Name, ing.ObjectMeta.Namespace, err)
+			}
 		}
+		statuses = append(statuses, status)
+	}
+
+	if rp.HTTPServers, err = servers.servers(); err != nil && firstErr == nil {
+		firstErr = err
 	}
 
+	rcg.mu.Lock()
+	rcg.statuses = statuses
+	rcg.conflicts = conflicts
+	rcg.mu.Unlock()
+
+	if rcg.snippets != nil {
+		rcg.snippets.Prune()
+	}
+	if rcg.drainer != nil {
+		rcg.drainer.Prune()
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
 	return &rp, nil
 }
 
-func (rcg *kubernetesReverseProxyConfigGetter) addHTTPIngressToReverseProxyConfig(rp *reverseProxyConfig, ing *kextensions.Ingress) error {
+// zones returns a function giving the cluster zones of Ingresses in a
+// namespace.
+func (rcg *kubernetesReverseProxyConfigGetter) zones() (func(namespace string) ([]string, error), error) {
+	if !rcg.krc.NamespaceZones {
+		return func(string) ([]string, error) {
+			return rcg.krc.ClusterZones, nil
+		}, nil
+	}
+
+	nsList, err := rcg.objs.ListNamespaces(kapi.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	byNamespace := map[string][]string{}
+	errs := map[string]error{}
+	for _, ns := range nsList.Items {
+		zones, err := rcg.krc.namespaceZones(ns.ObjectMeta.Annotations)
+		if err != nil {
+			errs[ns.ObjectMeta.Name] = &invalidIngressError{err}
+		} else if zones != nil {
+			byNamespace[ns.ObjectMeta.Name] = zones
+		}
+	}
+
+	return func(namespace string) ([]string, error) {
+		if err, ok := errs[namespace]; ok {
+			return nil, err
+		}
+		if zones, ok := byNamespace[namespace]; ok {
+			return zones, nil
+		}
+		return rcg.krc.ClusterZones, nil
+	}, nil
+}
+
+// serverNames returns the names of the server generated for an Ingress
+// rule: its canonical hostnames in each zone, the host of the rule and any
+// hostname aliases.
+func (rcg *kubernetesReverseProxyConfigGetter) serverNames(ing *kextensions.Ingress, rule *kextensions.IngressRule, zones []string) (string, []string, error) {
+	names := []string{}
+	if rule.Host == "" || rcg.krc.CanonicalHostnamePolicy != CanonicalHostnamePolicyUnlessHost {
+		names = append(names, rcg.krc.canonicalHostnames(ing.ObjectMeta.Name, ing.ObjectMeta.Namespace, zones)...)
+	}
+	if rule.Host != "" {
+		if err := validateHostname(rule.Host, rcg.krc.RegexHosts); err != nil {
+			return "", nil, &invalidIngressError{err}
+		}
+		names = append(names, rule.Host)
+	}
+	for _, alias := range rcg.krc.getAnnotationStringList(ing, HostnameAliasKey) {
+		if alias == "" {
+			continue
+		}
+		if err := validateHostname(alias, rcg.krc.RegexHosts); err != nil {
+			return "", nil, &invalidIngressError{fmt.Errorf("annotation %s: %v", rcg.krc.annotationKey(HostnameAliasKey), err)}
+		}
+		names = append(names, alias)
+	}
+	return names[0], names[1:], nil
+}
+
+// getAnnotationSubdomainHeader returns the header named by the subdomain
+// header annotation, if any.
+func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationSubdomainHeader(ing *kextensions.Ingress) (string, error) {
+	name := strings.TrimSpace(ing.ObjectMeta.Annotations[krc.annotationKey(SubdomainHeaderKey)])
+	if name == "" {
+		return "", nil
+	}
+	if err := validateHeaderName(name); err != nil {
+		return "", fmt.Errorf("annotation %s: %v", krc.annotationKey(SubdomainHeaderKey), err)
+	}
+	return name, nil
+}
+
+func (rcg *kubernetesReverseProxyConfigGetter) addHTTPIngressToReverseProxyConfig(rp *reverseProxyConfig, wrapped *ingress, zones []string) error {
+	ing := &wrapped.Ingress
 	ingNamespace := ing.ObjectMeta.Namespace
 	ingName := ing.ObjectMeta.Name
+	log := kubernetesLog.WithFields(logrus.Fields{
+		"ingress":   ingName,
+		"namespace": ingNamespace,
+	})
 
-	for _, rule := range ing.Spec.Rules {
+	proxySetHeaders, err := rcg.krc.getAnnotationHeaders(ing, ProxySetHeadersKey)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	addHeaders, err := rcg.krc.getAnnotationHeaders(ing, AddHeadersKey)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	proxyHideHeaders, err := parseHeaderNames(rcg.krc.getAnnotationStringList(ing, ProxyHideHeadersKey))
+	if err != nil {
+		return &invalidIngressError{fmt.Errorf("annotation %s: %v", rcg.krc.annotationKey(ProxyHideHeadersKey), err)}
+	}
+	serverSnippet, err := rcg.krc.getAnnotationSnippet(ing, ServerSnippetKey)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	locationSnippet, err := rcg.krc.getAnnotationSnippet(ing, LocationSnippetKey)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	subdomainHeader, err := rcg.krc.getAnnotationSubdomainHeader(ing)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	pathType, err := rcg.krc.getAnnotationPathTypes(ing)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+	backendMode, err := rcg.krc.getAnnotationBackendMode(wrapped)
+	if err != nil {
+		return &invalidIngressError{err}
+	}
+
+	// Rules with the same hosts share a server.
+	servers := map[string]int{}
+	// Paths sharing a Service port share its upstream, which NGINX only
+	// accepts once.
+	upstreams := map[string]bool{}
+
+	for ri, rule := range ing.Spec.Rules {
+		// A rule may name a host without any paths to serve.
+		if rule.HTTP == nil {
+			continue
+		}
+		name, altNames, err := rcg.serverNames(ing, &rule, zones)
+		if err != nil {
+			return err
+		}
 		srv := httpReverseProxyServer{
-			Name:       CanonicalHostname(ingName, ingNamespace, rcg.krc.ClusterZone),
-			AltNames:   rcg.krc.getAnnotationStringList(ing, HostnameAliasKey),
+			Name:       name,
+			AltNames:   altNames,
 			ListenPort: rcg.krc.ListenPort,
 			Locations:  []httpReverseProxyLocation{},
+
+			IngressName:      ingName,
+			IngressNamespace: ingNamespace,
+
+			ProxySetHeaders:  proxySetHeaders,
+			AddHeaders:       addHeaders,
+			ProxyHideHeaders: proxyHideHeaders,
+			Snippet:          serverSnippet,
 		}
 
-		logger.Log.WithFields(logrus.Fields{
-			"Name":        srv.Name,
-			"AltNames":    srv.AltNames,
-			"ListentPort": srv.ListenPort,
-		}).Info("Generating new reverse proxy server")
+		if subdomainHeader != "" {
+			for _, h := range append([]string{name}, altNames...) {
+				if isWildcardHostname(h) {
+					srv.SubdomainPatterns = append(srv.SubdomainPatterns, subdomainPattern(h))
+				}
+			}
+			if len(srv.SubdomainPatterns) > 0 {
+				srv.ProxySetHeaders = append(append([]httpHeader{}, proxySetHeaders...), httpHeader{Name: subdomainHeader, Value: "$farva_subdomain"})
+			}
+		}
 
-		for _, path := range rule.HTTP.Paths {
+		log.WithFields(logrus.Fields{
+			"Name":       srv.Name,
+			"AltNames":   srv.AltNames,
+			"ListenPort": srv.ListenPort,
+		}).Debug("Generating new reverse proxy server")
+
+		for pi, path := range rule.HTTP.Paths {
+			// The pathType field of newer API groups takes precedence
+			// over annotations.
+			pt := wrapped.pathType(ri, pi)
+			if pt == "" {
+				pt = pathType(path.Path)
+			}
+			locs, err := pathLocations(path.Path, pt)
+			if err != nil {
+				return &invalidIngressError{err}
+			}
+			if ri == wrapped.DefaultRule {
+				for i := range locs {
+					locs[i].implied = true
+				}
+			}
 
 			svcName := path.Backend.ServiceName
-			svcPort := path.Backend.ServicePort.IntValue()
+			svcPort := path.Backend.ServicePort
 
 			up := httpReverseProxyUpstream{
-				Name: strings.Join([]string{ingNamespace, ingName, svcName}, "__"),
-			}
-
-			svcTargetPort, err := rcg.getServiceTargetPort(ingNamespace, svcName, svcPort)
-			if err != nil {
-				return err
+				Name: strings.Join([]string{ingNamespace, ingName, svcName, svcPort.String()}, "__"),
 			}
 
-			up.Servers, err = rcg.getServiceEndpoints(ingNamespace, svcName, svcTargetPort)
-			if err != nil {
+			if err := rcg.getBackend(&up, ingNamespace, svcName, svcPort, backendMode); err != nil {
 				return err
 			}
 
 			if len(up.Servers) == 0 {
-				logger.Log.WithFields(logrus.Fields{
-					"svcName":       svcName,
-					"ingNamespace":  ingNamespace,
-					"svcTargetPort": svcTargetPort,
+				log.WithFields(logrus.Fields{
+					"svcName": svcName,
+					"svcPort": svcPort.String(),
 				}).Infof("No servers found for upstream, using StaticCode for %s", path.Path)
-				srv.Locations = append(srv.Locations, httpReverseProxyLocation{
-					Path:       path.Path,
-					StaticCode: 503,
-				})
+				for _, loc := range locs {
+					loc.StaticCode = 503
+					loc.Snippet = locationSnippet
+					srv.Locations = append(srv.Locations, loc)
+				}
 			} else {
-				rp.HTTPUpstreams = append(rp.HTTPUpstreams, up)
-				srv.Locations = append(srv.Locations, httpReverseProxyLocation{
-					Path:     path.Path,
-					Upstream: up.Name,
-				})
+				if !upstreams[up.Name] {
+					upstreams[up.Name] = true
+					rp.HTTPUpstreams = append(rp.HTTPUpstreams, up)
+				}
+				for _, loc := range locs {
+					loc.Upstream = up.Name
+					loc.Snippet = locationSnippet
+					srv.Locations = append(srv.Locations, loc)
+				}
 			}
 		}
 
+		key := strings.Join(append([]string{srv.Name}, srv.AltNames...), " ")
+		if i, ok := servers[key]; ok {
+			rp.HTTPServers[i].Locations = append(rp.HTTPServers[i].Locations, srv.Locations...)
+			continue
+		}
+		servers[key] = len(rp.HTTPServers)
 		rp.HTTPServers = append(rp.HTTPServers, srv)
 	}
 
+	for i := range rp.HTTPServers {
+		rp.HTTPServers[i].Locations, err = orderLocations(rp.HTTPServers[i].Locations)
+		if err != nil {
+			return &invalidIngressError{err}
+		}
+	}
+
 	return nil
 }
 
+// getAnnotationPathTypes returns a function giving the type of each path of
+// an Ingress from its path type annotations.
+func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationPathTypes(ing *kextensions.Ingress) (func(path string) string, error) {
+	anno := ing.ObjectMeta.Annotations
+	defaultType := strings.TrimSpace(anno[krc.annotationKey(PathTypeKey)])
+	if !validPathType(defaultType) {
+		return nil, fmt.Errorf("annotation %s: invalid path type %q", krc.annotationKey(PathTypeKey), defaultType)
+	}
+
+	types := map[string]string{}
+	if val := strings.TrimSpace(anno[krc.annotationKey(PathTypesKey)]); val != "" {
+		var kv flagutil.KVSliceFlag
+		if err := kv.Set(val); err != nil {
+			return nil, fmt.Errorf("annotation %s: %v", krc.annotationKey(PathTypesKey), err)
+		}
+		for _, pair := range kv {
+			if !validPathType(pair[1]) {
+				return nil, fmt.Errorf("annotation %s: invalid path type %q", krc.annotationKey(PathTypesKey), pair[1])
+			}
+			types[pair[0]] = pair[1]
+		}
+	}
+
+	return func(path string) string {
+		if t, ok := types[path]; ok {
+			return t
+		}
+		return defaultType
+	}, nil
+}
+
+func hasSnippets(rc *reverseProxyConfig) bool {
+	for _, srv := range rc.HTTPServers {
+		if len(srv.Snippet) > 0 {
+			return true
+		}
+		for _, loc := range srv.Locations {
+			if len(loc.Snippet) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func CanonicalHostname(name, namespace, clusterZone string) string {
-	return strings.Join([]string{name, namespace, clusterZone}, ".")
+	return renderHostname(DefaultHostnameTemplate, name, namespace, clusterZone)
 }
@@ -0,0 +1,231 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kextensions "k8s.io/kubernetes/pkg/apis/extensions"
+	klabels "k8s.io/kubernetes/pkg/labels"
+)
+
+func newTestIngress(namespace, name string, annotations map[string]string) *ingress {
+	return &ingress{
+		Ingress: kextensions.Ingress{
+			ObjectMeta: kapi.ObjectMeta{
+				Namespace:   namespace,
+				Name:        name,
+				Annotations: annotations,
+			},
+		},
+		DefaultRule: -1,
+	}
+}
+
+func TestHandlesIngress(t *testing.T) {
+	internal := newTestIngress("default", "internal", map[string]string{IngressClassKey: "internal"})
+	public := newTestIngress("default", "public", map[string]string{IngressClassKey: "public"})
+	unclassed := newTestIngress("default", "unclassed", nil)
+	classNamed := newTestIngress("default", "class-named", nil)
+	classNamed.ClassName = "internal"
+	overridden := newTestIngress("default", "overridden", map[string]string{IngressClassKey: "public"})
+	overridden.ClassName = "internal"
+
+	tests := []struct {
+		class  string
+		policy string
+		ing    *ingress
+		want   bool
+	}{
+		// no class configured handles everything
+		{class: "", policy: UnclassedIngressPolicyIgnore, ing: internal, want: true},
+		{class: "", policy: UnclassedIngressPolicyIgnore, ing: unclassed, want: true},
+
+		// matching and non-matching classes
+		{class: "internal", policy: UnclassedIngressPolicyClaim, ing: internal, want: true},
+		{class: "internal", policy: UnclassedIngressPolicyClaim, ing: public, want: false},
+
+		// unclassed Ingresses follow the policy
+		{class: "internal", policy: UnclassedIngressPolicyClaim, ing: unclassed, want: true},
+		{class: "internal", policy: UnclassedIngressPolicyIgnore, ing: unclassed, want: false},
+
+		// ingressClassName is used unless the annotation is set
+		{class: "internal", policy: UnclassedIngressPolicyIgnore, ing: classNamed, want: true},
+		{class: "internal", policy: UnclassedIngressPolicyClaim, ing: overridden, want: false},
+	}
+
+	for i, tt := range tests {
+		krc := kubernetesReverseProxyConfigGetterConfig{
+			IngressClass:           tt.class,
+			UnclassedIngressPolicy: tt.policy,
+		}
+		if got := krc.handlesIngress(tt.ing); got != tt.want {
+			t.Errorf("case %d: want=%t got=%t", i, tt.want, got)
+		}
+	}
+}
+
+const testScopeManifest = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: red
+  labels:
+    tenant: a
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: green
+  labels:
+    tenant: a
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: blue
+  labels:
+    tenant: b
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+  namespace: red
+  labels:
+    public: "true"
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: api
+  namespace: red
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+  namespace: green
+  labels:
+    public: "true"
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: web
+  namespace: blue
+  labels:
+    public: "true"
+`
+
+func TestListIngresses(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testScopeManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		namespaces        []string
+		namespaceSelector string
+		ingressSelector   string
+		want              []string
+	}{
+		// all namespaces
+		{
+			want: []string{"red/web", "red/api", "green/web", "blue/web"},
+		},
+		{
+			ingressSelector: "public=true",
+			want:            []string{"red/web", "green/web", "blue/web"},
+		},
+
+		// single namespace
+		{
+			namespaces: []string{"red"},
+			want:       []string{"red/web", "red/api"},
+		},
+		{
+			namespaces:      []string{"red"},
+			ingressSelector: "public=true",
+			want:            []string{"red/web"},
+		},
+
+		// multiple namespaces
+		{
+			namespaces: []string{"green", "blue"},
+			want:       []string{"green/web", "blue/web"},
+		},
+		{
+			namespaces:      []string{"red", "blue"},
+			ingressSelector: "public=true",
+			want:            []string{"red/web", "blue/web"},
+		},
+
+		// namespace selector, alone and limited to listed namespaces
+		{
+			namespaceSelector: "tenant=a",
+			want:              []string{"red/web", "red/api", "green/web"},
+		},
+		{
+			namespaceSelector: "tenant=a",
+			ingressSelector:   "public=true",
+			want:              []string{"red/web", "green/web"},
+		},
+		{
+			namespaces:        []string{"green", "blue"},
+			namespaceSelector: "tenant=a",
+			want:              []string{"green/web"},
+		},
+		{
+			namespaceSelector: "tenant=c",
+			want:              []string{},
+		},
+	}
+
+	for i, tt := range tests {
+		krc := DefaultKubernetesReverseProxyConfigGetterConfig
+		krc.Namespaces = tt.namespaces
+		var err error
+		if tt.namespaceSelector != "" {
+			if krc.NamespaceSelector, err = klabels.Parse(tt.namespaceSelector); err != nil {
+				t.Fatalf("case %d: invalid selector: %v", i, err)
+			}
+		}
+		if tt.ingressSelector != "" {
+			if krc.IngressSelector, err = klabels.Parse(tt.ingressSelector); err != nil {
+				t.Fatalf("case %d: invalid selector: %v", i, err)
+			}
+		}
+
+		rcg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+		ingresses, err := rcg.listIngresses()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+
+		got := []string{}
+		for _, ing := range ingresses {
+			got = append(got, ing.ObjectMeta.Namespace+"/"+ing.ObjectMeta.Name)
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bcwaldon/klondike/src/farva/pkg/metrics"
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// LeaderAnnotationKey is the annotation on the lock ConfigMap that records
+// the current leader. It matches the annotation the Kubernetes control plane
+// components use for the same purpose.
+const LeaderAnnotationKey = "control-plane.alpha.kubernetes.io/leader"
+
+type leaderElectionRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+func (r leaderElectionRecord) equal(o leaderElectionRecord) bool {
+	return r.HolderIdentity == o.HolderIdentity && r.RenewTime.Equal(o.RenewTime)
+}
+
+func newLeaderElector(cms kclient.ConfigMapsInterface, name, identity string, leaseDuration time.Duration) *leaderElector {
+	return &leaderElector{
+		cms:           cms,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		now:           time.Now,
+	}
+}
+
+// leaderElector elects a single leader among farva replicas using an
+// annotation on a ConfigMap as the lock. Optimistic concurrency on the
+// ConfigMap guarantees only one replica can take over an expired lease.
+// Expiry is judged by the local clock from the moment a record was first
+// observed, so replicas don't need synchronized clocks.
+type leaderElector struct {
+	cms           kclient.ConfigMapsInterface
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	now           func() time.Time
+
+	mu             sync.Mutex
+	leader         bool
+	observedRecord leaderElectionRecord
+	observedTime   time.Time
+}
+
+func (le *leaderElector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(le.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		le.setLeader(le.tryAcquireOrRenew())
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (le *leaderElector) IsLeader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leader
+}
+
+func (le *leaderElector) setLeader(leader bool) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	if leader != le.leader {
+		log := gatewayLog.WithField("identity", le.identity)
+		if leader {
+			log.Info("Became leader")
+		} else {
+			log.WithField("holder", le.observedRecord.HolderIdentity).Info("No longer leader")
+		}
+	}
+	le.leader = leader
+	metrics.SetLeader(leader)
+}
+
+// tryAcquireOrRenew attempts to take or extend the lease and reports whether
+// this replica holds it afterwards.
+func (le *leaderElector) tryAcquireOrRenew() bool {
+	now := le.now()
+	rec := leaderElectionRecord{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(le.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+
+	cm, err := le.cms.Get(le.name)
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			gatewayLog.Errorf("Failed reading leader election lock %s: %v", le.name, err)
+			return false
+		}
+
+		cm = &kapi.ConfigMap{ObjectMeta: kapi.ObjectMeta{Name: le.name}}
+		if err := le.annotate(cm, rec); err != nil {
+			return false
+		}
+		if _, err := le.cms.Create(cm); err != nil {
+			gatewayLog.Debugf("Failed creating leader election lock %s: %v", le.name, err)
+			return false
+		}
+		le.observe(rec, now)
+		return true
+	}
+
+	var old leaderElectionRecord
+	if raw, ok := cm.ObjectMeta.Annotations[LeaderAnnotationKey]; ok {
+		if err := json.Unmarshal([]byte(raw), &old); err != nil {
+			gatewayLog.Errorf("Ignoring invalid leader election record on %s: %v", le.name, err)
+		}
+	}
+
+	le.mu.Lock()
+	if !old.equal(le.observedRecord) {
+		le.observedRecord = old
+		le.observedTime = now
+	}
+	expiry := le.observedTime.Add(le.leaseDuration)
+	le.mu.Unlock()
+
+	if old.HolderIdentity != "" && old.HolderIdentity != le.identity && now.Before(expiry) {
+		return false
+	}
+	if old.HolderIdentity == le.identity {
+		rec.AcquireTime = old.AcquireTime
+	}
+
+	if err := le.annotate(cm, rec); err != nil {
+		return false
+	}
+	if _, err := le.cms.Update(cm); err != nil {
+		gatewayLog.WithFields(logrus.Fields{
+			"identity": le.identity,
+			"holder":   old.HolderIdentity,
+		}).Debugf("Failed updating leader election lock %s: %v", le.name, err)
+		return false
+	}
+	le.observe(rec, now)
+	return true
+}
+
+func (le *leaderElector) annotate(cm *kapi.ConfigMap, rec leaderElectionRecord) error {
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		gatewayLog.Errorf("Failed encoding leader election record: %v", err)
+		return err
+	}
+	if cm.ObjectMeta.Annotations == nil {
+		cm.ObjectMeta.Annotations = map[string]string{}
+	}
+	cm.ObjectMeta.Annotations[LeaderAnnotationKey] = string(raw)
+	return nil
+}
+
+func (le *leaderElector) observe(rec leaderElectionRecord, now time.Time) {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	le.observedRecord = rec
+	le.observedTime = now
+}
+
+// HealthStatus reports the election state for the health JSON.
+func (le *leaderElector) HealthStatus() interface{} {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+
+	return struct {
+		Identity string `json:"identity"`
+		Leader   bool   `json:"leader"`
+		Holder   string `json:"holder"`
+	}{
+		Identity: le.identity,
+		Leader:   le.leader,
+		Holder:   le.observedRecord.HolderIdentity,
+	}
+}
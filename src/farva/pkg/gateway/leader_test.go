@@ -0,0 +1,124 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+// fakeConfigMaps stores a single ConfigMap and rejects stale updates the
+// way the API server does.
+type fakeConfigMaps struct {
+	kclient.ConfigMapsInterface
+	cm      *kapi.ConfigMap
+	version int
+}
+
+var configMapResource = unversioned.GroupResource{Resource: "configmaps"}
+
+func (f *fakeConfigMaps) Get(name string) (*kapi.ConfigMap, error) {
+	if f.cm == nil {
+		return nil, kerrors.NewNotFound(configMapResource, name)
+	}
+	cm := *f.cm
+	cm.ObjectMeta.Annotations = map[string]string{}
+	for k, v := range f.cm.ObjectMeta.Annotations {
+		cm.ObjectMeta.Annotations[k] = v
+	}
+	return &cm, nil
+}
+
+func (f *fakeConfigMaps) Create(cm *kapi.ConfigMap) (*kapi.ConfigMap, error) {
+	if f.cm != nil {
+		return nil, errors.New("already exists")
+	}
+	return f.store(cm), nil
+}
+
+func (f *fakeConfigMaps) Update(cm *kapi.ConfigMap) (*kapi.ConfigMap, error) {
+	if f.cm == nil || cm.ObjectMeta.ResourceVersion != f.cm.ObjectMeta.ResourceVersion {
+		return nil, kerrors.NewConflict(configMapResource, cm.ObjectMeta.Name, errors.New("stale"))
+	}
+	return f.store(cm), nil
+}
+
+func (f *fakeConfigMaps) store(cm *kapi.ConfigMap) *kapi.ConfigMap {
+	f.version++
+	stored := *cm
+	stored.ObjectMeta.ResourceVersion = strconv.Itoa(f.version)
+	f.cm = &stored
+	return &stored
+}
+
+func TestLeaderElectorTryAcquireOrRenew(t *testing.T) {
+	cms := &fakeConfigMaps{}
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	a := newLeaderElector(cms, "farva-leader", "a", 15*time.Second)
+	a.now = clock
+	b := newLeaderElector(cms, "farva-leader", "b", 15*time.Second)
+	b.now = clock
+
+	steps := []struct {
+		advance time.Duration
+		le      *leaderElector
+		want    bool
+	}{
+		// a creates the lock
+		{0, a, true},
+		// b sees a valid lease held by a
+		{0, b, false},
+		// a renews
+		{10 * time.Second, a, true},
+		// b observed a new renewal, so the lease is still valid
+		{10 * time.Second, b, false},
+		// a stops renewing, but b has not waited a full lease since its last observation
+		{10 * time.Second, b, false},
+		// b takes over once the lease expires
+		{10 * time.Second, b, true},
+		// a sees b's fresh lease and backs off
+		{0, a, false},
+	}
+
+	for i, tt := range steps {
+		now = now.Add(tt.advance)
+		if got := tt.le.tryAcquireOrRenew(); got != tt.want {
+			t.Errorf("step %d: %s tryAcquireOrRenew=%t, want %t", i, tt.le.identity, got, tt.want)
+		}
+	}
+}
+
+func TestLeaderElectorExistingConfigMap(t *testing.T) {
+	cms := &fakeConfigMaps{}
+	cms.store(&kapi.ConfigMap{ObjectMeta: kapi.ObjectMeta{Name: "farva-leader"}})
+
+	le := newLeaderElector(cms, "farva-leader", "a", 15*time.Second)
+	if !le.tryAcquireOrRenew() {
+		t.Fatalf("expected to acquire lock on unannotated ConfigMap")
+	}
+	if _, ok := cms.cm.ObjectMeta.Annotations[LeaderAnnotationKey]; !ok {
+		t.Errorf("expected %s annotation on lock ConfigMap", LeaderAnnotationKey)
+	}
+}
@@ -0,0 +1,272 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	_ "k8s.io/kubernetes/pkg/api/install"
+	"k8s.io/kubernetes/pkg/api/unversioned"
+	kextensions "k8s.io/kubernetes/pkg/apis/extensions"
+	_ "k8s.io/kubernetes/pkg/apis/extensions/install"
+	klabels "k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/runtime"
+	kyaml "k8s.io/kubernetes/pkg/util/yaml"
+)
+
+// manifestObjectGetter serves Kubernetes objects read from manifest files
+// rather than from a live cluster.
+type manifestObjectGetter struct {
+	namespaces []kapi.Namespace
+	ingresses  []ingress
+	services   map[string]service
+	endpoints  map[string]kapi.Endpoints
+
+	gateways   []gatewayObject
+	httpRoutes []httpRouteObject
+}
+
+func newManifestObjectGetter() *manifestObjectGetter {
+	return &manifestObjectGetter{
+		services:  map[string]service{},
+		endpoints: map[string]kapi.Endpoints{},
+	}
+}
+
+// loadManifestObjects reads every manifest at the given paths. Directories
+// are read non-recursively, taking files ending in .yaml, .yml or .json.
+func loadManifestObjects(paths []string) (*manifestObjectGetter, error) {
+	g := newManifestObjectGetter()
+	for _, path := range paths {
+		files, err := manifestFiles(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := g.loadFile(file); err != nil {
+				return nil, fmt.Errorf("failed loading %s: %v", file, err)
+			}
+		}
+	}
+	return g, nil
+}
+
+func manifestFiles(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{path}, nil
+	}
+
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{}
+	for _, info := range infos {
+		switch filepath.Ext(info.Name()) {
+		case ".yaml", ".yml", ".json":
+			if !info.IsDir() {
+				files = append(files, filepath.Join(path, info.Name()))
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (g *manifestObjectGetter) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return g.load(f)
+}
+
+// load decodes a stream of YAML documents or JSON objects. Each may be a
+// single object or a List of objects.
+func (g *manifestObjectGetter) load(r io.Reader) error {
+	dec := kyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var doc map[string]interface{}
+		if err := dec.Decode(&doc); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if len(doc) == 0 {
+			continue
+		}
+
+		if err := g.loadDoc(doc); err != nil {
+			return err
+		}
+	}
+}
+
+// loadDoc adds a single decoded document. Lists, Ingresses of the
+// networking.k8s.io group, Gateway API objects and Services, which have
+// fields the vendored API doesn't know, are handled before decoding.
+func (g *manifestObjectGetter) loadDoc(doc map[string]interface{}) error {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	apiVersion, _ := doc["apiVersion"].(string)
+	switch kind, _ := doc["kind"].(string); {
+	case kind == "List":
+		var list struct {
+			Items []map[string]interface{} `json:"items"`
+		}
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		for _, item := range list.Items {
+			if err := g.loadDoc(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	case kind == "Ingress" && isNetworkingGroupVersion(apiVersion):
+		var ni networkingIngress
+		if err := json.Unmarshal(data, &ni); err != nil {
+			return err
+		}
+		defaultNamespace(&ni.ObjectMeta)
+		g.ingresses = append(g.ingresses, ni.convert())
+		return nil
+	case kind == "Service":
+		var svc service
+		if err := json.Unmarshal(data, &svc); err != nil {
+			return err
+		}
+		defaultNamespace(&svc.ObjectMeta)
+		g.services[svc.ObjectMeta.Namespace+"/"+svc.ObjectMeta.Name] = svc
+		return nil
+	case kind == "Gateway" && isGatewayAPIGroupVersion(apiVersion):
+		var gw gatewayObject
+		if err := json.Unmarshal(data, &gw); err != nil {
+			return err
+		}
+		defaultNamespace(&gw.ObjectMeta)
+		g.gateways = append(g.gateways, gw)
+		return nil
+	case kind == "HTTPRoute" && isGatewayAPIGroupVersion(apiVersion):
+		var route httpRouteObject
+		if err := json.Unmarshal(data, &route); err != nil {
+			return err
+		}
+		defaultNamespace(&route.ObjectMeta)
+		g.httpRoutes = append(g.httpRoutes, route)
+		return nil
+	}
+
+	obj, err := runtime.Decode(kapi.Codecs.UniversalDecoder(), data)
+	if err != nil {
+		return err
+	}
+	return g.add(obj)
+}
+
+func (g *manifestObjectGetter) add(obj runtime.Object) error {
+	switch o := obj.(type) {
+	case *kapi.Namespace:
+		g.namespaces = append(g.namespaces, *o)
+	case *kextensions.Ingress:
+		defaultNamespace(&o.ObjectMeta)
+		g.ingresses = append(g.ingresses, ingressFromExtensions(*o))
+	case *kapi.Endpoints:
+		defaultNamespace(&o.ObjectMeta)
+		g.endpoints[o.ObjectMeta.Namespace+"/"+o.ObjectMeta.Name] = *o
+	default:
+		kubernetesLog.Debugf("Ignoring manifest object of type %T", obj)
+	}
+	return nil
+}
+
+// defaultNamespace places objects without a namespace in the default
+// namespace, as kubectl would.
+func defaultNamespace(meta *kapi.ObjectMeta) {
+	if meta.Namespace == "" {
+		meta.Namespace = kapi.NamespaceDefault
+	}
+}
+
+func (g *manifestObjectGetter) ListNamespaces(opts kapi.ListOptions) (*kapi.NamespaceList, error) {
+	list := &kapi.NamespaceList{}
+	for _, ns := range g.namespaces {
+		if manifestSelected(opts, ns.ObjectMeta) {
+			list.Items = append(list.Items, ns)
+		}
+	}
+	return list, nil
+}
+
+func (g *manifestObjectGetter) ListIngresses(namespace string, opts kapi.ListOptions) ([]ingress, error) {
+	list := []ingress{}
+	for _, ing := range g.ingresses {
+		if namespace != kapi.NamespaceAll && ing.ObjectMeta.Namespace != namespace {
+			continue
+		}
+		if manifestSelected(opts, ing.ObjectMeta) {
+			list = append(list, ing)
+		}
+	}
+	return list, nil
+}
+
+func (g *manifestObjectGetter) ListGateways() ([]gatewayObject, error) {
+	return g.gateways, nil
+}
+
+func (g *manifestObjectGetter) ListHTTPRoutes() ([]httpRouteObject, error) {
+	return g.httpRoutes, nil
+}
+
+func (g *manifestObjectGetter) GetService(namespace, name string) (*service, error) {
+	svc, ok := g.services[namespace+"/"+name]
+	if !ok {
+		return nil, kerrors.NewNotFound(unversioned.GroupResource{Resource: "services"}, name)
+	}
+	return &svc, nil
+}
+
+func (g *manifestObjectGetter) GetEndpoints(namespace, name string) (*kapi.Endpoints, error) {
+	ep, ok := g.endpoints[namespace+"/"+name]
+	if !ok {
+		return nil, kerrors.NewNotFound(unversioned.GroupResource{Resource: "endpoints"}, name)
+	}
+	return &ep, nil
+}
+
+func manifestSelected(opts kapi.ListOptions, meta kapi.ObjectMeta) bool {
+	if opts.LabelSelector == nil {
+		return true
+	}
+	return opts.LabelSelector.Matches(klabels.Set(meta.Labels))
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: bar
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: bar
+  spec:
+    ports:
+    - port: 80
+      targetPort: 8080
+- apiVersion: v1
+  kind: Endpoints
+  metadata:
+    name: web
+    namespace: bar
+  subsets:
+  - addresses:
+    - ip: 10.0.0.1
+      targetRef:
+        kind: Pod
+        name: web-1
+    ports:
+    - port: 8080
+---
+{"apiVersion": "extensions/v1beta1", "kind": "Ingress", "metadata": {"name": "broken"}, "spec": {"backend": {"serviceName": "missing", "servicePort": 80}}}
+`
+
+func TestManifestReverseProxyConfig(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.ListenPort = 7331
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+
+	if _, err := rg.ReverseProxyConfig(); err == nil {
+		t.Fatalf("expected error for Ingress with missing Service")
+	}
+
+	want := []IngressStatus{
+		IngressStatus{
+			Namespace: "bar",
+			Name:      "foo",
+			Hostnames: []string{"foo.bar.example.com"},
+		},
+		IngressStatus{
+			Namespace: "default",
+			Name:      "broken",
+			Error:     `services "missing" not found`,
+		},
+	}
+	if diff := pretty.Compare(want, rg.IngressStatuses()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	// Without the broken Ingress the config builds.
+	kept := []ingress{}
+	for _, ing := range objs.ingresses {
+		if ing.ObjectMeta.Name != "broken" {
+			kept = append(kept, ing)
+		}
+	}
+	objs.ingresses = kept
+	rc, err := rg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	wantUpstreams := []httpReverseProxyUpstream{
+		httpReverseProxyUpstream{
+			Name: "bar__foo__web__80",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "web-1", Host: "10.0.0.1", Port: 8080},
+			},
+		},
+	}
+	if diff := pretty.Compare(wantUpstreams, rc.HTTPUpstreams); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
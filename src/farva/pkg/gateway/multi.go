@@ -0,0 +1,134 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// HostnameConflict describes a server, or one path of it if Path is set,
+// dropped from the merged config because an earlier source or Ingress
+// already claimed it.
+type HostnameConflict struct {
+	Hostname   string `json:"hostname"`
+	ListenPort int    `json:"listenPort"`
+	Path       string `json:"path,omitempty"`
+	Kept       string `json:"kept"`
+	Dropped    string `json:"dropped"`
+}
+
+type namedReverseProxyConfigGetter struct {
+	name string
+	ReverseProxyConfigGetter
+}
+
+func newMultiReverseProxyConfigGetter(sources ...namedReverseProxyConfigGetter) *multiReverseProxyConfigGetter {
+	return &multiReverseProxyConfigGetter{sources: sources}
+}
+
+// multiReverseProxyConfigGetter merges the configs of several sources. When
+// two sources define a server for the same hostname and port, the earlier
+// source wins and the conflict is reported.
+type multiReverseProxyConfigGetter struct {
+	sources []namedReverseProxyConfigGetter
+
+	mu        sync.Mutex
+	conflicts []HostnameConflict
+}
+
+func (m *multiReverseProxyConfigGetter) ReverseProxyConfig() (*reverseProxyConfig, error) {
+	merged := reverseProxyConfig{}
+	owners := map[string]string{}
+	conflicts := []HostnameConflict{}
+
+	for _, src := range m.sources {
+		rc, err := src.ReverseProxyConfig()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.name, err)
+		}
+
+		for _, srv := range rc.HTTPServers {
+			hostnames := append([]string{srv.Name}, srv.AltNames...)
+
+			var conflict *HostnameConflict
+			for _, h := range hostnames {
+				key := fmt.Sprintf("%s:%d", h, srv.ListenPort)
+				if owner, ok := owners[key]; ok && owner != src.name {
+					conflict = &HostnameConflict{
+						Hostname:   h,
+						ListenPort: srv.ListenPort,
+						Kept:       owner,
+						Dropped:    src.name,
+					}
+					break
+				}
+			}
+			if conflict != nil {
+				gatewayLog.WithFields(logrus.Fields{
+					"hostname": conflict.Hostname,
+					"kept":     conflict.Kept,
+					"dropped":  conflict.Dropped,
+				}).Error("Dropping server with conflicting hostname")
+				conflicts = append(conflicts, *conflict)
+				continue
+			}
+
+			for _, h := range hostnames {
+				owners[fmt.Sprintf("%s:%d", h, srv.ListenPort)] = src.name
+			}
+			merged.HTTPServers = append(merged.HTTPServers, srv)
+		}
+
+		merged.HTTPUpstreams = append(merged.HTTPUpstreams, rc.HTTPUpstreams...)
+		merged.TCPServers = append(merged.TCPServers, rc.TCPServers...)
+		merged.TCPUpstreams = append(merged.TCPUpstreams, rc.TCPUpstreams...)
+	}
+
+	m.mu.Lock()
+	m.conflicts = conflicts
+	m.mu.Unlock()
+
+	return &merged, nil
+}
+
+// Conflicts returns the hostname conflicts found during the most recent
+// call to ReverseProxyConfig, including those found by any source.
+func (m *multiReverseProxyConfigGetter) Conflicts() []HostnameConflict {
+	conflicts := []HostnameConflict{}
+	for _, src := range m.sources {
+		if cg, ok := src.ReverseProxyConfigGetter.(conflictGetter); ok {
+			conflicts = append(conflicts, cg.Conflicts()...)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append(conflicts, m.conflicts...)
+}
+
+// IngressStatuses returns the Ingress status of any source that tracks it.
+func (m *multiReverseProxyConfigGetter) IngressStatuses() []IngressStatus {
+	statuses := []IngressStatus{}
+	for _, src := range m.sources {
+		if sg, ok := src.ReverseProxyConfigGetter.(ingressStatusGetter); ok {
+			statuses = append(statuses, sg.IngressStatuses()...)
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,331 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"strings"
+
+	kapi "k8s.io/kubernetes/pkg/api"
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kextensions "k8s.io/kubernetes/pkg/apis/extensions"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// ingress is an Ingress from any API group, as the extensions type plus the
+// fields only newer groups have.
+type ingress struct {
+	kextensions.Ingress
+
+	// ClassName is spec.ingressClassName.
+	ClassName string
+	// PathTypes holds the pathType of each path of each rule, or is nil if
+	// the API group has no path types.
+	PathTypes [][]string
+	// DefaultRule is the index of the rule generated from the default
+	// backend, or -1. Its path gives way to any other for the same hosts.
+	DefaultRule int
+	// Unsupported, if set, explains why the Ingress can't be served.
+	Unsupported string
+}
+
+// pathType returns the API pathType of a path, if any.
+func (ing *ingress) pathType(rule, path int) string {
+	if rule < len(ing.PathTypes) && path < len(ing.PathTypes[rule]) {
+		return ing.PathTypes[rule][path]
+	}
+	return ""
+}
+
+// setDefaultBackend adds a rule for any host without a matching rule,
+// serving every path from backend.
+func (ing *ingress) setDefaultBackend(backend kextensions.IngressBackend) {
+	ing.Spec.Backend = nil
+	ing.DefaultRule = len(ing.Spec.Rules)
+	ing.Spec.Rules = append(ing.Spec.Rules, kextensions.IngressRule{
+		IngressRuleValue: kextensions.IngressRuleValue{
+			HTTP: &kextensions.HTTPIngressRuleValue{
+				Paths: []kextensions.HTTPIngressPath{
+					kextensions.HTTPIngressPath{
+						Path:    "/",
+						Backend: backend,
+					},
+				},
+			},
+		},
+	})
+}
+
+func ingressFromExtensions(ing kextensions.Ingress) ingress {
+	wrapped := ingress{Ingress: ing, DefaultRule: -1}
+	if ing.Spec.Backend != nil {
+		wrapped.setDefaultBackend(*ing.Spec.Backend)
+	}
+	return wrapped
+}
+
+// API group versions serving Ingresses, newest first.
+var ingressGroupVersions = []string{
+	"networking.k8s.io/v1",
+	"networking.k8s.io/v1beta1",
+	"extensions/v1beta1",
+}
+
+func isNetworkingGroupVersion(gv string) bool {
+	return strings.HasPrefix(gv, "networking.k8s.io/")
+}
+
+// networkingIngress decodes an Ingress of networking.k8s.io/v1 or v1beta1.
+type networkingIngress struct {
+	ObjectMeta kapi.ObjectMeta       `json:"metadata"`
+	Spec       networkingIngressSpec `json:"spec"`
+}
+
+type networkingIngressList struct {
+	Items []networkingIngress `json:"items"`
+}
+
+type networkingIngressSpec struct {
+	IngressClassName *string                   `json:"ingressClassName"`
+	DefaultBackend   *networkingIngressBackend `json:"defaultBackend"`
+	Backend          *networkingIngressBackend `json:"backend"`
+	Rules            []networkingIngressRule   `json:"rules"`
+}
+
+type networkingIngressRule struct {
+	Host string `json:"host"`
+	HTTP *struct {
+		Paths []networkingIngressPath `json:"paths"`
+	} `json:"http"`
+}
+
+type networkingIngressPath struct {
+	Path     string                   `json:"path"`
+	PathType *string                  `json:"pathType"`
+	Backend  networkingIngressBackend `json:"backend"`
+}
+
+type networkingIngressBackend struct {
+	// v1
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int32  `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+
+	// v1beta1
+	ServiceName string             `json:"serviceName"`
+	ServicePort intstr.IntOrString `json:"servicePort"`
+
+	Resource *struct {
+		APIGroup *string `json:"apiGroup"`
+		Kind     string  `json:"kind"`
+		Name     string  `json:"name"`
+	} `json:"resource"`
+}
+
+// convert returns the extensions backend, or an error for a resource
+// backend since only Services can be proxied to.
+func (b *networkingIngressBackend) convert() (kextensions.IngressBackend, error) {
+	switch {
+	case b.Resource != nil:
+		return kextensions.IngressBackend{}, fmt.Errorf("resource backend %s %s is not supported", b.Resource.Kind, b.Resource.Name)
+	case b.Service != nil:
+		port := intstr.FromInt(int(b.Service.Port.Number))
+		if b.Service.Port.Name != "" {
+			port = intstr.FromString(b.Service.Port.Name)
+		}
+		return kextensions.IngressBackend{ServiceName: b.Service.Name, ServicePort: port}, nil
+	default:
+		return kextensions.IngressBackend{ServiceName: b.ServiceName, ServicePort: b.ServicePort}, nil
+	}
+}
+
+func (ni *networkingIngress) convert() ingress {
+	ing := ingress{
+		Ingress: kextensions.Ingress{
+			ObjectMeta: ni.ObjectMeta,
+		},
+		PathTypes:   [][]string{},
+		DefaultRule: -1,
+	}
+	if ni.Spec.IngressClassName != nil {
+		ing.ClassName = *ni.Spec.IngressClassName
+	}
+
+	unsupported := func(err error) {
+		if ing.Unsupported == "" {
+			ing.Unsupported = err.Error()
+		}
+	}
+
+	for _, nr := range ni.Spec.Rules {
+		rule := kextensions.IngressRule{Host: nr.Host}
+		pathTypes := []string{}
+		if nr.HTTP != nil {
+			rule.HTTP = &kextensions.HTTPIngressRuleValue{}
+			for _, np := range nr.HTTP.Paths {
+				backend, err := np.Backend.convert()
+				if err != nil {
+					unsupported(err)
+				}
+				rule.HTTP.Paths = append(rule.HTTP.Paths, kextensions.HTTPIngressPath{
+					Path:    np.Path,
+					Backend: backend,
+				})
+				pathType := ""
+				if np.PathType != nil {
+					pathType = *np.PathType
+				}
+				pathTypes = append(pathTypes, pathType)
+			}
+		}
+		ing.Spec.Rules = append(ing.Spec.Rules, rule)
+		ing.PathTypes = append(ing.PathTypes, pathTypes)
+	}
+
+	defaultBackend := ni.Spec.DefaultBackend
+	if defaultBackend == nil {
+		defaultBackend = ni.Spec.Backend
+	}
+	if defaultBackend != nil {
+		backend, err := defaultBackend.convert()
+		if err != nil {
+			unsupported(err)
+		}
+		ing.setDefaultBackend(backend)
+	}
+
+	return ing
+}
+
+// ingressLister lists Ingresses from the newest API group version served
+// by the cluster.
+type ingressLister struct {
+	kc  *kclient.Client
+	gvs *groupVersions
+}
+
+func newIngressLister(kc *kclient.Client) *ingressLister {
+	return &ingressLister{
+		kc:  kc,
+		gvs: &groupVersions{kind: "Ingresses", all: ingressGroupVersions},
+	}
+}
+
+func (l *ingressLister) List(namespace string, opts kapi.ListOptions) ([]ingress, error) {
+	var ingresses []ingress
+	err := l.gvs.do(func(gv string) (err error) {
+		ingresses, err = l.list(gv, namespace, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ingresses, nil
+}
+
+func (l *ingressLister) list(gv, namespace string, opts kapi.ListOptions) ([]ingress, error) {
+	if !isNetworkingGroupVersion(gv) {
+		list, err := l.kc.Ingress(namespace).List(opts)
+		if err != nil {
+			return nil, err
+		}
+		ingresses := make([]ingress, 0, len(list.Items))
+		for _, ing := range list.Items {
+			ingresses = append(ingresses, ingressFromExtensions(ing))
+		}
+		return ingresses, nil
+	}
+
+	var list networkingIngressList
+	if err := (rawAPI{l.kc}).list(gv, namespace, "ingresses", opts.LabelSelector, &list); err != nil {
+		return nil, err
+	}
+	ingresses := make([]ingress, 0, len(list.Items))
+	for _, ni := range list.Items {
+		ingresses = append(ingresses, ni.convert())
+	}
+	return ingresses, nil
+}
+
+// ingressClass decodes an IngressClass of networking.k8s.io/v1 or v1beta1.
+type ingressClass struct {
+	ObjectMeta kapi.ObjectMeta `json:"metadata"`
+	Spec       struct {
+		Controller string `json:"controller"`
+		Parameters *struct {
+			APIGroup  *string `json:"apiGroup"`
+			Kind      string  `json:"kind"`
+			Name      string  `json:"name"`
+			Namespace *string `json:"namespace"`
+		} `json:"parameters"`
+	} `json:"spec"`
+}
+
+// getIngressClass reads an IngressClass, returning nil if it doesn't exist
+// or the cluster doesn't serve IngressClasses.
+func getIngressClass(kc *kclient.Client, name string) (*ingressClass, error) {
+	for _, gv := range ingressGroupVersions {
+		if !isNetworkingGroupVersion(gv) {
+			continue
+		}
+		var class ingressClass
+		err := (rawAPI{kc}).get(gv, "", "ingressclasses", name, &class)
+		if kerrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &class, nil
+	}
+	return nil, nil
+}
+
+// configMapRef returns the namespace/name of the ConfigMap referred to by
+// the parameters of the class, if any.
+func (c *ingressClass) configMapRef() (string, bool) {
+	p := c.Spec.Parameters
+	if p == nil || p.Kind != "ConfigMap" || (p.APIGroup != nil && *p.APIGroup != "") || p.Namespace == nil {
+		return "", false
+	}
+	return *p.Namespace + "/" + p.Name, true
+}
+
+// ingressClassConfigMap returns the nginx ConfigMap named by the parameters
+// of an IngressClass, or an empty string if there is none.
+func ingressClassConfigMap(kc *kclient.Client, name string) string {
+	class, err := getIngressClass(kc, name)
+	if err != nil {
+		kubernetesLog.Warningf("Failed reading IngressClass %s: %v", name, err)
+		return ""
+	} else if class == nil {
+		return ""
+	}
+
+	ref, ok := class.configMapRef()
+	if !ok {
+		if class.Spec.Parameters != nil {
+			kubernetesLog.Warningf("Ignoring parameters of IngressClass %s, which aren't a namespaced ConfigMap", name)
+		}
+		return ""
+	}
+	kubernetesLog.Infof("Using nginx ConfigMap %s from IngressClass %s", ref, name)
+	return ref
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+	kapi "k8s.io/kubernetes/pkg/api"
+	krestclient "k8s.io/kubernetes/pkg/client/restclient"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+)
+
+const testNetworkingManifest = `
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: v1
+  namespace: bar
+spec:
+  ingressClassName: internal
+  defaultBackend:
+    service:
+      name: web
+      port:
+        number: 80
+  rules:
+  - host: www.example.com
+  - http:
+      paths:
+      - path: /api
+        pathType: Prefix
+        backend:
+          service:
+            name: web
+            port:
+              name: http
+      - path: /
+        pathType: Prefix
+        backend:
+          service:
+            name: web
+            port:
+              number: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: networking.k8s.io/v1beta1
+  kind: Ingress
+  metadata:
+    name: v1beta1
+    namespace: bar
+  spec:
+    backend:
+      serviceName: web
+      servicePort: 80
+- apiVersion: networking.k8s.io/v1
+  kind: Ingress
+  metadata:
+    name: resource
+    namespace: bar
+  spec:
+    defaultBackend:
+      resource:
+        apiGroup: k8s.example.com
+        kind: StorageBucket
+        name: assets
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{name: http, port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{name: http, port: 8080}]
+`
+
+func TestNetworkingIngress(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testNetworkingManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if objs.ingresses[0].ClassName != "internal" {
+		t.Errorf("expected class name internal, got %q", objs.ingresses[0].ClassName)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+	rc, err := rg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The rule for www.example.com has no paths, so gets no server. The
+	// named port of /api is resolved to its number.
+	got := map[string][]string{}
+	for _, srv := range rc.HTTPServers {
+		for _, loc := range srv.Locations {
+			got[srv.Name] = append(got[srv.Name], strings.TrimSpace(loc.Match+" "+loc.Path+" "+loc.Upstream))
+		}
+	}
+	want := map[string][]string{
+		// The default backend gives way to the explicit path /.
+		"v1.bar.example.com": {
+			"= /api bar__v1__web__http",
+			"/api/ bar__v1__web__http",
+			"/ bar__v1__web__80",
+		},
+		"v1beta1.bar.example.com": {"/ bar__v1beta1__web__80"},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	for _, st := range rg.IngressStatuses() {
+		if st.Name == "resource" && (!st.Disabled || !strings.Contains(st.Error, "not supported")) {
+			t.Errorf("expected Ingress with resource backend to be disabled: %+v", st)
+		}
+		if st.Name != "resource" && (st.Disabled || st.Error != "") {
+			t.Errorf("expected Ingress %s to be served: %+v", st.Name, st)
+		}
+	}
+}
+
+func TestIngressListerFallback(t *testing.T) {
+	requests := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		switch r.URL.Path {
+		case "/apis/networking.k8s.io/v1beta1/namespaces/bar/ingresses":
+			fmt.Fprint(w, `{"items": [{"metadata": {"name": "foo", "namespace": "bar"}, "spec": {"ingressClassName": "internal", "rules": [{"http": {"paths": [{"path": "/", "pathType": "Prefix", "backend": {"serviceName": "web", "servicePort": "http"}}]}}]}}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	kc, err := kclient.New(&krestclient.Config{Host: srv.URL})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	l := newIngressLister(kc)
+
+	for i := 0; i < 2; i++ {
+		ingresses, err := l.List("bar", kapi.ListOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(ingresses) != 1 || ingresses[0].ClassName != "internal" || ingresses[0].pathType(0, 0) != PathTypePrefix {
+			t.Errorf("unexpected Ingresses: %+v", ingresses)
+		}
+		if port := ingresses[0].Spec.Rules[0].HTTP.Paths[0].Backend.ServicePort.String(); port != "http" {
+			t.Errorf("expected named service port, got %q", port)
+		}
+	}
+
+	// v1 is tried once, then the group version that worked is used.
+	want := []string{
+		"/apis/networking.k8s.io/v1/namespaces/bar/ingresses",
+		"/apis/networking.k8s.io/v1beta1/namespaces/bar/ingresses",
+		"/apis/networking.k8s.io/v1beta1/namespaces/bar/ingresses",
+	}
+	if diff := pretty.Compare(want, requests); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
+
+func TestIngressClassConfigMapRef(t *testing.T) {
+	tests := []struct {
+		params string
+		want   string
+	}{
+		{params: `{"kind": "ConfigMap", "name": "nginx", "namespace": "ops"}`, want: "ops/nginx"},
+		{params: `{"apiGroup": "", "kind": "ConfigMap", "name": "nginx", "namespace": "ops"}`, want: "ops/nginx"},
+		{params: `{"kind": "ConfigMap", "name": "nginx"}`, want: ""},
+		{params: `{"apiGroup": "k8s.example.com", "kind": "ConfigMap", "name": "nginx", "namespace": "ops"}`, want: ""},
+		{params: `null`, want: ""},
+	}
+
+	for i, tt := range tests {
+		var class ingressClass
+		if err := json.Unmarshal([]byte(`{"spec": {"parameters": `+tt.params+`}}`), &class); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+		got, _ := class.configMapRef()
+		if tt.want != got {
+			t.Errorf("case %d: want %q, got %q", i, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
+	kextensions "k8s.io/kubernetes/pkg/apis/extensions"
+)
+
+// domainOwners maps domain suffixes to the namespaces allowed to claim
+// hostnames within them. Hostnames outside of every suffix may be claimed
+// by any namespace.
+type domainOwners map[string]map[string]bool
+
+// parseDomainOwners reads suffix=namespace pairs. A suffix may be given
+// several times to allow several namespaces.
+func parseDomainOwners(kv flagutil.KVSliceFlag) (domainOwners, error) {
+	if len(kv) == 0 {
+		return nil, nil
+	}
+
+	owners := domainOwners{}
+	for _, pair := range kv {
+		suffix := strings.TrimPrefix(strings.ToLower(pair[0]), ".")
+		if suffix == "" || pair[1] == "" {
+			return nil, fmt.Errorf("invalid domain owner %s=%s", pair[0], pair[1])
+		}
+		if owners[suffix] == nil {
+			owners[suffix] = map[string]bool{}
+		}
+		owners[suffix][pair[1]] = true
+	}
+	return owners, nil
+}
+
+// owner returns the longest suffix containing hostname, or false if there
+// is none.
+func (d domainOwners) owner(hostname string) (string, bool) {
+	hostname = strings.ToLower(hostname)
+	best := ""
+	for suffix := range d {
+		if hostname == suffix || strings.HasSuffix(hostname, "."+suffix) {
+			if len(suffix) > len(best) {
+				best = suffix
+			}
+		}
+	}
+	return best, best != ""
+}
+
+// check returns an error if namespace may not claim hostname. A wildcard
+// hostname also needs every domain it covers, and since the hosts matched
+// by a regex hostname can't be known, those are never allowed.
+func (d domainOwners) check(hostname, namespace string) error {
+	if len(d) == 0 {
+		return nil
+	}
+	if isRegexHostname(hostname) {
+		return fmt.Errorf("regex hostname %s can't be checked against domain owners", hostname)
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(hostname, "*."))
+	if suffix, ok := d.owner(name); ok && !d[suffix][namespace] {
+		return fmt.Errorf("hostname %s is in domain %s, which namespace %s may not use", hostname, suffix, namespace)
+	}
+	if isWildcardHostname(hostname) {
+		suffixes := []string{}
+		for suffix := range d {
+			suffixes = append(suffixes, suffix)
+		}
+		sort.Strings(suffixes)
+		for _, suffix := range suffixes {
+			if strings.HasSuffix(suffix, "."+name) && !d[suffix][namespace] {
+				return fmt.Errorf("hostname %s covers domain %s, which namespace %s may not use", hostname, suffix, namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// sortIngressesByAge orders Ingresses from oldest to newest, falling back to
+// namespace and name, which is the order in which they claim hostnames.
+func sortIngressesByAge(ingresses []ingress) {
+	sort.Sort(ingressesByAge(ingresses))
+}
+
+type ingressesByAge []ingress
+
+func (s ingressesByAge) Len() int      { return len(s) }
+func (s ingressesByAge) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ingressesByAge) Less(i, j int) bool {
+	ti, tj := s[i].ObjectMeta.CreationTimestamp, s[j].ObjectMeta.CreationTimestamp
+	if !ti.Equal(tj) {
+		return ti.Before(tj)
+	}
+	if s[i].ObjectMeta.Namespace != s[j].ObjectMeta.Namespace {
+		return s[i].ObjectMeta.Namespace < s[j].ObjectMeta.Namespace
+	}
+	return s[i].ObjectMeta.Name < s[j].ObjectMeta.Name
+}
+
+func ingressKey(ing *kextensions.Ingress) string {
+	return fmt.Sprintf("ingress %s/%s", ing.ObjectMeta.Namespace, ing.ObjectMeta.Name)
+}
+
+func newIngressServers(krc *kubernetesReverseProxyConfigGetterConfig) *ingressServers {
+	return &ingressServers{krc: krc, hosts: map[string]*ingressHost{}}
+}
+
+// ingressServers merges the servers of every Ingress into one server per
+// hostname and port. Ingresses are added oldest first, and the first to add
+// a hostname owns its server settings, so a newer Ingress only adds its
+// paths to a hostname served by another if their server settings match.
+// Each path of a hostname is claimed by the first Ingress to add it, and a
+// path implied by a Prefix path or default backend gives way to any other.
+type ingressServers struct {
+	krc   *kubernetesReverseProxyConfigGetterConfig
+	hosts map[string]*ingressHost
+	order []string
+}
+
+type ingressHost struct {
+	owner string
+	srv   httpReverseProxyServer
+	// paths and implied map the key of each location to the Ingress that
+	// claimed it explicitly or implicitly.
+	paths   map[string]string
+	implied map[string]string
+}
+
+// add merges the servers of an Ingress, leaving out every hostname its
+// namespace isn't allowed to claim and every path claimed by an earlier
+// Ingress. Canonical hostnames are exempt from the domain owners policy. It
+// returns the hostnames the Ingress serves, the conflicts with earlier
+// Ingresses and a description of every hostname or path left out.
+func (m *ingressServers) add(ing *kextensions.Ingress, canonical []string, rc *reverseProxyConfig) ([]string, []HostnameConflict, []string) {
+	key := ingressKey(ing)
+	isCanonical := map[string]bool{}
+	for _, h := range canonical {
+		isCanonical[h] = true
+	}
+	log := kubernetesLog.WithFields(logrus.Fields{
+		"ingress":   ing.ObjectMeta.Name,
+		"namespace": ing.ObjectMeta.Namespace,
+	})
+
+	kept := []string{}
+	conflicts := []HostnameConflict{}
+	problems := []string{}
+	for _, srv := range rc.HTTPServers {
+		for _, h := range append([]string{srv.Name}, srv.AltNames...) {
+			if err := m.krc.DomainOwners.check(h, ing.ObjectMeta.Namespace); err != nil && !isCanonical[h] {
+				log.WithField("hostname", h).Errorf("Dropping hostname: %v", err)
+				problems = append(problems, err.Error())
+				continue
+			}
+
+			claim := fmt.Sprintf("%s:%d", strings.ToLower(h), srv.ListenPort)
+			host, ok := m.hosts[claim]
+			if !ok {
+				host = &ingressHost{
+					owner:   key,
+					srv:     srv,
+					paths:   map[string]string{},
+					implied: map[string]string{},
+				}
+				host.srv.Name, host.srv.AltNames = h, nil
+				host.srv.Locations = []httpReverseProxyLocation{}
+				m.hosts[claim] = host
+				m.order = append(m.order, claim)
+			} else if host.owner != key && !sameServerSettings(host.srv, srv) {
+				log.WithFields(logrus.Fields{
+					"hostname": h,
+					"owner":    host.owner,
+				}).Error("Dropping hostname claimed by an older Ingress with different server settings")
+				conflicts = append(conflicts, HostnameConflict{
+					Hostname:   h,
+					ListenPort: srv.ListenPort,
+					Kept:       host.owner,
+					Dropped:    key,
+				})
+				problems = append(problems, fmt.Sprintf("hostname %s is claimed by %s with different server settings", h, host.owner))
+				continue
+			}
+
+			added := 0
+			droppedBy := ""
+			pathConflicts := []HostnameConflict{}
+			for _, loc := range srv.Locations {
+				locKey := loc.Match + " " + loc.Path
+				owner, ok := host.paths[locKey]
+				if !ok && loc.implied {
+					owner, ok = host.implied[locKey]
+				}
+				if ok {
+					if owner != key {
+						if droppedBy == "" {
+							droppedBy = owner
+						}
+						if !loc.implied {
+							pathConflicts = append(pathConflicts, HostnameConflict{
+								Hostname:   h,
+								ListenPort: srv.ListenPort,
+								Path:       loc.Path,
+								Kept:       owner,
+								Dropped:    key,
+							})
+						}
+					}
+					continue
+				}
+
+				if loc.implied {
+					host.implied[locKey] = key
+				} else {
+					host.paths[locKey] = key
+				}
+				if host.owner != key {
+					loc.IngressName = ing.ObjectMeta.Name
+					loc.IngressNamespace = ing.ObjectMeta.Namespace
+				}
+				host.srv.Locations = append(host.srv.Locations, loc)
+				added++
+			}
+
+			// An Ingress left without any path of a hostname loses the
+			// whole hostname rather than each of its paths.
+			if added == 0 && droppedBy != "" {
+				pathConflicts = []HostnameConflict{{
+					Hostname:   h,
+					ListenPort: srv.ListenPort,
+					Kept:       droppedBy,
+					Dropped:    key,
+				}}
+			}
+			for _, c := range pathConflicts {
+				log.WithFields(logrus.Fields{
+					"hostname": c.Hostname,
+					"path":     c.Path,
+					"owner":    c.Kept,
+				}).Error("Dropping path claimed by an older Ingress")
+				if c.Path == "" {
+					problems = append(problems, fmt.Sprintf("hostname %s is claimed by %s", c.Hostname, c.Kept))
+				} else {
+					problems = append(problems, fmt.Sprintf("path %s of hostname %s is claimed by %s", c.Path, c.Hostname, c.Kept))
+				}
+			}
+			conflicts = append(conflicts, pathConflicts...)
+
+			if added > 0 || host.owner == key {
+				kept = append(kept, h)
+			}
+		}
+	}
+
+	return kept, conflicts, problems
+}
+
+// servers returns the merged servers, ordered by when their first hostname
+// was added. Hostnames served identically share a server.
+func (m *ingressServers) servers() ([]httpReverseProxyServer, error) {
+	servers := []httpReverseProxyServer{}
+	shared := map[string]int{}
+	for _, claim := range m.order {
+		srv := m.hosts[claim].srv
+
+		var err error
+		if srv.Locations, err = orderLocations(srv.Locations); err != nil {
+			return nil, fmt.Errorf("hostname %s: %v", srv.Name, err)
+		}
+
+		name := srv.Name
+		srv.Name = ""
+		fingerprint := fmt.Sprintf("%#v", srv)
+		if i, ok := shared[fingerprint]; ok {
+			servers[i].AltNames = append(servers[i].AltNames, name)
+			continue
+		}
+		srv.Name = name
+		srv.AltNames = []string{}
+		shared[fingerprint] = len(servers)
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// sameServerSettings reports whether a and b differ only in their hostnames,
+// locations and Ingress.
+func sameServerSettings(a, b httpReverseProxyServer) bool {
+	for _, srv := range []*httpReverseProxyServer{&a, &b} {
+		srv.Name, srv.AltNames, srv.Locations = "", nil, nil
+		srv.IngressName, srv.IngressNamespace = "", ""
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,536 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bcwaldon/klondike/src/farva/pkg/flagutil"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestDomainOwners(t *testing.T) {
+	var kv flagutil.KVSliceFlag
+	if err := kv.Set("example.com=web,example.com=ops,.api.example.com=api"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	owners, err := parseDomainOwners(kv)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		hostname  string
+		namespace string
+		want      bool
+	}{
+		{"example.com", "web", true},
+		{"www.example.com", "ops", true},
+		{"www.example.com", "api", false},
+		{"v1.api.example.com", "api", true},
+		{"API.example.com", "api", true},
+		{"v1.api.example.com", "web", false},
+		{"notexample.com", "api", true},
+		{"example.org", "api", true},
+		{"*.example.com", "web", false},
+		{"*.example.com", "api", false},
+		{"*.v1.api.example.com", "api", true},
+		{"*.www.example.com", "web", true},
+		{"~^.*$", "web", false},
+	}
+
+	for i, tt := range tests {
+		if got := owners.check(tt.hostname, tt.namespace) == nil; tt.want != got {
+			t.Errorf("case %d: want %t, got %t", i, tt.want, got)
+		}
+	}
+
+	if _, err := parseDomainOwners(flagutil.KVSliceFlag{{"example.com", ""}}); err == nil {
+		t.Errorf("expected error for empty namespace")
+	}
+}
+
+const testOwnershipManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: new
+  namespace: bar
+  creationTimestamp: 2016-06-02T00:00:00Z
+  annotations:
+    klondike.gateway/hostname-aliases: shared.example.com, www.example.org
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: old
+  namespace: bar
+  creationTimestamp: 2016-06-01T00:00:00Z
+  annotations:
+    klondike.gateway/hostname-aliases: shared.example.com
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: hijack
+  namespace: bar
+  creationTimestamp: 2016-06-03T00:00:00Z
+spec:
+  rules:
+  - host: www.example.org
+    http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{port: 8080}]
+`
+
+func TestKubernetesHostnameOwnership(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testOwnershipManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.CanonicalHostnamePolicy = CanonicalHostnamePolicyUnlessHost
+	krc.DomainOwners = domainOwners{"example.org": {"bar": true}, "www.example.org": {"web": true}}
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+
+	rc, err := rg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := [][]string{}
+	for _, srv := range rc.HTTPServers {
+		got = append(got, append([]string{srv.Name}, srv.AltNames...))
+	}
+	want := [][]string{
+		{"old.bar.example.com", "shared.example.com"},
+		{"new.bar.example.com"},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	wantConflicts := []HostnameConflict{
+		{Hostname: "shared.example.com", Kept: "ingress bar/old", Dropped: "ingress bar/new"},
+	}
+	if diff := pretty.Compare(wantConflicts, rg.Conflicts()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	wantStatuses := []IngressStatus{
+		{Namespace: "bar", Name: "old", Hostnames: []string{"old.bar.example.com", "shared.example.com"}},
+		{
+			Namespace: "bar",
+			Name:      "new",
+			Hostnames: []string{"new.bar.example.com"},
+			Error:     "hostname shared.example.com is claimed by ingress bar/old; hostname www.example.org is in domain www.example.org, which namespace bar may not use",
+		},
+		{
+			Namespace: "bar",
+			Name:      "hijack",
+			Disabled:  true,
+			Error:     "hostname www.example.org is in domain www.example.org, which namespace bar may not use",
+		},
+	}
+	if diff := pretty.Compare(wantStatuses, rg.IngressStatuses()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
+
+const testSharedHostManifest = `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: shop
+  spec:
+    ports:
+    - port: 80
+      targetPort: 8080
+- apiVersion: v1
+  kind: Endpoints
+  metadata:
+    name: web
+    namespace: shop
+  subsets:
+  - addresses:
+    - ip: 10.0.0.1
+    ports:
+    - port: 8080
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: api
+    namespace: api
+  spec:
+    ports:
+    - port: 80
+      targetPort: 8080
+- apiVersion: v1
+  kind: Endpoints
+  metadata:
+    name: api
+    namespace: api
+  subsets:
+  - addresses:
+    - ip: 10.0.0.2
+    ports:
+    - port: 8080
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: shop
+  namespace: shop
+  creationTimestamp: 2016-06-01T00:00:00Z
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+  - host: shop.example.com
+    http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: api
+  namespace: api
+  creationTimestamp: 2016-06-02T00:00:00Z
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /api
+        backend:
+          serviceName: api
+          servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: v2
+  namespace: api
+  creationTimestamp: 2016-06-03T00:00:00Z
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /api
+        backend:
+          serviceName: api
+          servicePort: 80
+      - path: /v2
+        backend:
+          serviceName: api
+          servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: framed
+  namespace: api
+  creationTimestamp: 2016-06-04T00:00:00Z
+  annotations:
+    klondike.gateway/add-headers: X-Frame-Options=DENY
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /framed
+        backend:
+          serviceName: api
+          servicePort: 80
+`
+
+func TestKubernetesSharedHostname(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testSharedHostManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.CanonicalHostnamePolicy = CanonicalHostnamePolicyUnlessHost
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+
+	rc, err := rg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type location struct {
+		Path      string
+		Upstream  string
+		Ingress   string
+		Namespace string
+	}
+	type server struct {
+		Names     []string
+		Ingress   string
+		Locations []location
+	}
+	got := []server{}
+	for _, srv := range rc.HTTPServers {
+		s := server{
+			Names:   append([]string{srv.Name}, srv.AltNames...),
+			Ingress: srv.IngressNamespace + "/" + srv.IngressName,
+		}
+		for _, loc := range srv.Locations {
+			s.Locations = append(s.Locations, location{loc.Path, loc.Upstream, loc.IngressName, loc.IngressNamespace})
+		}
+		got = append(got, s)
+	}
+	want := []server{
+		{
+			Names:   []string{"www.example.com"},
+			Ingress: "shop/shop",
+			Locations: []location{
+				{Path: "/", Upstream: "shop__shop__web__80"},
+				{Path: "/api", Upstream: "api__api__api__80", Ingress: "api", Namespace: "api"},
+				{Path: "/v2", Upstream: "api__v2__api__80", Ingress: "v2", Namespace: "api"},
+			},
+		},
+		{
+			Names:   []string{"shop.example.com"},
+			Ingress: "shop/shop",
+			Locations: []location{
+				{Path: "/", Upstream: "shop__shop__web__80"},
+			},
+		},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	wantConflicts := []HostnameConflict{
+		{Hostname: "www.example.com", Path: "/api", Kept: "ingress api/api", Dropped: "ingress api/v2"},
+		{Hostname: "www.example.com", Kept: "ingress shop/shop", Dropped: "ingress api/framed"},
+	}
+	if diff := pretty.Compare(wantConflicts, rg.Conflicts()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	wantStatuses := []IngressStatus{
+		{Namespace: "shop", Name: "shop", Hostnames: []string{"www.example.com", "shop.example.com"}},
+		{Namespace: "api", Name: "api", Hostnames: []string{"www.example.com"}},
+		{
+			Namespace: "api",
+			Name:      "v2",
+			Hostnames: []string{"www.example.com"},
+			Error:     "path /api of hostname www.example.com is claimed by ingress api/api",
+		},
+		{
+			Namespace: "api",
+			Name:      "framed",
+			Disabled:  true,
+			Error:     "hostname www.example.com is claimed by ingress shop/shop with different server settings",
+		},
+	}
+	if diff := pretty.Compare(wantStatuses, rg.IngressStatuses()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	// Locations added by another Ingress carry its identity.
+	wantConfig := `
+pid /var/run/nginx.pid;
+error_log /dev/stderr;
+daemon on;
+worker_processes auto;
+
+events {
+    worker_connections 512;
+}
+
+http {
+    server_names_hash_bucket_size 128;
+    log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+                      '$status $body_bytes_sent "$http_referer" '
+                      '"$http_user_agent" "$http_x_forwarded_for"';
+    access_log /dev/stdout main;
+
+    proxy_http_version 1.1;
+    proxy_set_header Connection "";
+
+    # Override the Host header with the value of the
+    # X-Forwarded-Host header only if it is provided.
+    # This allows the upstream service with the most
+    # accurate value for the Host header without having
+    # to be aware they are behind a proxy.
+    map $http_x_forwarded_host $host_value {
+        default $http_host;
+        ~.+ $http_x_forwarded_host;
+    }
+    proxy_set_header Host $host_value;
+
+
+    server {
+        listen 0;
+        server_name www.example.com;
+        set $farva_ingress_name "shop";
+        set $farva_ingress_namespace "shop";
+        
+        location / {
+            
+            set $farva_upstream "shop__shop__web__80";
+            proxy_pass http://shop__shop__web__80;
+        }
+
+        location /api {
+            set $farva_ingress_name "api";
+            set $farva_ingress_namespace "api";
+            
+            set $farva_upstream "api__api__api__80";
+            proxy_pass http://api__api__api__80;
+        }
+
+        location /v2 {
+            set $farva_ingress_name "v2";
+            set $farva_ingress_namespace "api";
+            
+            set $farva_upstream "api__v2__api__80";
+            proxy_pass http://api__v2__api__80;
+        }
+
+    }
+
+    server {
+        listen 0;
+        server_name shop.example.com;
+        set $farva_ingress_name "shop";
+        set $farva_ingress_namespace "shop";
+        
+        location / {
+            
+            set $farva_upstream "shop__shop__web__80";
+            proxy_pass http://shop__shop__web__80;
+        }
+
+    }
+
+
+
+    server {
+        listen 7332;
+        server_name localhost;
+
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
+        access_log off;
+        allow 127.0.0.1;
+        deny all;
+
+        location /nginx_status {
+          stub_status on;
+        }
+    }
+
+
+
+
+
+    upstream shop__shop__web__80 {
+
+        server 10.0.0.1:8080;  # 10.0.0.1
+        keepalive 64;
+    }
+
+
+    upstream api__api__api__80 {
+
+        server 10.0.0.2:8080;  # 10.0.0.2
+        keepalive 64;
+    }
+
+
+    upstream api__v2__api__80 {
+
+        server 10.0.0.2:8080;  # 10.0.0.2
+        keepalive 64;
+    }
+
+
+    upstream api__framed__api__80 {
+
+        server 10.0.0.2:8080;  # 10.0.0.2
+        keepalive 64;
+    }
+
+}
+
+stream {
+
+
+}
+`
+	rendered, err := renderConfig(&DefaultNGINXConfig, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if wantConfig != string(rendered) {
+		wantPretty := strings.Replace(wantConfig, " ", "÷", -1)
+		gotPretty := strings.Replace(string(rendered), " ", "÷", -1)
+		t.Errorf("unexpected output: want=%sgot=%s", wantPretty, gotPretty)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Path types, as in the pathType field of Kubernetes Ingress paths. Paths
+// without a type keep nginx's plain prefix match, so /foo also matches
+// /foobar.
+const (
+	// PathTypeExact matches the path exactly.
+	PathTypeExact = "Exact"
+	// PathTypePrefix matches the path and everything below it, split on
+	// /, so /foo matches /foo and /foo/bar but not /foobar.
+	PathTypePrefix = "Prefix"
+	// PathTypeImplementationSpecific treats the path as a case-sensitive
+	// regular expression.
+	PathTypeImplementationSpecific = "ImplementationSpecific"
+)
+
+// Annotations giving the type of all paths of an Ingress, or of particular
+// paths as path=type pairs separated by commas.
+const (
+	PathTypeKey  = "path-type"
+	PathTypesKey = "path-types"
+)
+
+// nginx location modifiers.
+const (
+	locationMatchPrefix = ""
+	locationMatchExact  = "="
+	locationMatchRegex  = "~"
+)
+
+var (
+	// Paths are written to location unquoted, so can't contain anything
+	// that would end the directive.
+	typedPathRE = regexp.MustCompile(`^/[^\s;{}'"]*$`)
+	regexPathRE = regexp.MustCompile(`^[^\s;{}'"]+$`)
+)
+
+func validPathType(pathType string) bool {
+	switch pathType {
+	case "", PathTypeExact, PathTypePrefix, PathTypeImplementationSpecific:
+		return true
+	}
+	return false
+}
+
+// pathLocations returns the locations matching path as described by
+// pathType. Only Path and Match are set.
+func pathLocations(path, pathType string) ([]httpReverseProxyLocation, error) {
+	if !validPathType(pathType) {
+		return nil, fmt.Errorf("invalid path type %q", pathType)
+	}
+
+	switch pathType {
+	case "":
+		return []httpReverseProxyLocation{{Path: path}}, nil
+	case PathTypeImplementationSpecific:
+		if !regexPathRE.MatchString(path) {
+			return nil, fmt.Errorf("invalid regex path %q", path)
+		}
+		if _, err := regexp.Compile(path); err != nil {
+			return nil, fmt.Errorf("invalid regex path %q: %v", path, err)
+		}
+		return []httpReverseProxyLocation{{Path: path, Match: locationMatchRegex}}, nil
+	}
+
+	if path == "" {
+		path = "/"
+	}
+	if !typedPathRE.MatchString(path) {
+		return nil, fmt.Errorf("invalid path %q", path)
+	}
+
+	if pathType == PathTypeExact {
+		return []httpReverseProxyLocation{{Path: path, Match: locationMatchExact}}, nil
+	}
+
+	// A trailing / makes no difference to a Prefix path.
+	path = strings.TrimRight(path, "/")
+	if path == "" {
+		return []httpReverseProxyLocation{{Path: "/"}}, nil
+	}
+	return []httpReverseProxyLocation{
+		{Path: path, Match: locationMatchExact, implied: true},
+		{Path: path + "/"},
+	}, nil
+}
+
+// orderLocations sorts exact locations before prefix ones and regex ones
+// last, keeping the order of each kind. nginx uses an exact match first,
+// then the first matching regex, then the longest matching prefix. A
+// location implied by a Prefix path gives way to one given explicitly, but
+// any other duplicate is an error.
+func orderLocations(locs []httpReverseProxyLocation) ([]httpReverseProxyLocation, error) {
+	explicit := map[string]bool{}
+	for _, loc := range locs {
+		if loc.implied {
+			continue
+		}
+		key := loc.Match + " " + loc.Path
+		if explicit[key] {
+			return nil, fmt.Errorf("path %q is given more than once", loc.Path)
+		}
+		explicit[key] = true
+	}
+
+	ordered := []httpReverseProxyLocation{}
+	seen := map[string]bool{}
+	for _, loc := range locs {
+		key := loc.Match + " " + loc.Path
+		if loc.implied && (explicit[key] || seen[key]) {
+			continue
+		}
+		seen[key] = true
+		ordered = append(ordered, loc)
+	}
+	sort.Stable(locationsByMatch(ordered))
+	return ordered, nil
+}
+
+type locationsByMatch []httpReverseProxyLocation
+
+func (s locationsByMatch) Len() int           { return len(s) }
+func (s locationsByMatch) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s locationsByMatch) Less(i, j int) bool { return matchRank(s[i].Match) < matchRank(s[j].Match) }
+
+func matchRank(match string) int {
+	switch match {
+	case locationMatchExact:
+		return 0
+	case locationMatchRegex:
+		return 2
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,441 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestPathLocations(t *testing.T) {
+	tests := []struct {
+		path     string
+		pathType string
+		want     []httpReverseProxyLocation
+	}{
+		{
+			path: "/foo",
+			want: []httpReverseProxyLocation{{Path: "/foo"}},
+		},
+		{
+			path:     "/foo",
+			pathType: PathTypeExact,
+			want:     []httpReverseProxyLocation{{Path: "/foo", Match: "="}},
+		},
+		{
+			path:     "",
+			pathType: PathTypePrefix,
+			want:     []httpReverseProxyLocation{{Path: "/"}},
+		},
+		{
+			path:     "/foo/",
+			pathType: PathTypePrefix,
+			want: []httpReverseProxyLocation{
+				{Path: "/foo", Match: "=", implied: true},
+				{Path: "/foo/"},
+			},
+		},
+		{
+			path:     `^/v[0-9]+/`,
+			pathType: PathTypeImplementationSpecific,
+			want:     []httpReverseProxyLocation{{Path: `^/v[0-9]+/`, Match: "~"}},
+		},
+	}
+
+	for i, tt := range tests {
+		got, err := pathLocations(tt.path, tt.pathType)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestPathLocationsError(t *testing.T) {
+	tests := []struct {
+		path     string
+		pathType string
+	}{
+		{path: "foo", pathType: PathTypePrefix},
+		{path: "/foo bar", pathType: PathTypeExact},
+		{path: "/foo;", pathType: PathTypePrefix},
+		{path: "^/a{2}", pathType: PathTypeImplementationSpecific},
+		{path: "^/(a", pathType: PathTypeImplementationSpecific},
+		{path: "/foo", pathType: "Regex"},
+	}
+
+	for i, tt := range tests {
+		if _, err := pathLocations(tt.path, tt.pathType); err == nil {
+			t.Errorf("case %d: expected error", i)
+		}
+	}
+}
+
+func TestOrderLocations(t *testing.T) {
+	locs := []httpReverseProxyLocation{
+		{Path: "/"},
+		{Path: `^/v[0-9]+/`, Match: "~"},
+		{Path: "/api", Match: "=", implied: true, Upstream: "prefix"},
+		{Path: "/api/"},
+		{Path: "/api", Match: "=", Upstream: "exact"},
+		{Path: `\.php$`, Match: "~"},
+	}
+	want := []httpReverseProxyLocation{
+		{Path: "/api", Match: "=", Upstream: "exact"},
+		{Path: "/"},
+		{Path: "/api/"},
+		{Path: `^/v[0-9]+/`, Match: "~"},
+		{Path: `\.php$`, Match: "~"},
+	}
+
+	got, err := orderLocations(locs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	if _, err := orderLocations(append(locs, httpReverseProxyLocation{Path: "/api/"})); err == nil {
+		t.Errorf("expected error for duplicate path")
+	}
+}
+
+const testPathTypesManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: paths
+  namespace: bar
+  annotations:
+    klondike.gateway/path-type: Prefix
+    klondike.gateway/path-types: /healthz=Exact, ^/v[0-9]+/=ImplementationSpecific
+spec:
+  rules:
+  - http:
+      paths:
+      - path: ^/v[0-9]+/
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+  - http:
+      paths:
+      - path: /app/
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: /healthz
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{port: 8080}]
+`
+
+func TestKubernetesPathTypes(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testPathTypesManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.ListenPort = 7331
+	rc, err := newReverseProxyConfigGetterFromObjects(objs, &krc).ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Both rules have the canonical hostname only, so share a server.
+	want := `
+pid /var/run/nginx.pid;
+error_log /dev/stderr;
+daemon on;
+worker_processes auto;
+
+events {
+    worker_connections 512;
+}
+
+http {
+    server_names_hash_bucket_size 128;
+    log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+                      '$status $body_bytes_sent "$http_referer" '
+                      '"$http_user_agent" "$http_x_forwarded_for"';
+    access_log /dev/stdout main;
+
+    proxy_http_version 1.1;
+    proxy_set_header Connection "";
+
+    # Override the Host header with the value of the
+    # X-Forwarded-Host header only if it is provided.
+    # This allows the upstream service with the most
+    # accurate value for the Host header without having
+    # to be aware they are behind a proxy.
+    map $http_x_forwarded_host $host_value {
+        default $http_host;
+        ~.+ $http_x_forwarded_host;
+    }
+    proxy_set_header Host $host_value;
+
+
+    server {
+        listen 7331;
+        server_name paths.bar.example.com;
+        set $farva_ingress_name "paths";
+        set $farva_ingress_namespace "bar";
+        
+        location = /app {
+            
+            set $farva_upstream "bar__paths__web__80";
+            proxy_pass http://bar__paths__web__80;
+        }
+
+        location = /healthz {
+            
+            set $farva_upstream "bar__paths__web__80";
+            proxy_pass http://bar__paths__web__80;
+        }
+
+        location / {
+            
+            set $farva_upstream "bar__paths__web__80";
+            proxy_pass http://bar__paths__web__80;
+        }
+
+        location /app/ {
+            
+            set $farva_upstream "bar__paths__web__80";
+            proxy_pass http://bar__paths__web__80;
+        }
+
+        location ~ ^/v[0-9]+/ {
+            
+            set $farva_upstream "bar__paths__web__80";
+            proxy_pass http://bar__paths__web__80;
+        }
+
+    }
+
+
+
+    server {
+        listen 7332;
+        server_name localhost;
+
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
+        access_log off;
+        allow 127.0.0.1;
+        deny all;
+
+        location /nginx_status {
+          stub_status on;
+        }
+    }
+
+
+
+    upstream bar__paths__web__80 {
+
+        server 10.0.0.1:8080;  # 10.0.0.1
+        keepalive 64;
+    }
+
+}
+
+stream {
+
+
+}
+`
+	got, err := renderConfig(&DefaultNGINXConfig, rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want != string(got) {
+		wantPretty := strings.Replace(want, " ", "÷", -1)
+		gotPretty := strings.Replace(string(got), " ", "÷", -1)
+		t.Errorf("unexpected output: want=%sgot=%s", wantPretty, gotPretty)
+	}
+}
+
+const testSharedPathsManifest = `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: web
+    namespace: bar
+  spec:
+    ports:
+    - port: 80
+      targetPort: 8080
+- apiVersion: v1
+  kind: Endpoints
+  metadata:
+    name: web
+    namespace: bar
+  subsets:
+  - addresses:
+    - ip: 10.0.0.1
+    ports:
+    - port: 8080
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: site
+  namespace: bar
+  creationTimestamp: SITE_CREATED
+  annotations:
+    klondike.gateway/path-types: /=Prefix, ^/v[0-9]+/=ImplementationSpecific
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: ^/v[0-9]+/
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: app
+  namespace: bar
+  creationTimestamp: APP_CREATED
+  annotations:
+    klondike.gateway/path-types: /app=Prefix, /healthz=Exact, \.php$=ImplementationSpecific
+spec:
+  rules:
+  - host: www.example.com
+    http:
+      paths:
+      - path: /app
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: /healthz
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: \.php$
+        backend:
+          serviceName: web
+          servicePort: 80
+`
+
+func TestKubernetesPathPrecedenceAcrossIngresses(t *testing.T) {
+	tests := []struct {
+		siteCreated string
+		appCreated  string
+		want        []string
+	}{
+		// regex paths of the older Ingress come first
+		{
+			siteCreated: "2016-06-01T00:00:00Z",
+			appCreated:  "2016-06-02T00:00:00Z",
+			want: []string{
+				"location = /app {",
+				"location = /healthz {",
+				"location / {",
+				"location /app/ {",
+				"location ~ ^/v[0-9]+/ {",
+				"location ~ \\.php$ {",
+			},
+		},
+		{
+			siteCreated: "2016-06-02T00:00:00Z",
+			appCreated:  "2016-06-01T00:00:00Z",
+			want: []string{
+				"location = /app {",
+				"location = /healthz {",
+				"location /app/ {",
+				"location / {",
+				"location ~ \\.php$ {",
+				"location ~ ^/v[0-9]+/ {",
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		manifest := strings.NewReplacer("SITE_CREATED", tt.siteCreated, "APP_CREATED", tt.appCreated).Replace(testSharedPathsManifest)
+		objs := newManifestObjectGetter()
+		if err := objs.load(strings.NewReader(manifest)); err != nil {
+			t.Fatalf("case %d: unexpected error: %v", i, err)
+		}
+
+		krc := DefaultKubernetesReverseProxyConfigGetterConfig
+		krc.ClusterZones = []string{"example.com"}
+		krc.CanonicalHostnamePolicy = CanonicalHostnamePolicyUnlessHost
+		rc, err := newReverseProxyConfigGetterFromObjects(objs, &krc).ReverseProxyConfig()
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if len(rc.HTTPServers) != 1 {
+			t.Errorf("case %d: expected 1 server, got %d", i, len(rc.HTTPServers))
+			continue
+		}
+
+		got := []string{}
+		for _, loc := range rc.HTTPServers[0].Locations {
+			if loc.Match == "" {
+				got = append(got, fmt.Sprintf("location %s {", loc.Path))
+			} else {
+				got = append(got, fmt.Sprintf("location %s %s {", loc.Match, loc.Path))
+			}
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	kerrors "k8s.io/kubernetes/pkg/api/errors"
+	kclient "k8s.io/kubernetes/pkg/client/unversioned"
+	klabels "k8s.io/kubernetes/pkg/labels"
+)
+
+// rawAPI reads and writes objects as JSON through the REST client. The
+// vendored client predates the networking.k8s.io and Gateway API groups and
+// fields such as the external name of a Service, so objects that use them
+// are decoded into farva's own types rather than the client's.
+type rawAPI struct {
+	kc *kclient.Client
+}
+
+// resourcePath returns the path of resource in group version gv. The
+// namespace and name are left out if empty.
+func resourcePath(gv, namespace, resource, name string) []string {
+	path := []string{"/apis", gv}
+	if gv == "v1" {
+		path[0] = "/api"
+	}
+	if namespace != "" {
+		path = append(path, "namespaces", namespace)
+	}
+	path = append(path, resource)
+	if name != "" {
+		path = append(path, name)
+	}
+	return path
+}
+
+// get decodes the named object into into.
+func (a rawAPI) get(gv, namespace, resource, name string, into interface{}) error {
+	data, err := a.kc.Get().AbsPath(resourcePath(gv, namespace, resource, name)...).Do().Raw()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, into); err != nil {
+		return fmt.Errorf("failed decoding %s %s %s: %v", gv, resource, name, err)
+	}
+	return nil
+}
+
+// list decodes the objects matching selector, which may be nil, into into.
+func (a rawAPI) list(gv, namespace, resource string, selector klabels.Selector, into interface{}) error {
+	req := a.kc.Get().AbsPath(resourcePath(gv, namespace, resource, "")...)
+	if selector != nil {
+		req = req.Param("labelSelector", selector.String())
+	}
+	data, err := req.Do().Raw()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, into); err != nil {
+		return fmt.Errorf("failed decoding %s %s: %v", gv, resource, err)
+	}
+	return nil
+}
+
+// putStatus writes obj to the status subresource of the named object.
+func (a rawAPI) putStatus(gv, namespace, resource, name string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	path := append(resourcePath(gv, namespace, resource, name), "status")
+	return a.kc.Put().AbsPath(path...).Body(data).Do().Error()
+}
+
+// groupVersions picks the newest of several API group versions served by
+// the cluster, and remembers it.
+type groupVersions struct {
+	// kind names the objects read, for logging.
+	kind string
+	// all lists the group versions, newest first.
+	all []string
+
+	mu sync.Mutex
+	// current is the group version last used successfully.
+	current string
+}
+
+// do calls fn with the group version last used successfully, or else with
+// each group version in turn until fn returns anything but a NotFound
+// error.
+func (v *groupVersions) do(fn func(gv string) error) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	gvs := v.all
+	if v.current != "" {
+		// The cluster may stop serving it, so fall back to looking again.
+		gvs = append([]string{v.current}, gvs...)
+	}
+
+	var err error
+	for _, gv := range gvs {
+		err = fn(gv)
+		if kerrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if gv != v.current {
+			kubernetesLog.Infof("Reading %s from %s", v.kind, gv)
+			v.current = gv
+		}
+		return nil
+	}
+	return err
+}
+
+// get returns the group version last used successfully, if any.
+func (v *groupVersions) get() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.current
+}
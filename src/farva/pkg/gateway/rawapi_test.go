@@ -0,0 +1,39 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResourcePath(t *testing.T) {
+	tests := []struct {
+		gv, namespace, resource, name string
+		want                          string
+	}{
+		{gv: "v1", namespace: "shop", resource: "services", name: "web", want: "/api/v1/namespaces/shop/services/web"},
+		{gv: "networking.k8s.io/v1", resource: "ingressclasses", name: "internal", want: "/apis/networking.k8s.io/v1/ingressclasses/internal"},
+		{gv: "gateway.networking.k8s.io/v1", resource: "httproutes", want: "/apis/gateway.networking.k8s.io/v1/httproutes"},
+	}
+
+	for i, tt := range tests {
+		got := strings.Join(resourcePath(tt.gv, tt.namespace, tt.resource, tt.name), "/")
+		if tt.want != got {
+			t.Errorf("case %d: want %q, got %q", i, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Rendered is the output of Render.
+type Rendered struct {
+	// ReverseProxyConfig is the reverseProxyConfig encoded as JSON.
+	ReverseProxyConfig []byte
+	NGINXConfig        []byte
+	Ingresses          []IngressStatus
+}
+
+// Render runs the same translation as a running Gateway over the objects in
+// the given manifest files, without contacting a cluster. If validate is
+// true the result is also checked with `nginx -t`.
+func Render(cfg Config, manifests []string, validate bool) (*Rendered, error) {
+	krc, err := newKubernetesReverseProxyConfigGetterConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	objs, err := loadManifestObjects(manifests)
+	if err != nil {
+		return nil, err
+	}
+	nc, err := newGatewayNGINXConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	kg := newReverseProxyConfigGetterFromObjects(objs, krc)
+	if validate && len(krc.SnippetDirectives) > 0 {
+		kg.snippets = newSnippetValidator(nc)
+	}
+	var gg *gatewayAPIReverseProxyConfigGetter
+	if cfg.GatewayClass != "" {
+		gg = newGatewayAPIReverseProxyConfigGetter(objs, kg, cfg.GatewayClass, cfg.GatewayControllerName)
+	}
+	rg := mergeConfigSources(cfg, kg, gg)
+
+	rc, err := rg.ReverseProxyConfig()
+	out := &Rendered{Ingresses: rg.(ingressStatusGetter).IngressStatuses()}
+	if err != nil {
+		return out, err
+	}
+	rc.HTTPServers = append(rc.HTTPServers, DefaultHTTPReverseProxyServers(&cfg)...)
+
+	if out.ReverseProxyConfig, err = json.MarshalIndent(rc, "", "  "); err != nil {
+		return out, err
+	}
+	if out.NGINXConfig, err = renderConfig(&nc, rc); err != nil {
+		return out, err
+	}
+
+	if validate {
+		if err := validateNGINXConfig(nc, rc); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// validateNGINXConfig runs `nginx -t` against the config rendered into a
+// scratch directory, so that the pid file and logs (normally fifos nobody
+// is reading) don't interfere with the check.
+func validateNGINXConfig(nc NGINXConfig, rc *reverseProxyConfig) error {
+	dir, err := ioutil.TempDir("", "farva-render")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	nc.ConfigFile = filepath.Join(dir, "nginx.conf")
+	nc.PIDFile = filepath.Join(dir, "nginx.pid")
+	nc.AccessLog = filepath.Join(dir, "access.log")
+	nc.ErrorLog = filepath.Join(dir, "error.log")
+
+	cfg, err := renderConfig(&nc, rc)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(nc.ConfigFile, cfg, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	output, err := exec.Command("nginx", "-t", "-c", nc.ConfigFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nginx rejected config: %v\n%s", err, output)
+	}
+	return nil
+}
@@ -34,24 +34,124 @@ type httpReverseProxyServer struct {
 	Locations     []httpReverseProxyLocation
 	StaticCode    int
 	StaticMessage string
+
+	// IngressName and IngressNamespace identify the Ingress, if any, that
+	// this server was generated from. They are exposed to the access log.
+	IngressName      string
+	IngressNamespace string
+
+	// Headers set on requests to upstreams, added to responses, or hidden
+	// from responses, in addition to the global ones.
+	ProxySetHeaders  []httpHeader
+	AddHeaders       []httpHeader
+	ProxyHideHeaders []string
+
+	// Snippet holds raw nginx directives added to the server block.
+	Snippet []string
+
+	// SubdomainPatterns capture the subdomain matched by the wildcard
+	// names of the server into $farva_subdomain.
+	SubdomainPatterns []string
+
+	// RouteHeaders are request headers that routes may change. Each is
+	// copied into $farva_route_header_N, its index, which is passed to
+	// upstreams through ProxySetHeaders.
+	RouteHeaders []httpHeader
+}
+
+type httpHeader struct {
+	Name  string
+	Value string
 }
 
 type httpReverseProxyLocation struct {
-	Path          string
+	Path string
+	// Match is the nginx location modifier, such as = for an exact match,
+	// or empty for a prefix match.
+	Match string
+
+	// implied is set on locations generated to complete a Prefix path,
+	// which are dropped if the same location is given explicitly.
+	implied bool
+
 	StaticCode    int
 	StaticMessage string
 	Upstream      string
+
+	// IngressName and IngressNamespace identify the Ingress this location
+	// was generated from, if it isn't the one of its server.
+	IngressName      string
+	IngressNamespace string
+
+	// Snippet holds raw nginx directives added to the location block.
+	Snippet []string
+
+	// Routes, if set, choose the upstream of each request from its
+	// headers and query parameters, and take the place of Upstream and
+	// StaticCode. The last matching route wins, and requests matching
+	// none get a 404.
+	Routes []httpRoute
+}
+
+type httpRoute struct {
+	// Conditions must all hold for the route to match.
+	Conditions []httpRouteCondition
+	Upstream   string
+	StaticCode int
+
+	// Headers are assigned in order when the route is chosen.
+	Headers []httpRouteHeader
+}
+
+type httpRouteCondition struct {
+	Variable string
+	// Operator is = for an exact match or ~ for a regular expression.
+	Operator string
+	Value    string
+}
+
+type httpRouteHeader struct {
+	Variable string
+	Value    string
+	// IfEmpty, if set, is a variable that must be empty for the
+	// assignment to happen.
+	IfEmpty string
 }
 
 type httpReverseProxyUpstream struct {
 	Name    string
 	Servers []reverseProxyUpstreamServer
+
+	// Scheme is the scheme used to reach the servers, http if empty.
+	// HostHeader, if set, replaces the Host header of requests, and is
+	// the server name sent over https.
+	Scheme     string
+	HostHeader string
+}
+
+// UpstreamOverrides returns the HTTP upstreams with their own scheme or
+// Host header.
+func (rc *reverseProxyConfig) UpstreamOverrides() []httpReverseProxyUpstream {
+	ups := []httpReverseProxyUpstream{}
+	for _, up := range rc.HTTPUpstreams {
+		if up.Scheme != "" || up.HostHeader != "" {
+			ups = append(ups, up)
+		}
+	}
+	return ups
 }
 
 type reverseProxyUpstreamServer struct {
 	Name string
 	Host string
 	Port int
+	// Weight is left to nginx's default if zero.
+	Weight int
+
+	// Down and Backup keep a draining endpoint in its upstream without
+	// giving it new requests, or only when no other server is available.
+	Down   bool
+	Backup bool
 }
 
 type tcpReverseProxyServer struct {
@@ -30,21 +30,95 @@ var (
 pid {{ .NGINXConfig.PIDFile }};
 error_log {{ .NGINXConfig.ErrorLog }};
 daemon on;
-worker_processes auto;
+worker_processes {{ .NGINXConfig.WorkerProcesses }};
+{{- if .NGINXConfig.WorkerRlimitNofile }}
+worker_rlimit_nofile {{ .NGINXConfig.WorkerRlimitNofile }};
+{{- end }}
 
 events {
-    worker_connections 512;
+{{- if .NGINXConfig.WorkerConnections }}
+    worker_connections {{ .NGINXConfig.WorkerConnections }};
+{{- end }}
 }
 
 http {
-    server_names_hash_bucket_size 128;
+{{- if .NGINXConfig.ServerNamesHashBucketSize }}
+    server_names_hash_bucket_size {{ .NGINXConfig.ServerNamesHashBucketSize }};
+{{- end }}
+{{- if .NGINXConfig.ServerNamesHashMaxSize }}
+    server_names_hash_max_size {{ .NGINXConfig.ServerNamesHashMaxSize }};
+{{- end }}
+{{- if .NGINXConfig.MapHashBucketSize }}
+    map_hash_bucket_size {{ .NGINXConfig.MapHashBucketSize }};
+{{- end }}
     log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
                       '$status $body_bytes_sent "$http_referer" '
-                      '"$http_user_agent" "$http_x_forwarded_for"';
-    access_log {{ .NGINXConfig.AccessLog }} main;
+                      '"$http_user_agent" "$http_x_forwarded_for"'{{ if .NGINXConfig.RequestIDHeader }}
+                      ' "$farva_request_id"'{{ end }};
+{{- if .NGINXConfig.LogFormat }}
+    log_format  custom  '{{ .NGINXConfig.LogFormat }}';
+{{- end }}
+{{- if eq .NGINXConfig.AccessLogFormatName "json" }}
+    log_format  json  escape=json '{'
+                      '"time":"$time_iso8601",'
+                      '"remote_addr":"$remote_addr",'
+                      '"method":"$request_method",'
+                      '"uri":"$request_uri",'
+                      '"protocol":"$server_protocol",'
+                      '"host":"$host",'
+                      '"server_name":"$server_name",'
+                      '"status":$status,'
+                      '"bytes_sent":$bytes_sent,'
+                      '"body_bytes_sent":$body_bytes_sent,'
+                      '"request_time":$request_time,'
+                      '"upstream_addr":"$upstream_addr",'
+                      '"upstream_status":"$upstream_status",'
+                      '"upstream_response_time":"$upstream_response_time",'
+                      '"http_referer":"$http_referer",'
+                      '"http_user_agent":"$http_user_agent",'
+                      '"http_x_forwarded_for":"$http_x_forwarded_for",'
+{{- if .NGINXConfig.RequestIDHeader }}
+                      '"request_id":"$farva_request_id",'
+{{- end }}
+                      '"ingress_name":"$farva_ingress_name",'
+                      '"ingress_namespace":"$farva_ingress_namespace",'
+                      '"upstream_name":"$farva_upstream"'
+                      '}';
+    uninitialized_variable_warn off;
+{{- end }}
+    access_log {{ .NGINXConfig.AccessLog }} {{ .NGINXConfig.AccessLogFormatName }};
+{{- if .NGINXConfig.KeepaliveTimeout }}
+
+    keepalive_timeout {{ .NGINXConfig.KeepaliveTimeout }};
+{{- end }}
+{{- if .NGINXConfig.KeepaliveRequests }}
+    keepalive_requests {{ .NGINXConfig.KeepaliveRequests }};
+{{- end }}
+{{- if .NGINXConfig.ClientBodyTimeout }}
+    client_body_timeout {{ .NGINXConfig.ClientBodyTimeout }};
+{{- end }}
+{{- if .NGINXConfig.Gzip }}
+
+    gzip on;
+{{- if .NGINXConfig.GzipMinLength }}
+    gzip_min_length {{ .NGINXConfig.GzipMinLength }};
+{{- end }}
+{{- if .NGINXConfig.GzipTypes }}
+    gzip_types {{ join .NGINXConfig.GzipTypes " " }};
+{{- end }}
+{{- end }}
 
     proxy_http_version 1.1;
     proxy_set_header Connection "";
+{{- if .NGINXConfig.ProxyConnectTimeout }}
+    proxy_connect_timeout {{ .NGINXConfig.ProxyConnectTimeout }};
+{{- end }}
+{{- if .NGINXConfig.ProxyReadTimeout }}
+    proxy_read_timeout {{ .NGINXConfig.ProxyReadTimeout }};
+{{- end }}
+{{- if .NGINXConfig.ProxySendTimeout }}
+    proxy_send_timeout {{ .NGINXConfig.ProxySendTimeout }};
+{{- end }}
 
     # Override the Host header with the value of the
     # X-Forwarded-Host header only if it is provided.
@@ -55,21 +129,203 @@ http {
         default $http_host;
         ~.+ $http_x_forwarded_host;
     }
+{{- $overrides := .ReverseProxyConfig.UpstreamOverrides }}
+{{- if $overrides }}
+
+    # Some upstreams are reached over https or expect their own Host
+    # header, which is also the server name sent to them.
+    map $farva_upstream $farva_upstream_scheme {
+        default http;
+{{- range $up := $overrides }}
+        "{{ $up.Name }}" {{ or $up.Scheme "http" }};
+{{- end }}
+    }
+    map $farva_upstream $farva_upstream_host {
+        default $host_value;
+{{- range $up := $overrides }}
+{{- if $up.HostHeader }}
+        "{{ $up.Name }}" "{{ $up.HostHeader }}";
+{{- end }}
+{{- end }}
+    }
+    proxy_ssl_server_name on;
+    proxy_ssl_name $farva_upstream_host;
+    proxy_set_header Host $farva_upstream_host;
+{{- else }}
     proxy_set_header Host $host_value;
+{{- end }}
+{{- if .NGINXConfig.TrustProxies }}
+
+    # Forwarded headers and request IDs sent by clients are only believed
+    # when the connection comes from a trusted proxy.
+    geo $realip_remote_addr $farva_trusted_proxy {
+        default 0;
+{{- range $cidr := .NGINXConfig.TrustedProxies }}
+        {{ $cidr }} 1;
+{{- end }}
+    }
+{{- end }}
+{{- if .NGINXConfig.RequestIDHeader }}
+{{- if .NGINXConfig.RequestIDHonorIncoming }}
+
+    map "$farva_trusted_proxy:{{ .NGINXConfig.RequestIDVariable }}" $farva_request_id {
+        default $request_id;
+        # Keep a well-formed ID sent by a trusted proxy.
+        "~^1:(?<incoming_request_id>[A-Za-z0-9._:-]{1,128})$" $incoming_request_id;
+    }
+{{- else }}
+
+    map {{ .NGINXConfig.RequestIDVariable }} $farva_request_id {
+        default $request_id;
+    }
+{{- end }}
+{{- end }}
+{{- template "globalHeaders" $.NGINXConfig }}
+{{- if .NGINXConfig.ForwardedHeadersPorts }}
+
+    map "$farva_trusted_proxy:$http_x_forwarded_proto" $farva_forwarded_proto {
+        default $scheme;
+        "~^1:(?<proto>https?)$" $proto;
+    }
+    map "$farva_trusted_proxy:$http_x_forwarded_port" $farva_forwarded_port {
+        default $server_port;
+        "~^1:(?<port>[0-9]+)$" $port;
+    }
+    map "$farva_trusted_proxy:$http_x_forwarded_for" $farva_forwarded_for {
+        default $realip_remote_addr;
+        "~^1:(?<forwarded_for>.+)$" "$forwarded_for, $realip_remote_addr";
+    }
+    map "$farva_trusted_proxy:$http_x_forwarded_for" $farva_proxy_protocol_forwarded_for {
+        default $realip_remote_addr;
+        "1:" $proxy_protocol_addr;
+        "~^1:(?<forwarded_for>.+)$" "$forwarded_for, $proxy_protocol_addr";
+    }
+    # IPv6 addresses are bracketed in the Forwarded header.
+    map $remote_addr $farva_forwarded_node {
+        default $remote_addr;
+        "~:" "[$remote_addr]";
+    }
+{{- end }}
 
 {{ range $srv := $.ReverseProxyConfig.HTTPServers }}
     server {
-        listen {{ $srv.ListenPort }}{{ if $srv.DefaultServer }} default_server{{ end }};
+        listen {{ $srv.ListenPort }}{{ if $srv.DefaultServer }} default_server{{ end }}{{ if $.NGINXConfig.ProxyProtocol $srv.ListenPort }} proxy_protocol{{ end }};
         {{ if $srv.Name }}server_name {{ $srv.Name }}{{ if $srv.AltNames }} {{ join $srv.AltNames " " }}{{ end }};{{ end }}
+        {{- if $srv.IngressName }}
+        set $farva_ingress_name "{{ $srv.IngressName }}";
+        set $farva_ingress_namespace "{{ $srv.IngressNamespace }}";
+        {{- end }}
+        {{- if $srv.SubdomainPatterns }}
+        set $farva_subdomain "";
+        {{- range $re := $srv.SubdomainPatterns }}
+        if ($host ~* "{{ $re }}") {
+            set $farva_subdomain $1;
+        }
+        {{- end }}
+        {{- end }}
+        {{- range $i, $h := $srv.RouteHeaders }}
+        set $farva_route_header_{{ $i }} "{{ $h.Value }}";
+        {{- end }}
+        {{- $forwarded := $.NGINXConfig.ForwardedHeaders $srv.ListenPort }}
+        {{- $proxyProtocol := $.NGINXConfig.ProxyProtocol $srv.ListenPort }}
+        {{- if and $forwarded $.NGINXConfig.TrustedProxies }}
+        {{- range $cidr := $.NGINXConfig.TrustedProxies }}
+        set_real_ip_from {{ $cidr }};
+        {{- end }}
+        real_ip_header {{ if $proxyProtocol }}proxy_protocol{{ else }}X-Forwarded-For{{ end }};
+        real_ip_recursive on;
+        {{- end }}
+        {{- if or $srv.ProxySetHeaders $forwarded }}
+        proxy_set_header Connection "";
+        proxy_set_header Host {{ if $overrides }}$farva_upstream_host{{ else }}$host_value{{ end }};
+        {{- if $.NGINXConfig.RequestIDHeader }}
+        proxy_set_header {{ $.NGINXConfig.RequestIDHeader }} $farva_request_id;
+        {{- end }}
+        {{- range $h := $.NGINXConfig.ProxySetHeaders }}
+        proxy_set_header {{ $h.Name }} "{{ $h.Value }}";
+        {{- end }}
+        {{- if $forwarded }}
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For {{ if $proxyProtocol }}$farva_proxy_protocol_forwarded_for{{ else }}$farva_forwarded_for{{ end }};
+        proxy_set_header X-Forwarded-Proto $farva_forwarded_proto;
+        proxy_set_header X-Forwarded-Port $farva_forwarded_port;
+        proxy_set_header Forwarded 'for="$farva_forwarded_node";proto=$farva_forwarded_proto;host="$host"';
+        {{- end }}
+        {{- range $h := $srv.ProxySetHeaders }}
+        proxy_set_header {{ $h.Name }} "{{ $h.Value }}";
+        {{- end }}
+        {{- end }}
+        {{- if $srv.ProxyHideHeaders }}
+        {{- range $h := $.NGINXConfig.ProxyHideHeaders }}
+        proxy_hide_header {{ $h }};
+        {{- end }}
+        {{- range $h := $srv.ProxyHideHeaders }}
+        proxy_hide_header {{ $h }};
+        {{- end }}
+        {{- end }}
+        {{- if $srv.AddHeaders }}
+        {{- if $.NGINXConfig.RequestIDHeader }}
+        add_header {{ $.NGINXConfig.RequestIDHeader }} $farva_request_id always;
+        {{- end }}
+        {{- range $h := $.NGINXConfig.AddHeaders }}
+        add_header {{ $h.Name }} "{{ $h.Value }}" always;
+        {{- end }}
+        {{- range $h := $srv.AddHeaders }}
+        add_header {{ $h.Name }} "{{ $h.Value }}" always;
+        {{- end }}
+        {{- end }}
+        {{- range $d := $srv.Snippet }}
+        {{ $d }};
+        {{- end }}
         {{ if $srv.StaticCode -}}
         return {{ $srv.StaticCode }}{{ if $srv.StaticMessage }} '{{ $srv.StaticMessage }}'{{ end }};
         {{- else -}}
 {{ range $loc := $srv.Locations }}
-        location {{ or $loc.Path "/" }} {
-            {{ if $loc.StaticCode -}}
+        location {{ if $loc.Match }}{{ $loc.Match }} {{ end }}{{ or $loc.Path "/" }} {
+            {{- if $loc.IngressName }}
+            set $farva_ingress_name "{{ $loc.IngressName }}";
+            set $farva_ingress_namespace "{{ $loc.IngressNamespace }}";
+            {{- end }}
+            {{- range $d := $loc.Snippet }}
+            {{ $d }};
+            {{- end }}
+            {{ if $loc.Routes -}}
+            set $farva_route "";
+            set $farva_upstream "";
+            {{- range $i, $r := $loc.Routes }}
+            set $farva_match "";
+            {{- range $c := $r.Conditions }}
+            if ({{ $c.Variable }} {{ $c.Operator }} "{{ $c.Value }}") {
+                set $farva_match "${farva_match}x";
+            }
+            {{- end }}
+            if ($farva_match = "{{ repeat "x" (len $r.Conditions) }}") {
+                set $farva_route "{{ $i }}";
+                set $farva_upstream "{{ $r.Upstream }}";
+            }
+            {{- end }}
+            if ($farva_route = "") {
+                return 404;
+            }
+            {{- range $i, $r := $loc.Routes }}
+            {{- if $r.StaticCode }}
+            if ($farva_route = "{{ $i }}") {
+                return {{ $r.StaticCode }};
+            }
+            {{- end }}
+            {{- range $h := $r.Headers }}
+            set $farva_guard "$farva_route:{{ $h.IfEmpty }}";
+            if ($farva_guard = "{{ $i }}:") {
+                set {{ $h.Variable }} "{{ $h.Value }}";
+            }
+            {{- end }}
+            {{- end }}
+            proxy_pass {{ if $overrides }}$farva_upstream_scheme{{ else }}http{{ end }}://$farva_upstream;
+            {{- else if $loc.StaticCode -}}
 			return {{ $loc.StaticCode }}{{ if $loc.StaticMessage }} '{{ $loc.StaticMessage }}'{{end}};
 			{{- else }}
-            proxy_pass http://{{ $loc.Upstream }};
+            set $farva_upstream "{{ $loc.Upstream }}";
+            proxy_pass {{ if $overrides }}$farva_upstream_scheme{{ else }}http{{ end }}://{{ $loc.Upstream }};
 			{{- end }}
         }
 {{ end }}
@@ -79,9 +335,15 @@ http {
 {{ range $index, $srv := $.ReverseProxyConfig.HTTPServers }}
 {{ if eq ($index) (0) }}
     server {
-        listen {{ $srv.ListenPort }};
+        listen {{ $.NGINXConfig.HealthPort }};
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -95,9 +357,11 @@ http {
 {{ if $up.Servers }}
     upstream {{ $up.Name }} {
 {{ range $ep := $up.Servers }}
-        server {{ $ep.Host }}:{{ $ep.Port }};  # {{ $ep.Name }}
+        server {{ $ep.Host }}:{{ $ep.Port }}{{ if $ep.Weight }} weight={{ $ep.Weight }}{{ end }}{{ if $ep.Down }} down{{ else if $ep.Backup }} backup{{ end }};  # {{ $ep.Name }}
+{{- end }}
+{{- if $.NGINXConfig.UpstreamKeepalive }}
+        keepalive {{ $.NGINXConfig.UpstreamKeepalive }};
 {{- end }}
-        keepalive 64;
     }
 {{- end }}
 {{ end }}
@@ -122,9 +386,29 @@ stream {
 }
 `
 
-	nginxTemplate = template.Must(template.New("nginx").Funcs(template.FuncMap{
-		"join": strings.Join,
-	}).Parse(nginxTemplateData))
+	// nginx only inherits proxy_set_header, proxy_hide_header and
+	// add_header from the http block into servers that set none of their
+	// own, so servers with their own headers repeat the global ones.
+	nginxGlobalHeadersTemplateData = `{{ define "globalHeaders" }}
+{{- if .RequestIDHeader }}
+    proxy_set_header {{ .RequestIDHeader }} $farva_request_id;
+    add_header {{ .RequestIDHeader }} $farva_request_id always;
+{{- end }}
+{{- range $h := .ProxySetHeaders }}
+    proxy_set_header {{ $h.Name }} "{{ $h.Value }}";
+{{- end }}
+{{- range $h := .ProxyHideHeaders }}
+    proxy_hide_header {{ $h }};
+{{- end }}
+{{- range $h := .AddHeaders }}
+    add_header {{ $h.Name }} "{{ $h.Value }}" always;
+{{- end }}
+{{- end }}`
+
+	nginxTemplate = template.Must(template.Must(template.New("nginx").Funcs(template.FuncMap{
+		"join":   strings.Join,
+		"repeat": strings.Repeat,
+	}).Parse(nginxTemplateData)).Parse(nginxGlobalHeadersTemplateData))
 
 	DefaultNGINXConfig = NGINXConfig{
 		ClusterZone: "example.com",
@@ -133,9 +417,23 @@ stream {
 		HealthPort:  7332,
 		AccessLog:   "/dev/stdout",
 		ErrorLog:    "/dev/stderr",
+
+		WorkerProcesses:           "auto",
+		WorkerConnections:         512,
+		UpstreamKeepalive:         64,
+		ServerNamesHashBucketSize: 128,
+		AccessLogFormat:           accessLogFormatMain,
 	}
 )
 
+var nginxLog = logger.Component("nginx")
+
+const (
+	accessLogFormatMain   = "main"
+	accessLogFormatJSON   = "json"
+	accessLogFormatCustom = "custom"
+)
+
 const (
 	nginxStatusRunning = "running"
 	nginxStatusStopped = "stopped"
@@ -150,6 +448,94 @@ type NGINXConfig struct {
 	ListenPort  int
 	ErrorLog    string
 	AccessLog   string
+
+	// The following fields tune global nginx directives and may be
+	// overridden at runtime through the nginx ConfigMap. Zero values
+	// leave the corresponding directive at its nginx default.
+	WorkerProcesses           string
+	WorkerConnections         int
+	WorkerRlimitNofile        int
+	UpstreamKeepalive         int
+	KeepaliveTimeout          string
+	KeepaliveRequests         int
+	ServerNamesHashBucketSize int
+	ServerNamesHashMaxSize    int
+	MapHashBucketSize         int
+	Gzip                      bool
+	GzipTypes                 []string
+	GzipMinLength             int
+	ClientBodyTimeout         string
+	ProxyConnectTimeout       string
+	ProxyReadTimeout          string
+	ProxySendTimeout          string
+	LogFormat                 string
+	AccessLogFormat           string
+
+	// Headers set on requests to upstreams, added to responses, or hidden
+	// from responses for every server.
+	ProxySetHeaders  []httpHeader
+	AddHeaders       []httpHeader
+	ProxyHideHeaders []string
+
+	// ProxyProtocolPorts lists the listeners that expect the PROXY
+	// protocol. ForwardedHeadersPorts lists the listeners on which the
+	// client address is recovered from trusted proxies and passed on to
+	// upstreams in X-Forwarded-* headers. TrustedProxies are the CIDRs
+	// whose PROXY protocol and X-Forwarded-* values are believed.
+	ProxyProtocolPorts    []int
+	ForwardedHeadersPorts []int
+	TrustedProxies        []string
+
+	// RequestIDHeader, if set, names the header carrying the ID of each
+	// request to upstreams and back to clients. A valid ID sent by one of
+	// the TrustedProxies is kept if RequestIDHonorIncoming is set.
+	RequestIDHeader        string
+	RequestIDHonorIncoming bool
+}
+
+// RequestIDVariable returns the nginx variable holding the incoming request
+// ID header.
+func (cfg *NGINXConfig) RequestIDVariable() string {
+	return "$http_" + strings.ToLower(strings.Replace(cfg.RequestIDHeader, "-", "_", -1))
+}
+
+// TrustProxies reports whether any value sent by clients is only believed
+// from trusted proxies.
+func (cfg *NGINXConfig) TrustProxies() bool {
+	return len(cfg.ForwardedHeadersPorts) > 0 || (cfg.RequestIDHeader != "" && cfg.RequestIDHonorIncoming)
+}
+
+// ProxyProtocol reports whether the listener on port expects the PROXY
+// protocol.
+func (cfg *NGINXConfig) ProxyProtocol(port int) bool {
+	return containsPort(cfg.ProxyProtocolPorts, port)
+}
+
+// ForwardedHeaders reports whether forwarded headers are handled on the
+// listener on port.
+func (cfg *NGINXConfig) ForwardedHeaders(port int) bool {
+	return containsPort(cfg.ForwardedHeadersPorts, port)
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessLogFormatName returns the name of the log_format used for the access
+// log. A custom LogFormat takes precedence over AccessLogFormat.
+func (cfg *NGINXConfig) AccessLogFormatName() string {
+	if cfg.LogFormat != "" {
+		return accessLogFormatCustom
+	}
+	if cfg.AccessLogFormat == "" {
+		return accessLogFormatMain
+	}
+	return cfg.AccessLogFormat
 }
 
 func newNGINXConfig(hp int, cz string, errorLog string, accessLog string) NGINXConfig {
@@ -163,7 +549,7 @@ func newNGINXConfig(hp int, cz string, errorLog string, accessLog string) NGINXC
 
 type NGINXManager interface {
 	Status() (string, error)
-	SetConfig(*reverseProxyConfig) error
+	SetConfig(*NGINXConfig, *reverseProxyConfig) error
 	Start() error
 }
 
@@ -176,7 +562,7 @@ type nginxManager struct {
 }
 
 func (n *nginxManager) Status() (string, error) {
-	logger.Log.Info("Checking status")
+	nginxLog.Debug("Checking status")
 	if _, err := os.Stat(n.cfg.PIDFile); err != nil {
 		if os.IsNotExist(err) {
 			return nginxStatusStopped, nil
@@ -188,16 +574,32 @@ func (n *nginxManager) Status() (string, error) {
 	return nginxStatusRunning, nil
 }
 
-func (n *nginxManager) SetConfig(rc *reverseProxyConfig) error {
-	cfg, err := renderConfig(&n.cfg, rc)
+// SetConfig renders nc and rc into the nginx config file and reloads nginx if
+// the result differs from what is currently on disk. The config file and
+// PID file locations are always taken from the manager's own NGINXConfig.
+func (n *nginxManager) SetConfig(nc *NGINXConfig, rc *reverseProxyConfig) error {
+	rnc := *nc
+	rnc.ConfigFile = n.cfg.ConfigFile
+	rnc.PIDFile = n.cfg.PIDFile
+
+	cfg, err := renderConfig(&rnc, rc)
 	if err != nil {
 		return err
 	}
-	if !n.hasConfigChanged(cfg) {
+	current, err := ioutil.ReadFile(n.cfg.ConfigFile)
+	if err != nil {
+		nginxLog.Errorf("Could not read existing configuration, assuming changed: %s", err)
+		current = nil
+	} else if bytes.Compare(current, cfg) == 0 {
 		return nil
 	}
 
-	logger.Log.Infof("About to write config: %s", cfg)
+	if current == nil {
+		nginxLog.Info("Writing initial config")
+	} else {
+		nginxLog.Infof("Writing changed config:\n%s", configDiff(current, cfg))
+	}
+	nginxLog.Debugf("About to write config: %s", cfg)
 	if err := ioutil.WriteFile(n.cfg.ConfigFile, cfg, os.FileMode(0644)); err != nil {
 		return err
 	}
@@ -205,20 +607,19 @@ func (n *nginxManager) SetConfig(rc *reverseProxyConfig) error {
 		return nil
 	}
 	if err := n.reload(); err != nil {
+		// Put the last known good config back so a bad change
+		// can't take nginx down on its next restart.
+		if current != nil {
+			nginxLog.Errorf("Reload failed, restoring previous config: %v", err)
+			if werr := ioutil.WriteFile(n.cfg.ConfigFile, current, os.FileMode(0644)); werr != nil {
+				nginxLog.Errorf("Failed restoring previous config: %v", werr)
+			}
+		}
 		return err
 	}
 	return nil
 }
 
-func (n *nginxManager) hasConfigChanged(incoming []byte) bool {
-	current, err := ioutil.ReadFile(n.cfg.ConfigFile)
-	if err != nil {
-		logger.Log.Errorf("Could not read existing configuration, assuming changed: %s", err)
-		return true
-	}
-	return bytes.Compare(current, incoming) != 0
-}
-
 func (n *nginxManager) assertConfigOK() error {
 	_, err := n.runCombinedOutput("-t")
 	return err
@@ -226,10 +627,10 @@ func (n *nginxManager) assertConfigOK() error {
 
 func (n *nginxManager) Start() error {
 	if err := n.assertConfigOK(); err != nil {
-		logger.Log.Info("Configuration is invalid, aborting start")
+		nginxLog.Error("Configuration is invalid, aborting start")
 		return err
 	}
-	logger.Log.Info("Starting nginx")
+	nginxLog.Info("Starting nginx")
 	return n.run()
 }
 
@@ -237,38 +638,38 @@ func (n *nginxManager) reload() error {
 	if err := n.assertConfigOK(); err != nil {
 		return err
 	}
-	logger.Log.Info("Reloading nginx")
+	nginxLog.Info("Reloading nginx")
 	return n.run("-s", "reload")
 }
 
 func (n *nginxManager) run(args ...string) error {
 	args = append([]string{"-c", n.cfg.ConfigFile}, args...)
-	logger.Log.Infof("Calling run on nginx with args: %q", args)
+	nginxLog.Debugf("Calling run on nginx with args: %q", args)
 	err := exec.Command("nginx", args...).Run()
 	if err != nil {
-		logger.Log.Infof("nginx command failed w/ err: %v", err)
+		nginxLog.Errorf("nginx command failed w/ err: %v", err)
 		return err
 	} else {
-		logger.Log.Info("nginx command success")
+		nginxLog.Debug("nginx command success")
 	}
 	return nil
 }
 
 func (n *nginxManager) runCombinedOutput(args ...string) (string, error) {
 	args = append([]string{"-c", n.cfg.ConfigFile}, args...)
-	logger.Log.Infof("Calling run on nginx with args: %q", args)
+	nginxLog.Debugf("Calling run on nginx with args: %q", args)
 	output, err := exec.Command("nginx", args...).CombinedOutput()
 	if err != nil {
-		logger.Log.Infof("nginx command failed w/ err: %v, output:%s", err, output)
+		nginxLog.Errorf("nginx command failed w/ err: %v, output:%s", err, output)
 		return "", err
 	} else {
-		logger.Log.Info("nginx command success")
+		nginxLog.Debug("nginx command success")
 	}
 	return string(output), nil
 }
 
 func renderConfig(cfg *NGINXConfig, rc *reverseProxyConfig) ([]byte, error) {
-	logger.Log.Info("Rendering config")
+	nginxLog.Debug("Rendering config")
 
 	config := struct {
 		ReverseProxyConfig *reverseProxyConfig
@@ -294,17 +695,17 @@ type loggingNGINXManager struct {
 }
 
 func (l *loggingNGINXManager) Status() (string, error) {
-	logger.Log.Info("called NGINXManager.Status()")
+	nginxLog.Info("called NGINXManager.Status()")
 	return l.status, nil
 }
 
 func (l *loggingNGINXManager) Start() error {
-	logger.Log.Info("called NGINXManager.Start()")
+	nginxLog.Info("called NGINXManager.Start()")
 	l.status = nginxStatusRunning
 	return nil
 }
 
-func (l *loggingNGINXManager) SetConfig(rc *reverseProxyConfig) error {
-	logger.Log.Infof("called NGINXManager.SetConfig(*reverseProxyConfig) w/ %+v", rc)
+func (l *loggingNGINXManager) SetConfig(nc *NGINXConfig, rc *reverseProxyConfig) error {
+	nginxLog.Infof("called NGINXManager.SetConfig(*NGINXConfig, *reverseProxyConfig) w/ %+v %+v", nc, rc)
 	return nil
 }
@@ -16,6 +16,7 @@ limitations under the License.
 package gateway
 
 import (
+	"regexp"
 	"strings"
 	"testing"
 )
@@ -96,9 +97,15 @@ http {
 
 
     server {
-        listen 9001;
+        listen 7332;
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -200,9 +207,15 @@ http {
 
 
     server {
-        listen 9001;
+        listen 7332;
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -313,11 +326,13 @@ http {
         
         location /abc {
             
+            set $farva_upstream "foo";
             proxy_pass http://foo;
         }
 
         location /def {
             
+            set $farva_upstream "bar";
             proxy_pass http://bar;
         }
 
@@ -326,9 +341,15 @@ http {
 
 
     server {
-        listen 9001;
+        listen 7332;
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -523,9 +544,15 @@ http {
 
 
     server {
-        listen 9001;
+        listen 7332;
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -596,9 +623,15 @@ http {
 
 
     server {
-        listen 9001;
+        listen 7332;
         server_name localhost;
 
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
         access_log off;
         allow 127.0.0.1;
         deny all;
@@ -676,6 +709,157 @@ stream {
 
 
 
+}
+`,
+		},
+
+		// an upstream reached over https with its own Host header
+		{
+			rc: reverseProxyConfig{
+				HTTPServers: []httpReverseProxyServer{
+					httpReverseProxyServer{
+						ListenPort: 9001,
+						Locations: []httpReverseProxyLocation{
+							httpReverseProxyLocation{
+								Path:     "/api",
+								Upstream: "saas",
+							},
+							httpReverseProxyLocation{
+								Path:     "/",
+								Upstream: "web",
+							},
+						},
+					},
+				},
+				HTTPUpstreams: []httpReverseProxyUpstream{
+					httpReverseProxyUpstream{
+						Name: "saas",
+						Servers: []reverseProxyUpstreamServer{
+							reverseProxyUpstreamServer{
+								Name: "api.saas.example",
+								Host: "10.9.0.1",
+								Port: 443,
+							},
+						},
+						Scheme:     "https",
+						HostHeader: "api.saas.example",
+					},
+					httpReverseProxyUpstream{
+						Name: "web",
+						Servers: []reverseProxyUpstreamServer{
+							reverseProxyUpstreamServer{
+								Name: "web",
+								Host: "10.3.0.7",
+								Port: 80,
+							},
+						},
+					},
+				},
+			},
+			want: `
+pid /var/run/nginx.pid;
+error_log /dev/stderr;
+daemon on;
+worker_processes auto;
+
+events {
+    worker_connections 512;
+}
+
+http {
+    server_names_hash_bucket_size 128;
+    log_format  main  '$remote_addr - $remote_user [$time_local] "$request" '
+                      '$status $body_bytes_sent "$http_referer" '
+                      '"$http_user_agent" "$http_x_forwarded_for"';
+    access_log /dev/stdout main;
+
+    proxy_http_version 1.1;
+    proxy_set_header Connection "";
+
+    # Override the Host header with the value of the
+    # X-Forwarded-Host header only if it is provided.
+    # This allows the upstream service with the most
+    # accurate value for the Host header without having
+    # to be aware they are behind a proxy.
+    map $http_x_forwarded_host $host_value {
+        default $http_host;
+        ~.+ $http_x_forwarded_host;
+    }
+
+    # Some upstreams are reached over https or expect their own Host
+    # header, which is also the server name sent to them.
+    map $farva_upstream $farva_upstream_scheme {
+        default http;
+        "saas" https;
+    }
+    map $farva_upstream $farva_upstream_host {
+        default $host_value;
+        "saas" "api.saas.example";
+    }
+    proxy_ssl_server_name on;
+    proxy_ssl_name $farva_upstream_host;
+    proxy_set_header Host $farva_upstream_host;
+
+
+    server {
+        listen 9001;
+        
+        
+        location /api {
+            
+            set $farva_upstream "saas";
+            proxy_pass $farva_upstream_scheme://saas;
+        }
+
+        location / {
+            
+            set $farva_upstream "web";
+            proxy_pass $farva_upstream_scheme://web;
+        }
+
+    }
+
+
+
+    server {
+        listen 7332;
+        server_name localhost;
+
+        # Define the variables set per Ingress so that log formats and
+        # headers referring to them are valid without any Ingresses.
+        set $farva_ingress_name "";
+        set $farva_ingress_namespace "";
+        set $farva_upstream "";
+
+        access_log off;
+        allow 127.0.0.1;
+        deny all;
+
+        location /nginx_status {
+          stub_status on;
+        }
+    }
+
+
+
+    upstream saas {
+
+        server 10.9.0.1:443;  # api.saas.example
+        keepalive 64;
+    }
+
+
+    upstream web {
+
+        server 10.3.0.7:80;  # web
+        keepalive 64;
+    }
+
+}
+
+stream {
+
+
 }
 `,
 		},
@@ -697,3 +881,62 @@ stream {
 		}
 	}
 }
+
+func TestRenderConfigJSONAccessLog(t *testing.T) {
+	cfg := DefaultNGINXConfig
+	cfg.AccessLogFormat = accessLogFormatJSON
+
+	rc := reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{
+				Name:             "web.default.example.com",
+				ListenPort:       9001,
+				IngressName:      "web",
+				IngressNamespace: "default",
+				Locations: []httpReverseProxyLocation{
+					httpReverseProxyLocation{
+						Path:     "/",
+						Upstream: "default__web__web",
+					},
+				},
+			},
+		},
+	}
+	got, err := renderConfig(&cfg, &rc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, want := range []string{
+		"\n    log_format  json  escape=json '{'\n",
+		"\n    access_log /dev/stdout json;\n",
+		"\n        set $farva_ingress_name \"web\";\n        set $farva_ingress_namespace \"default\";\n",
+		"\n            set $farva_upstream \"default__web__web\";\n",
+	} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("rendered config missing %q:\n%s", want, got)
+		}
+	}
+}
+
+// Without any Ingress servers the variables used by the json log format
+// must still be defined, otherwise nginx refuses the config.
+func TestRenderConfigJSONAccessLogDefault(t *testing.T) {
+	cfg := DefaultNGINXConfig
+	cfg.AccessLogFormat = accessLogFormatJSON
+
+	got, err := renderConfig(&cfg, DefaultReverseProxyConfig(&DefaultConfig))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	used := regexp.MustCompile(`\$(farva_[a-z_]+)`).FindAllStringSubmatch(string(got), -1)
+	if len(used) == 0 {
+		t.Fatalf("rendered config uses no farva variables:\n%s", got)
+	}
+	for _, m := range used {
+		if !strings.Contains(string(got), "set $"+m[1]+" ") && !regexp.MustCompile(` \$`+m[1]+` \{`).Match(got) {
+			t.Errorf("rendered config uses undefined variable $%s:\n%s", m[1], got)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	kapi "k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util/intstr"
+)
+
+// serviceTypeExternalName is the type of Services that alias a DNS name.
+const serviceTypeExternalName kapi.ServiceType = "ExternalName"
+
+// BackendModeKey is the Ingress annotation choosing how its Services are
+// proxied to.
+const BackendModeKey = "backend-mode"
+
+// Annotations of an ExternalName Service choosing how its external name is
+// reached: UpstreamSchemeKey is http, the default, or https, and
+// UpstreamHostKey sets the Host header of requests, which defaults to the
+// external name over https.
+const (
+	UpstreamSchemeKey = "upstream-scheme"
+	UpstreamHostKey   = "upstream-host"
+)
+
+// externalNameLookupTimeout bounds the resolution of each external name.
+const externalNameLookupTimeout = 2 * time.Second
+
+const (
+	// BackendModeEndpoints proxies to the endpoints of each Service,
+	// balanced by nginx.
+	BackendModeEndpoints = "endpoints"
+	// BackendModeClusterIP proxies to the cluster IP of each Service,
+	// leaving balancing to kube-proxy.
+	BackendModeClusterIP = "cluster-ip"
+)
+
+// service is a Service with the fields added to the API after the vendored
+// client.
+type service struct {
+	kapi.Service
+
+	// ExternalName is the DNS name aliased by an ExternalName Service.
+	ExternalName string
+}
+
+// UnmarshalJSON decodes a v1 Service.
+func (s *service) UnmarshalJSON(data []byte) error {
+	obj, err := runtime.Decode(kapi.Codecs.UniversalDecoder(), data)
+	if err != nil {
+		return err
+	}
+	svc, ok := obj.(*kapi.Service)
+	if !ok {
+		return fmt.Errorf("expected Service, got %T", obj)
+	}
+
+	var spec struct {
+		Spec struct {
+			ExternalName string `json:"externalName"`
+		} `json:"spec"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+
+	*s = service{Service: *svc}
+	if svc.Spec.Type == serviceTypeExternalName {
+		s.ExternalName = spec.Spec.ExternalName
+	}
+	return nil
+}
+
+func (krc *kubernetesReverseProxyConfigGetterConfig) getAnnotationBackendMode(ing *ingress) (string, error) {
+	mode, ok := ing.ObjectMeta.Annotations[krc.annotationKey(BackendModeKey)]
+	if !ok {
+		return BackendModeEndpoints, nil
+	}
+	switch mode {
+	case BackendModeEndpoints, BackendModeClusterIP:
+		return mode, nil
+	}
+	return "", fmt.Errorf("annotation %s: invalid backend mode %q", krc.annotationKey(BackendModeKey), mode)
+}
+
+// getBackend fills up with the servers for a port of a Service, given by
+// number or name: the addresses its external name resolves to, its cluster
+// IP in BackendModeClusterIP, or else its endpoints.
+func (rcg *kubernetesReverseProxyConfigGetter) getBackend(up *httpReverseProxyUpstream, svcNamespace, svcName string, port intstr.IntOrString, mode string) error {
+	svc, err := rcg.objs.GetService(svcNamespace, svcName)
+	if err != nil {
+		return err
+	}
+
+	svcPort, err := servicePort(svc, port)
+	if err != nil {
+		return err
+	}
+
+	if svc.ExternalName != "" {
+		if up.Scheme, up.HostHeader, err = rcg.krc.externalNameOptions(svc); err != nil {
+			return &invalidIngressError{err}
+		}
+		up.Servers = rcg.externalNameServers(svc, svcPort)
+		return nil
+	}
+
+	targetPort, err := serviceTargetPort(svc, svcPort)
+	if err != nil {
+		return err
+	}
+
+	if mode == BackendModeClusterIP {
+		if !kapi.IsServiceIPSet(&svc.Service) {
+			return &invalidIngressError{fmt.Errorf("service %s in namespace %s has no cluster IP", svcName, svcNamespace)}
+		}
+		up.Servers = []reverseProxyUpstreamServer{
+			reverseProxyUpstreamServer{Name: svcName, Host: svc.Spec.ClusterIP, Port: svcPort},
+		}
+		return nil
+	}
+
+	up.Servers, err = rcg.getServiceEndpoints(svcNamespace, svcName, targetPort)
+	return err
+}
+
+// externalNameOptions returns the scheme and Host header used to reach the
+// external name of a Service.
+func (krc *kubernetesReverseProxyConfigGetterConfig) externalNameOptions(svc *service) (string, string, error) {
+	scheme := svc.ObjectMeta.Annotations[krc.annotationKey(UpstreamSchemeKey)]
+	host := svc.ObjectMeta.Annotations[krc.annotationKey(UpstreamHostKey)]
+	switch scheme {
+	case "", "http":
+		scheme = ""
+	case "https":
+		if host == "" {
+			host = svc.ExternalName
+		}
+	default:
+		return "", "", fmt.Errorf("service %s in namespace %s: annotation %s: invalid scheme %q", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace, krc.annotationKey(UpstreamSchemeKey), scheme)
+	}
+	if host != "" && !exactHostnameRE.MatchString(host) {
+		return "", "", fmt.Errorf("service %s in namespace %s: annotation %s: invalid hostname %q", svc.ObjectMeta.Name, svc.ObjectMeta.Namespace, krc.annotationKey(UpstreamHostKey), host)
+	}
+	return scheme, host, nil
+}
+
+// servicePort returns the number of a Service port, looking up a named port
+// in the Service spec.
+func servicePort(svc *service, port intstr.IntOrString) (int, error) {
+	if port.Type == intstr.Int {
+		return port.IntValue(), nil
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name == port.StrVal {
+			return p.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("could not find port named %q for service %s in namespace %s", port.StrVal, svc.ObjectMeta.Name, svc.ObjectMeta.Namespace)
+}
+
+func serviceTargetPort(svc *service, svcPort int) (int, error) {
+	for _, port := range svc.Spec.Ports {
+		if port.Port == svcPort && port.Protocol == kapi.ProtocolTCP {
+			return port.TargetPort.IntValue(), nil
+		}
+	}
+	return 0, fmt.Errorf("could not find port matching %d for service %s in namespace %s", svcPort, svc.ObjectMeta.Name, svc.ObjectMeta.Namespace)
+}
+
+// externalNameServers resolves the external name of a Service on every
+// refresh, so that nginx follows changes to its addresses. An ExternalName
+// Service has no endpoints, so the Service port is used as is. A name that
+// fails to resolve in time leaves the upstream without servers.
+func (rcg *kubernetesReverseProxyConfigGetter) externalNameServers(svc *service, svcPort int) []reverseProxyUpstreamServer {
+	log := kubernetesLog.WithFields(logrus.Fields{
+		"service":      svc.ObjectMeta.Name,
+		"namespace":    svc.ObjectMeta.Namespace,
+		"externalName": svc.ExternalName,
+	})
+
+	lookupHost := rcg.lookupHost
+	if lookupHost == nil {
+		lookupHost = net.DefaultResolver.LookupHost
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), externalNameLookupTimeout)
+	defer cancel()
+	addrs, err := lookupHost(ctx, svc.ExternalName)
+	if err != nil {
+		log.Errorf("Failed resolving external name: %v", err)
+		return []reverseProxyUpstreamServer{}
+	}
+	sort.Strings(addrs)
+
+	ups := []reverseProxyUpstreamServer{}
+	seen := map[string]bool{}
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if strings.Contains(addr, ":") {
+			addr = "[" + addr + "]"
+		}
+		ups = append(ups, reverseProxyUpstreamServer{
+			Name: svc.ExternalName,
+			Host: addr,
+			Port: svcPort,
+		})
+	}
+	log.WithField("addresses", addrs).Debug("Resolved external name")
+	return ups
+}
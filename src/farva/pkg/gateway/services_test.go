@@ -0,0 +1,356 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+const testBackendModesManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: saas
+  namespace: shop
+spec:
+  backend:
+    serviceName: saas
+    servicePort: 443
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: vip
+  namespace: shop
+  annotations:
+    klondike.gateway/backend-mode: cluster-ip
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: manual
+  namespace: shop
+spec:
+  backend:
+    serviceName: legacy
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: unresolved
+  namespace: shop
+spec:
+  backend:
+    serviceName: gone
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: headless
+  namespace: shop
+  annotations:
+    klondike.gateway/backend-mode: cluster-ip
+spec:
+  backend:
+    serviceName: headless
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: bad-mode
+  namespace: shop
+  annotations:
+    klondike.gateway/backend-mode: magic
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: bad-scheme
+  namespace: shop
+spec:
+  backend:
+    serviceName: partner
+    servicePort: 21
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: partner
+    namespace: shop
+    annotations:
+      klondike.gateway/upstream-scheme: ftp
+  spec:
+    type: ExternalName
+    externalName: ftp.partner.example
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: saas
+    namespace: shop
+    annotations:
+      klondike.gateway/upstream-scheme: https
+  spec:
+    type: ExternalName
+    externalName: api.saas.example
+- apiVersion: v1
+  kind: Service
+  metadata: {name: gone, namespace: shop}
+  spec:
+    type: ExternalName
+    externalName: gone.example
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: shop}
+  spec:
+    clusterIP: 10.3.0.7
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Service
+  metadata: {name: headless, namespace: shop}
+  spec:
+    clusterIP: None
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Service
+  metadata: {name: legacy, namespace: shop}
+  spec:
+    ports: [{port: 80, targetPort: 80}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: legacy, namespace: shop}
+  subsets:
+  - addresses:
+    - ip: 192.168.1.10
+    ports: [{port: 80}]
+`
+
+func TestServiceUnmarshalJSON(t *testing.T) {
+	data := `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "saas"}, "spec": {"type": "ExternalName", "externalName": "api.saas.example"}}`
+	var svc service
+	if err := json.Unmarshal([]byte(data), &svc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc.ExternalName != "api.saas.example" {
+		t.Errorf("expected external name api.saas.example, got %q", svc.ExternalName)
+	}
+
+	// The field only counts for ExternalName Services.
+	data = `{"apiVersion": "v1", "kind": "Service", "metadata": {"name": "web"}, "spec": {"externalName": "api.saas.example"}}`
+	if err := json.Unmarshal([]byte(data), &svc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if svc.ExternalName != "" {
+		t.Errorf("expected no external name, got %q", svc.ExternalName)
+	}
+}
+
+func TestKubernetesBackendModes(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testBackendModesManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	rcg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+
+	lookups := 0
+	rcg.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("expected a deadline for looking up %s", host)
+		}
+		lookups++
+		if host != "api.saas.example" {
+			return nil, errors.New("no such host")
+		}
+		return []string{"10.9.0.2", "2001:db8::1", "10.9.0.1", "10.9.0.2"}, nil
+	}
+
+	rc, err := rcg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ingresses of the same age are taken by name.
+	want := []httpReverseProxyUpstream{
+		httpReverseProxyUpstream{
+			Name: "shop__manual__legacy__80",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "192.168.1.10", Host: "192.168.1.10", Port: 80},
+			},
+		},
+		httpReverseProxyUpstream{
+			Name: "shop__saas__saas__443",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "api.saas.example", Host: "10.9.0.1", Port: 443},
+				reverseProxyUpstreamServer{Name: "api.saas.example", Host: "10.9.0.2", Port: 443},
+				reverseProxyUpstreamServer{Name: "api.saas.example", Host: "[2001:db8::1]", Port: 443},
+			},
+			Scheme:     "https",
+			HostHeader: "api.saas.example",
+		},
+		httpReverseProxyUpstream{
+			Name: "shop__vip__web__80",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "web", Host: "10.3.0.7", Port: 80},
+			},
+		},
+	}
+	if diff := pretty.Compare(want, rc.HTTPUpstreams); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	// A name that doesn't resolve gets a 503 like a Service without
+	// endpoints.
+	for _, srv := range rc.HTTPServers {
+		if srv.Name == "unresolved.shop.example.com" && srv.Locations[0].StaticCode != 503 {
+			t.Errorf("expected 503 for unresolved external name, got %d", srv.Locations[0].StaticCode)
+		}
+	}
+
+	errs := map[string]string{}
+	for _, st := range rcg.IngressStatuses() {
+		if st.Disabled {
+			errs[st.Name] = st.Error
+		}
+	}
+	wantErrs := map[string]string{
+		"headless":   "service headless in namespace shop has no cluster IP",
+		"bad-mode":   `annotation klondike.gateway/backend-mode: invalid backend mode "magic"`,
+		"bad-scheme": `service partner in namespace shop: annotation klondike.gateway/upstream-scheme: invalid scheme "ftp"`,
+	}
+	if diff := pretty.Compare(wantErrs, errs); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	// External names are resolved again on every refresh.
+	if _, err := rcg.ReverseProxyConfig(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lookups != 4 {
+		t.Errorf("expected 4 lookups, got %d", lookups)
+	}
+}
+
+const testServicePortsManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: shop
+  namespace: shop
+spec:
+  rules:
+  - http:
+      paths:
+      - path: /a
+        backend:
+          serviceName: web
+          servicePort: 80
+      - path: /b
+        backend:
+          serviceName: web
+          servicePort: 81
+      - path: /c
+        backend:
+          serviceName: web
+          servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: shop}
+  spec:
+    ports:
+    - {name: http, port: 80, targetPort: 8080}
+    - {name: admin, port: 81, targetPort: 9090}
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: shop}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{name: http, port: 8080}]
+  - addresses: [{ip: 10.0.0.2}]
+    ports: [{name: admin, port: 9090}]
+`
+
+func TestKubernetesServicePorts(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testServicePortsManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	rc, err := newReverseProxyConfigGetterFromObjects(objs, &krc).ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Each port of the Service gets its own upstream, shared by the paths
+	// using it.
+	want := []httpReverseProxyUpstream{
+		httpReverseProxyUpstream{
+			Name: "shop__shop__web__80",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "10.0.0.1", Host: "10.0.0.1", Port: 8080},
+			},
+		},
+		httpReverseProxyUpstream{
+			Name: "shop__shop__web__81",
+			Servers: []reverseProxyUpstreamServer{
+				reverseProxyUpstreamServer{Name: "10.0.0.2", Host: "10.0.0.2", Port: 9090},
+			},
+		},
+	}
+	if diff := pretty.Compare(want, rc.HTTPUpstreams); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	got := map[string]string{}
+	for _, loc := range rc.HTTPServers[0].Locations {
+		got[loc.Path] = loc.Upstream
+	}
+	wantLocs := map[string]string{
+		"/a": "shop__shop__web__80",
+		"/b": "shop__shop__web__81",
+		"/c": "shop__shop__web__80",
+	}
+	if diff := pretty.Compare(wantLocs, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
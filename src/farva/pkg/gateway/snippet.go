@@ -0,0 +1,161 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Annotations injecting raw nginx directives into the server or every
+// location generated for an Ingress.
+const (
+	ServerSnippetKey   = "server-snippet"
+	LocationSnippetKey = "location-snippet"
+)
+
+// parseSnippet splits a snippet into its directives, each without the
+// trailing semicolon. Only simple directives whose names are in allowed are
+// accepted; blocks are always rejected. Quotes and comments are recognized
+// where nginx recognizes them, at the start of a word, and backslashes are
+// rejected since nginx uses them to escape quotes and semicolons.
+func parseSnippet(snippet string, allowed map[string]bool) ([]string, error) {
+	directives := []string{}
+	var cur []rune
+	var quote rune
+	comment := false
+	wordStart := true
+	quoteClosed := false
+
+	for _, r := range snippet {
+		if r == '\\' {
+			return nil, fmt.Errorf("backslashes are not allowed in snippets")
+		}
+		if quoteClosed && r != ';' && !isSnippetSpace(r) {
+			return nil, fmt.Errorf("unexpected %q after quoted string in snippet", r)
+		}
+		quoteClosed = false
+
+		switch {
+		case comment:
+			if r == '\n' {
+				comment = false
+			}
+			continue
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				quoteClosed = true
+			}
+		case wordStart && (r == '"' || r == '\''):
+			quote = r
+		case wordStart && r == '#':
+			comment = true
+			continue
+		case r == '{' || r == '}':
+			return nil, fmt.Errorf("blocks are not allowed in snippets")
+		case r == ';':
+			d, err := checkDirective(string(cur), allowed)
+			if err != nil {
+				return nil, err
+			}
+			directives = append(directives, d)
+			cur = cur[:0]
+			wordStart = true
+			continue
+		case isSnippetSpace(r):
+			r = ' '
+		}
+		wordStart = quote == 0 && r == ' '
+		cur = append(cur, r)
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in snippet")
+	}
+	if strings.TrimSpace(string(cur)) != "" {
+		return nil, fmt.Errorf("directive %q is missing a semicolon", strings.TrimSpace(string(cur)))
+	}
+	return directives, nil
+}
+
+func isSnippetSpace(r rune) bool {
+	return r == ' ' || r == '\n' || r == '\r' || r == '\t'
+}
+
+func checkDirective(d string, allowed map[string]bool) (string, error) {
+	fields := strings.Fields(d)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty directive in snippet")
+	}
+	if !allowed[strings.ToLower(fields[0])] {
+		return "", fmt.Errorf("directive %q is not allowed in snippets", fields[0])
+	}
+	return strings.Join(fields, " "), nil
+}
+
+// snippetValidator checks that an Ingress's part of the config is accepted
+// by nginx on its own, so that a bad snippet can't break the whole config.
+// Results are cached by the rendered config so nginx is only run when an
+// Ingress changes.
+type snippetValidator struct {
+	nc       NGINXConfig
+	validate func(NGINXConfig, *reverseProxyConfig) error
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]error
+	seen  map[[sha256.Size]byte]error
+}
+
+func newSnippetValidator(nc NGINXConfig) *snippetValidator {
+	return &snippetValidator{
+		nc:       nc,
+		validate: validateNGINXConfig,
+		cache:    map[[sha256.Size]byte]error{},
+		seen:     map[[sha256.Size]byte]error{},
+	}
+}
+
+func (v *snippetValidator) Validate(rc *reverseProxyConfig) error {
+	rendered, err := renderConfig(&v.nc, rc)
+	if err != nil {
+		return err
+	}
+	key := sha256.Sum256(rendered)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	err, ok := v.seen[key]
+	if !ok {
+		err, ok = v.cache[key]
+	}
+	if !ok {
+		err = v.validate(v.nc, rc)
+	}
+	v.seen[key] = err
+	return err
+}
+
+// Prune forgets results not used since the last call to Prune.
+func (v *snippetValidator) Prune() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.cache = v.seen
+	v.seen = map[[sha256.Size]byte]error{}
+}
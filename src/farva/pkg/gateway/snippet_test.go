@@ -0,0 +1,238 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseSnippet(t *testing.T) {
+	allowed := map[string]bool{
+		"client_max_body_size": true,
+		"proxy_buffering":      true,
+		"more_set_headers":     true,
+	}
+
+	tests := []struct {
+		snippet string
+		want    []string
+	}{
+		{
+			snippet: "client_max_body_size 10m;",
+			want:    []string{"client_max_body_size 10m"},
+		},
+		{
+			snippet: "# big uploads\nclient_max_body_size   10m;\n\tproxy_buffering off;  # stream\n",
+			want:    []string{"client_max_body_size 10m", "proxy_buffering off"},
+		},
+		{
+			snippet: `more_set_headers "X-Note: a;b{c}";`,
+			want:    []string{`more_set_headers "X-Note: a;b{c}"`},
+		},
+		// quotes and comments only start at the beginning of a word
+		{
+			snippet: `more_set_headers X-Note:a#b'c;`,
+			want:    []string{`more_set_headers X-Note:a#b'c`},
+		},
+	}
+
+	for i, tt := range tests {
+		got, err := parseSnippet(tt.snippet, allowed)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestParseSnippetError(t *testing.T) {
+	allowed := map[string]bool{"client_max_body_size": true}
+
+	tests := []string{
+		// not in the allowlist
+		"include /etc/passwd;",
+		"root /;",
+		// blocks can't be used to smuggle directives
+		"if ($host) { root /; }",
+		"location /x { }",
+		// missing semicolon
+		"client_max_body_size 10m",
+		// unterminated quote
+		`client_max_body_size "10m;`,
+		// empty directive
+		";",
+		// escaped quotes would end the quoted string early
+		`client_max_body_size "\";client_max_body_size ";root /x; #";`,
+		`client_max_body_size 1\;root /x;`,
+		// quotes and comments in the middle of a word don't hide a semicolon
+		`client_max_body_size a";root /x;#";`,
+		`client_max_body_size a#;` + "\nroot /x;",
+		// quoted strings must end their word
+		`client_max_body_size "10"m;`,
+	}
+
+	for i, tt := range tests {
+		if _, err := parseSnippet(tt, allowed); err == nil {
+			t.Errorf("case %d: expected error for %q", i, tt)
+		}
+	}
+}
+
+func TestSnippetValidatorCache(t *testing.T) {
+	calls := 0
+	v := newSnippetValidator(DefaultNGINXConfig)
+	v.validate = func(NGINXConfig, *reverseProxyConfig) error {
+		calls++
+		return nil
+	}
+
+	rc := &reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{Name: "foo", ListenPort: 80, Snippet: []string{"client_max_body_size 10m"}},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := v.Validate(rc); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		v.Prune()
+	}
+	if calls != 1 {
+		t.Errorf("expected nginx to be run once, got %d", calls)
+	}
+
+	// Results are forgotten once unused for a whole refresh.
+	v.Prune()
+	v.Validate(rc)
+	if calls != 2 {
+		t.Errorf("expected nginx to be run again after prune, got %d", calls)
+	}
+}
+
+const testSnippetManifest = `
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: foo
+  namespace: bar
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: good
+  namespace: bar
+  annotations:
+    klondike.gateway/server-snippet: client_max_body_size 10m;
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: invalid
+  namespace: bar
+  annotations:
+    klondike.gateway/server-snippet: client_max_body_size bogus;
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: extensions/v1beta1
+kind: Ingress
+metadata:
+  name: not-allowed
+  namespace: bar
+  annotations:
+    klondike.gateway/server-snippet: root /;
+spec:
+  backend:
+    serviceName: web
+    servicePort: 80
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata: {name: web, namespace: bar}
+  spec:
+    ports: [{port: 80, targetPort: 8080}]
+- apiVersion: v1
+  kind: Endpoints
+  metadata: {name: web, namespace: bar}
+  subsets:
+  - addresses: [{ip: 10.0.0.1}]
+    ports: [{port: 8080}]
+`
+
+func TestSnippetDisablesOnlyItsIngress(t *testing.T) {
+	objs := newManifestObjectGetter()
+	if err := objs.load(strings.NewReader(testSnippetManifest)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	krc := DefaultKubernetesReverseProxyConfigGetterConfig
+	krc.ClusterZones = []string{"example.com"}
+	krc.SnippetDirectives = map[string]bool{"client_max_body_size": true}
+	rg := newReverseProxyConfigGetterFromObjects(objs, &krc)
+	rg.snippets = newSnippetValidator(DefaultNGINXConfig)
+	rg.snippets.validate = func(_ NGINXConfig, rc *reverseProxyConfig) error {
+		for _, d := range rc.HTTPServers[0].Snippet {
+			if strings.Contains(d, "bogus") {
+				return errors.New(`"client_max_body_size" directive invalid value`)
+			}
+		}
+		return nil
+	}
+
+	rc, err := rg.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := []string{}
+	for _, srv := range rc.HTTPServers {
+		names = append(names, srv.Name)
+	}
+	if diff := pretty.Compare([]string{"foo.bar.example.com", "good.bar.example.com"}, names); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	disabled := map[string]bool{}
+	for _, st := range rg.IngressStatuses() {
+		if st.Disabled {
+			disabled[st.Name] = true
+		}
+	}
+	if diff := pretty.Compare(map[string]bool{"invalid": true, "not-allowed": true}, disabled); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
@@ -0,0 +1,254 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// staticConfig is the format of the static routes file. It mirrors
+// reverseProxyConfig but only exposes what is needed to route to hosts
+// outside of Kubernetes.
+type staticConfig struct {
+	Servers   []staticServer   `json:"servers"`
+	Upstreams []staticUpstream `json:"upstreams"`
+}
+
+type staticServer struct {
+	Name       string           `json:"name"`
+	AltNames   []string         `json:"altNames"`
+	ListenPort int              `json:"listenPort"`
+	Locations  []staticLocation `json:"locations"`
+}
+
+type staticLocation struct {
+	Path          string `json:"path"`
+	PathType      string `json:"pathType"`
+	Upstream      string `json:"upstream"`
+	StaticCode    int    `json:"staticCode"`
+	StaticMessage string `json:"staticMessage"`
+}
+
+type staticUpstream struct {
+	Name    string                 `json:"name"`
+	Servers []staticUpstreamServer `json:"servers"`
+}
+
+type staticUpstreamServer struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// staticUpstreamPrefix keeps static upstream names from colliding with those
+// generated from Ingresses.
+const staticUpstreamPrefix = "static__"
+
+// staticUpstreamNameRegexp matches upstream names that nginx reads unquoted.
+var staticUpstreamNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// staticUpstreamHost returns a host of the static file as it is rendered into
+// an upstream server: a hostname, an IPv4 address or a bracketed IPv6
+// address.
+func staticUpstreamHost(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		return "[" + host + "]", nil
+	}
+	if !exactHostnameRE.MatchString(host) {
+		return "", fmt.Errorf("invalid host %q", host)
+	}
+	return host, nil
+}
+
+func newStaticReverseProxyConfigGetter(path string, listenPort int) *staticReverseProxyConfigGetter {
+	return &staticReverseProxyConfigGetter{
+		path:       path,
+		listenPort: listenPort,
+	}
+}
+
+// staticReverseProxyConfigGetter reads servers and upstreams with fixed
+// endpoints from a YAML or JSON file. The file is read on every refresh.
+type staticReverseProxyConfigGetter struct {
+	path       string
+	listenPort int
+}
+
+func (g *staticReverseProxyConfigGetter) ReverseProxyConfig() (*reverseProxyConfig, error) {
+	data, err := ioutil.ReadFile(g.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sc staticConfig
+	if err := yaml.Unmarshal(data, &sc); err != nil {
+		return nil, fmt.Errorf("failed parsing static config %s: %v", g.path, err)
+	}
+
+	rc, err := sc.reverseProxyConfig(g.listenPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid static config %s: %v", g.path, err)
+	}
+	return rc, nil
+}
+
+func (sc *staticConfig) reverseProxyConfig(listenPort int) (*reverseProxyConfig, error) {
+	rc := reverseProxyConfig{}
+
+	upstreams := map[string]bool{}
+	for _, su := range sc.Upstreams {
+		if su.Name == "" {
+			return nil, fmt.Errorf("upstream missing name")
+		}
+		if !staticUpstreamNameRegexp.MatchString(su.Name) {
+			return nil, fmt.Errorf("invalid upstream name %q", su.Name)
+		}
+		if upstreams[su.Name] {
+			return nil, fmt.Errorf("duplicate upstream %q", su.Name)
+		}
+		upstreams[su.Name] = true
+
+		up := httpReverseProxyUpstream{Name: staticUpstreamPrefix + su.Name}
+		for _, s := range su.Servers {
+			if s.Host == "" || s.Port == 0 {
+				return nil, fmt.Errorf("upstream %q has a server without host and port", su.Name)
+			}
+			host, err := staticUpstreamHost(s.Host)
+			if err != nil {
+				return nil, fmt.Errorf("upstream %q: %v", su.Name, err)
+			}
+			if s.Port < 1 || s.Port > 65535 {
+				return nil, fmt.Errorf("upstream %q: invalid port %d", su.Name, s.Port)
+			}
+			up.Servers = append(up.Servers, reverseProxyUpstreamServer{
+				Name: s.Host,
+				Host: host,
+				Port: s.Port,
+			})
+		}
+		rc.HTTPUpstreams = append(rc.HTTPUpstreams, up)
+	}
+
+	for _, ss := range sc.Servers {
+		if ss.Name == "" {
+			return nil, fmt.Errorf("server missing name")
+		}
+		for _, name := range append([]string{ss.Name}, ss.AltNames...) {
+			if err := validateHostname(name, true); err != nil {
+				return nil, fmt.Errorf("server %s: %v", ss.Name, err)
+			}
+		}
+		srv := httpReverseProxyServer{
+			Name:       ss.Name,
+			AltNames:   ss.AltNames,
+			ListenPort: ss.ListenPort,
+			Locations:  []httpReverseProxyLocation{},
+		}
+		if srv.AltNames == nil {
+			srv.AltNames = []string{}
+		}
+		if srv.ListenPort == 0 {
+			srv.ListenPort = listenPort
+		}
+
+		for _, sl := range ss.Locations {
+			loc := httpReverseProxyLocation{
+				Path:          sl.Path,
+				StaticCode:    sl.StaticCode,
+				StaticMessage: sl.StaticMessage,
+			}
+			if loc.Path == "" {
+				loc.Path = "/"
+			}
+			switch {
+			case sl.Upstream != "" && sl.StaticCode != 0:
+				return nil, fmt.Errorf("location %s%s sets both upstream and staticCode", ss.Name, loc.Path)
+			case sl.Upstream != "":
+				if !upstreams[sl.Upstream] {
+					return nil, fmt.Errorf("location %s%s references unknown upstream %q", ss.Name, loc.Path, sl.Upstream)
+				}
+				loc.Upstream = staticUpstreamPrefix + sl.Upstream
+			case sl.StaticCode == 0:
+				return nil, fmt.Errorf("location %s%s needs an upstream or staticCode", ss.Name, loc.Path)
+			}
+
+			locs, err := pathLocations(loc.Path, sl.PathType)
+			if err != nil {
+				return nil, fmt.Errorf("location %s%s: %v", ss.Name, loc.Path, err)
+			}
+			for _, l := range locs {
+				loc.Path, loc.Match, loc.implied = l.Path, l.Match, l.implied
+				srv.Locations = append(srv.Locations, loc)
+			}
+		}
+
+		var err error
+		if srv.Locations, err = orderLocations(srv.Locations); err != nil {
+			return nil, fmt.Errorf("server %s: %v", ss.Name, err)
+		}
+
+		rc.HTTPServers = append(rc.HTTPServers, srv)
+	}
+
+	return &rc, nil
+}
+
+// Watch polls the file and sends on the returned channel whenever its
+// modification time or size changes.
+func (g *staticReverseProxyConfigGetter) Watch(stop <-chan struct{}, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last os.FileInfo
+		if fi, err := os.Stat(g.path); err == nil {
+			last = fi
+		}
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			fi, err := os.Stat(g.path)
+			if err != nil {
+				gatewayLog.Errorf("Failed checking static config %s: %v", g.path, err)
+				continue
+			}
+			if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+				continue
+			}
+			last = fi
+
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changed
+}
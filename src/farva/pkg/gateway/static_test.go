@@ -0,0 +1,172 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"testing"
+
+	"github.com/ghodss/yaml"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestStaticConfigReverseProxyConfig(t *testing.T) {
+	data := `
+servers:
+- name: legacy.example.com
+  altNames: [old.example.com]
+  locations:
+  - path: /
+    upstream: legacy
+  - path: /gone
+    pathType: Exact
+    staticCode: 410
+upstreams:
+- name: legacy
+  servers:
+  - host: 10.1.0.5
+    port: 8080
+`
+	var sc staticConfig
+	if err := yaml.Unmarshal([]byte(data), &sc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got, err := sc.reverseProxyConfig(7331)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := &reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{
+				Name:       "legacy.example.com",
+				AltNames:   []string{"old.example.com"},
+				ListenPort: 7331,
+				Locations: []httpReverseProxyLocation{
+					httpReverseProxyLocation{Path: "/gone", Match: "=", StaticCode: 410},
+					httpReverseProxyLocation{Path: "/", Upstream: "static__legacy"},
+				},
+			},
+		},
+		HTTPUpstreams: []httpReverseProxyUpstream{
+			httpReverseProxyUpstream{
+				Name: "static__legacy",
+				Servers: []reverseProxyUpstreamServer{
+					reverseProxyUpstreamServer{Name: "10.1.0.5", Host: "10.1.0.5", Port: 8080},
+				},
+			},
+		},
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
+
+func TestStaticConfigReverseProxyConfigError(t *testing.T) {
+	tests := []staticConfig{
+		// server without name
+		staticConfig{
+			Servers: []staticServer{staticServer{}},
+		},
+		// unknown upstream
+		staticConfig{
+			Servers: []staticServer{
+				staticServer{Name: "a", Locations: []staticLocation{staticLocation{Upstream: "nope"}}},
+			},
+		},
+		// location with neither upstream nor static code
+		staticConfig{
+			Servers: []staticServer{
+				staticServer{Name: "a", Locations: []staticLocation{staticLocation{Path: "/"}}},
+			},
+		},
+		// upstream server without port
+		staticConfig{
+			Upstreams: []staticUpstream{
+				staticUpstream{Name: "a", Servers: []staticUpstreamServer{staticUpstreamServer{Host: "10.0.0.1"}}},
+			},
+		},
+		// duplicate upstream
+		staticConfig{
+			Upstreams: []staticUpstream{staticUpstream{Name: "a"}, staticUpstream{Name: "a"}},
+		},
+		// server name with a stray semicolon
+		staticConfig{
+			Servers: []staticServer{
+				staticServer{Name: "a.example.com;", Locations: []staticLocation{staticLocation{StaticCode: 410}}},
+			},
+		},
+		// invalid alt name
+		staticConfig{
+			Servers: []staticServer{
+				staticServer{Name: "a.example.com", AltNames: []string{"b.example.com include /etc/passwd"}, Locations: []staticLocation{staticLocation{StaticCode: 410}}},
+			},
+		},
+		// invalid upstream name
+		staticConfig{
+			Upstreams: []staticUpstream{staticUpstream{Name: "a {"}},
+		},
+		// invalid upstream host
+		staticConfig{
+			Upstreams: []staticUpstream{
+				staticUpstream{Name: "a", Servers: []staticUpstreamServer{staticUpstreamServer{Host: "10.0.0.1; error_log /tmp/x", Port: 80}}},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		if _, err := tt.reverseProxyConfig(7331); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
+
+func TestMultiReverseProxyConfigGetterConflicts(t *testing.T) {
+	kube := &fakeReverseProxyConfigGetter{rc: reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{Name: "foo.bar.example.com", AltNames: []string{"www.example.com"}, ListenPort: 7331},
+		},
+	}}
+	static := &fakeReverseProxyConfigGetter{rc: reverseProxyConfig{
+		HTTPServers: []httpReverseProxyServer{
+			httpReverseProxyServer{Name: "legacy.example.com", AltNames: []string{"www.example.com"}, ListenPort: 7331},
+			httpReverseProxyServer{Name: "vm.example.com", ListenPort: 7331},
+		},
+	}}
+
+	m := newMultiReverseProxyConfigGetter(
+		namedReverseProxyConfigGetter{"kubernetes", kube},
+		namedReverseProxyConfigGetter{"static", static},
+	)
+	rc, err := m.ReverseProxyConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := []string{}
+	for _, srv := range rc.HTTPServers {
+		names = append(names, srv.Name)
+	}
+	if diff := pretty.Compare([]string{"foo.bar.example.com", "vm.example.com"}, names); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+
+	want := []HostnameConflict{
+		HostnameConflict{Hostname: "www.example.com", ListenPort: 7331, Kept: "kubernetes", Dropped: "static"},
+	}
+	if diff := pretty.Compare(want, m.Conflicts()); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bcwaldon/klondike/src/farva/pkg/metrics"
+)
+
+var (
+	stubStatusActiveRegexp   = regexp.MustCompile(`Active connections:\s+(\d+)`)
+	stubStatusCountersRegexp = regexp.MustCompile(`\n\s*(\d+)\s+(\d+)\s+(\d+)\s*\n`)
+	stubStatusStatesRegexp   = regexp.MustCompile(`Reading:\s+(\d+)\s+Writing:\s+(\d+)\s+Waiting:\s+(\d+)`)
+)
+
+// parseStubStatus parses the output of the nginx stub_status module:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func parseStubStatus(body []byte) (metrics.NGINXStatus, error) {
+	var st metrics.NGINXStatus
+
+	active := stubStatusActiveRegexp.FindSubmatch(body)
+	counters := stubStatusCountersRegexp.FindSubmatch(body)
+	states := stubStatusStatesRegexp.FindSubmatch(body)
+	if active == nil || counters == nil || states == nil {
+		return st, fmt.Errorf("unrecognized stub_status output: %q", body)
+	}
+
+	for _, f := range []struct {
+		dst *int64
+		src []byte
+	}{
+		{&st.Active, active[1]},
+		{&st.Accepted, counters[1]},
+		{&st.Handled, counters[2]},
+		{&st.Requests, counters[3]},
+		{&st.Reading, states[1]},
+		{&st.Writing, states[2]},
+		{&st.Waiting, states[3]},
+	} {
+		v, err := strconv.ParseInt(string(f.src), 10, 64)
+		if err != nil {
+			return st, err
+		}
+		*f.dst = v
+	}
+
+	return st, nil
+}
+
+func newStubStatusScraper(port int, interval time.Duration) *stubStatusScraper {
+	return &stubStatusScraper{
+		url:      fmt.Sprintf("http://127.0.0.1:%d/nginx_status", port),
+		interval: interval,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// stubStatusScraper periodically polls nginx's stub_status location and
+// exports the result as metrics and in the health JSON.
+type stubStatusScraper struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.Mutex
+	status  *metrics.NGINXStatus
+	scraped time.Time
+	lastErr error
+}
+
+func (s *stubStatusScraper) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.scrape()
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *stubStatusScraper) scrape() {
+	st, err := s.fetch()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scraped = time.Now()
+	s.lastErr = err
+	if err != nil {
+		nginxLog.Warnf("Failed scraping nginx stub_status: %v", err)
+		return
+	}
+	s.status = &st
+	metrics.SetNGINXStatus(st)
+}
+
+func (s *stubStatusScraper) fetch() (metrics.NGINXStatus, error) {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return metrics.NGINXStatus{}, err
+	}
+	// The stub_status location lives on the localhost server block.
+	req.Host = "localhost"
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return metrics.NGINXStatus{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return metrics.NGINXStatus{}, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return metrics.NGINXStatus{}, err
+	}
+	return parseStubStatus(body)
+}
+
+// HealthStatus reports the last scrape for the health JSON.
+func (s *stubStatusScraper) HealthStatus() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hs := struct {
+		Status      *metrics.NGINXStatus `json:"status"`
+		LastScraped time.Time            `json:"lastScraped"`
+		Error       string               `json:"error,omitempty"`
+	}{
+		Status:      s.status,
+		LastScraped: s.scraped,
+	}
+	if s.lastErr != nil {
+		hs.Error = s.lastErr.Error()
+	}
+	return hs
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package gateway
+
+import (
+	"testing"
+
+	"github.com/bcwaldon/klondike/src/farva/pkg/metrics"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseStubStatus(t *testing.T) {
+	body := []byte("Active connections: 291 \nserver accepts handled requests\n 16630948 16630947 31070465 \nReading: 6 Writing: 179 Waiting: 106 \n")
+	want := metrics.NGINXStatus{
+		Active:   291,
+		Reading:  6,
+		Writing:  179,
+		Waiting:  106,
+		Accepted: 16630948,
+		Handled:  16630947,
+		Requests: 31070465,
+	}
+
+	got, err := parseStubStatus(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if diff := pretty.Compare(want, got); diff != "" {
+		t.Errorf("diff=%s", diff)
+	}
+}
+
+func TestParseStubStatusError(t *testing.T) {
+	tests := []string{
+		"",
+		"<html>403 Forbidden</html>",
+		"Active connections: 1 \nReading: 0 Writing: 1 Waiting: 0 \n",
+	}
+
+	for i, tt := range tests {
+		if _, err := parseStubStatus([]byte(tt)); err == nil {
+			t.Errorf("case %d: expected error, got nil", i)
+		}
+	}
+}
@@ -16,10 +16,40 @@ limitations under the License.
 package health
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
 )
 
+// Reporter returns the current state of a component. The result is encoded
+// as JSON under the component's name.
+type Reporter func() interface{}
+
+var (
+	reportersMu sync.Mutex
+	reporters   = map[string]Reporter{}
+)
+
+// Register adds a component to the /health.json output. Registering the
+// same name again replaces the previous Reporter.
+func Register(name string, r Reporter) {
+	reportersMu.Lock()
+	defer reportersMu.Unlock()
+	reporters[name] = r
+}
+
+func report() map[string]interface{} {
+	reportersMu.Lock()
+	defer reportersMu.Unlock()
+
+	components := make(map[string]interface{}, len(reporters))
+	for name, r := range reporters {
+		components[name] = r()
+	}
+	return components
+}
+
 func NewHandler() http.Handler {
 	mux := http.NewServeMux()
 
@@ -27,5 +57,13 @@ func NewHandler() http.Handler {
 		fmt.Fprintf(w, "Healthy")
 	})
 
+	mux.HandleFunc("/health.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     "Healthy",
+			"components": report(),
+		})
+	})
+
 	return mux
 }
@@ -16,6 +16,8 @@ limitations under the License.
 package logger
 
 import (
+	"fmt"
+
 	"github.com/Sirupsen/logrus"
 )
 
@@ -25,3 +27,30 @@ func init() {
 	Log.Formatter = new(logrus.TextFormatter)
 	Log.Level = logrus.DebugLevel
 }
+
+// Configure sets the level and output format of Log. The format is either
+// "text" or "json".
+func Configure(level, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "text":
+		Log.Formatter = new(logrus.TextFormatter)
+	case "json":
+		Log.Formatter = new(logrus.JSONFormatter)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	Log.Level = lvl
+	return nil
+}
+
+// Component returns a logger that tags every entry with the name of the
+// component that produced it. It shares the level and format of Log.
+func Component(name string) *logrus.Entry {
+	return Log.WithField("component", name)
+}
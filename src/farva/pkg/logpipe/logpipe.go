@@ -17,46 +17,261 @@ package logpipe
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
 	"github.com/bcwaldon/klondike/src/farva/pkg/logger"
 	"io"
 	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
+var (
+	log       = logger.Component("logpipe")
+	accessLog = logger.Component("nginx").WithField("stream", "access")
+	errorLog  = logger.Component("nginx").WithField("stream", "error")
+)
+
+// DefaultBufferSize is the number of lines a LogPipe holds before it starts
+// dropping them rather than blocking nginx.
+const DefaultBufferSize = 1024
+
+// LineHandler is called once for every line read from a LogPipe.
+type LineHandler func(line []byte)
+
 type LogPipe struct {
-	path string
+	// dropped is first to guarantee 64-bit alignment for atomic access.
+	dropped uint64
+
+	path    string
+	handler LineHandler
+	lines   chan []byte
+
+	mu   sync.Mutex
+	file *os.File
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewLogPipe(path string, handler LineHandler, bufferSize int) *LogPipe {
+	return &LogPipe{
+		path:    path,
+		handler: handler,
+		lines:   make(chan []byte, bufferSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
 }
 
-func NewLogPipe(path string) LogPipe {
-	return LogPipe{path: path}
+// AccessObserver is handed the fields of every decoded json access log line.
+type AccessObserver func(fields logrus.Fields)
+
+// NewAccessLogPipe returns a LogPipe that decodes nginx access log lines and
+// passes them to each of the observers.
+func NewAccessLogPipe(path string, observers ...AccessObserver) *LogPipe {
+	return NewLogPipe(path, func(line []byte) {
+		fields, ok := parseAccessLine(line)
+		if !ok {
+			accessLog.Info(string(line))
+			return
+		}
+		for _, o := range observers {
+			o(fields)
+		}
+		accessLog.WithFields(fields).Info("nginx access")
+	}, DefaultBufferSize)
+}
+
+// NewErrorLogPipe returns a LogPipe that re-emits nginx error log lines at
+// the matching logrus level.
+func NewErrorLogPipe(path string) *LogPipe {
+	return NewLogPipe(path, LogErrorLine, DefaultBufferSize)
 }
 
 func (l *LogPipe) Start() error {
 	// Always remove the fifo initially, ignore error if it doesn't exist.
 	os.Remove(l.path)
 	if err := syscall.Mkfifo(l.path, 0777); err != nil {
-		logger.Log.Errorf("Could create fifo at %s: %s", l.path, err)
+		log.Errorf("Could not create fifo at %s: %s", l.path, err)
 		return err
 	}
 
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		l.read()
+	}()
 	go func() {
+		defer wg.Done()
+		l.handle()
+	}()
+	go func() {
+		wg.Wait()
+		close(l.done)
+	}()
+
+	return nil
+}
+
+// Stop closes the fifo and waits for all buffered lines to be handled. It
+// must only be called once, after a successful call to Start.
+func (l *LogPipe) Stop() {
+	close(l.stop)
+
+	l.mu.Lock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.mu.Unlock()
+
+	// Opening the write end unblocks a reader still waiting in open(2).
+	if f, err := os.OpenFile(l.path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+		f.Close()
+	}
+
+	<-l.done
+}
+
+// Dropped returns the number of lines discarded because the buffer was full.
+func (l *LogPipe) Dropped() uint64 {
+	return atomic.LoadUint64(&l.dropped)
+}
+
+func (l *LogPipe) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// read drains the fifo into the line buffer, reopening it every time the
+// writer goes away. It never blocks on the handler so nginx can't be stalled
+// by a slow consumer.
+func (l *LogPipe) read() {
+	defer close(l.lines)
+
+	for !l.stopped() {
 		f, err := os.Open(l.path)
 		if err != nil {
-			logger.Log.Errorf("Could not open fifo: %s", err)
+			log.Errorf("Could not open fifo: %s", err)
+			return
+		}
+
+		l.mu.Lock()
+		if l.stopped() {
+			l.mu.Unlock()
+			f.Close()
 			return
 		}
+		l.file = f
+		l.mu.Unlock()
+
+		l.readFile(f)
+
+		l.mu.Lock()
+		l.file = nil
+		l.mu.Unlock()
+		f.Close()
+	}
+}
 
-		reader := bufio.NewReader(f)
+func (l *LogPipe) readFile(f *os.File) {
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if line = bytes.TrimRight(line, "\r\n"); len(line) > 0 {
+			l.enqueue(line)
+		}
 
-		for {
-			line, _, err := reader.ReadLine()
-			if err != nil && err != io.EOF {
-				logger.Log.Errorf("Could not read line from fifo: %s", err)
-			} else {
-				logger.Log.Printf("NGINX: %s", string(line))
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			if !l.stopped() {
+				log.Errorf("Could not read line from fifo: %s", err)
 			}
+			return
 		}
-	}()
+	}
+}
 
-	return nil
+func (l *LogPipe) enqueue(line []byte) {
+	select {
+	case l.lines <- line:
+	default:
+		atomic.AddUint64(&l.dropped, 1)
+	}
+}
+
+func (l *LogPipe) handle() {
+	var reported uint64
+	for line := range l.lines {
+		l.handler(line)
+
+		if dropped := l.Dropped(); dropped != reported {
+			log.Warnf("Dropped %d lines from fifo %s, %d total", dropped-reported, l.path, dropped)
+			reported = dropped
+		}
+	}
+}
+
+// parseAccessLine decodes a line written by the json access log format.
+func parseAccessLine(line []byte) (logrus.Fields, bool) {
+	if len(line) == 0 || line[0] != '{' {
+		return nil, false
+	}
+	fields := logrus.Fields{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, false
+	}
+	return fields, true
+}
+
+// nginx error log lines look like "2016/06/01 12:00:00 [error] 7#7: ...".
+var errorLineRegexp = regexp.MustCompile(`^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[(\w+)\] (.*)$`)
+
+var errorLevels = map[string]logrus.Level{
+	"debug":  logrus.DebugLevel,
+	"info":   logrus.InfoLevel,
+	"notice": logrus.InfoLevel,
+	"warn":   logrus.WarnLevel,
+	"error":  logrus.ErrorLevel,
+	"crit":   logrus.ErrorLevel,
+	"alert":  logrus.ErrorLevel,
+	"emerg":  logrus.ErrorLevel,
+}
+
+// LogErrorLine re-emits an nginx error log line at the logrus level matching
+// its nginx severity. Lines that can't be parsed are logged at error level.
+func LogErrorLine(line []byte) {
+	level, msg := parseErrorLine(line)
+	entry := errorLog
+	switch level {
+	case logrus.DebugLevel:
+		entry.Debug(msg)
+	case logrus.InfoLevel:
+		entry.Info(msg)
+	case logrus.WarnLevel:
+		entry.Warn(msg)
+	default:
+		entry.Error(msg)
+	}
+}
+
+func parseErrorLine(line []byte) (logrus.Level, string) {
+	m := errorLineRegexp.FindSubmatch(line)
+	if m == nil {
+		return logrus.ErrorLevel, string(line)
+	}
+	level, ok := errorLevels[string(m[1])]
+	if !ok {
+		level = logrus.ErrorLevel
+	}
+	return level, string(m[2])
 }
@@ -0,0 +1,177 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package logpipe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestParseAccessLine(t *testing.T) {
+	tests := []struct {
+		line string
+		want logrus.Fields
+		ok   bool
+	}{
+		{
+			line: `{"status":200,"upstream_addr":"10.1.2.5:80","ingress_name":"web","ingress_namespace":"default"}`,
+			want: logrus.Fields{
+				"status":            float64(200),
+				"upstream_addr":     "10.1.2.5:80",
+				"ingress_name":      "web",
+				"ingress_namespace": "default",
+			},
+			ok: true,
+		},
+		{
+			line: `127.0.0.1 - - [01/Jan/2016:00:00:00 +0000] "GET / HTTP/1.1" 200 0 "-" "curl" "-"`,
+			ok:   false,
+		},
+		{
+			line: `{"status":`,
+			ok:   false,
+		},
+		{
+			line: ``,
+			ok:   false,
+		},
+	}
+
+	for i, tt := range tests {
+		got, ok := parseAccessLine([]byte(tt.line))
+		if ok != tt.ok {
+			t.Errorf("case %d: want ok=%t, got ok=%t", i, tt.ok, ok)
+			continue
+		}
+		if diff := pretty.Compare(tt.want, got); diff != "" {
+			t.Errorf("case %d: diff=%s", i, diff)
+		}
+	}
+}
+
+func TestParseErrorLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		wantLevel logrus.Level
+		wantMsg   string
+	}{
+		{
+			line:      `2016/06/01 12:00:00 [error] 7#7: *1 connect() failed (111: Connection refused)`,
+			wantLevel: logrus.ErrorLevel,
+			wantMsg:   `7#7: *1 connect() failed (111: Connection refused)`,
+		},
+		{
+			line:      `2016/06/01 12:00:00 [warn] 7#7: conflicting server name "foo" on 0.0.0.0:7331, ignored`,
+			wantLevel: logrus.WarnLevel,
+			wantMsg:   `7#7: conflicting server name "foo" on 0.0.0.0:7331, ignored`,
+		},
+		{
+			line:      `2016/06/01 12:00:00 [notice] 1#1: signal process started`,
+			wantLevel: logrus.InfoLevel,
+			wantMsg:   `1#1: signal process started`,
+		},
+		{
+			line:      `nginx: [emerg] unknown directive "foo"`,
+			wantLevel: logrus.ErrorLevel,
+			wantMsg:   `nginx: [emerg] unknown directive "foo"`,
+		},
+	}
+
+	for i, tt := range tests {
+		level, msg := parseErrorLine([]byte(tt.line))
+		if level != tt.wantLevel {
+			t.Errorf("case %d: want level=%v, got level=%v", i, tt.wantLevel, level)
+		}
+		if msg != tt.wantMsg {
+			t.Errorf("case %d: want msg=%q, got msg=%q", i, tt.wantMsg, msg)
+		}
+	}
+}
+
+func TestLogPipeReopensAndStops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logpipe")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	lines := make(chan string, 10)
+	lp := NewLogPipe(filepath.Join(dir, "fifo"), func(line []byte) {
+		lines <- string(line)
+	}, 10)
+	if err := lp.Start(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Each writer closes the fifo, which the reader sees as EOF.
+	for _, want := range []string{"ping", "pong"} {
+		f, err := os.OpenFile(lp.path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		fmt.Fprintln(f, want)
+		f.Close()
+
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("want line=%q, got line=%q", want, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for line %q", want)
+		}
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		lp.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for Stop")
+	}
+
+	if len(lines) != 0 {
+		t.Errorf("unexpected lines after Stop: %d", len(lines))
+	}
+}
+
+func TestLogPipeDropsWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	lp := NewLogPipe("", func([]byte) { <-block }, 1)
+	go lp.handle()
+
+	for i := 0; i < 5; i++ {
+		lp.enqueue([]byte("line"))
+	}
+	close(block)
+	close(lp.lines)
+
+	// One line is held by the blocked handler and one by the buffer, but
+	// the handler may not have picked up the first line yet.
+	if got := lp.Dropped(); got < 3 || got > 4 {
+		t.Errorf("want 3 or 4 dropped lines, got %d", got)
+	}
+}
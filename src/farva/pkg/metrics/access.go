@@ -0,0 +1,135 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var accessLabels = []string{"host", "namespace", "ingress", "upstream"}
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "Number of HTTP requests served by nginx, by response status class.",
+		},
+		append(accessLabels, "status_class"),
+	)
+
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Time nginx spent serving HTTP requests.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		accessLabels,
+	)
+
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "upstream_response_duration_seconds",
+			Help:      "Time spent receiving responses from upstream servers.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		accessLabels,
+	)
+
+	responseBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "response_bytes_total",
+			Help:      "Number of bytes sent to clients.",
+		},
+		accessLabels,
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(upstreamDuration)
+	prometheus.MustRegister(responseBytes)
+}
+
+// ObserveAccess records a single decoded json access log line. Lines from
+// other formats don't carry a status and are ignored.
+func ObserveAccess(fields map[string]interface{}) {
+	status, ok := fields["status"].(float64)
+	if !ok {
+		return
+	}
+
+	labels := []string{
+		stringField(fields, "server_name"),
+		stringField(fields, "ingress_namespace"),
+		stringField(fields, "ingress_name"),
+		stringField(fields, "upstream_name"),
+	}
+
+	requestsTotal.WithLabelValues(append(labels, statusClass(int(status)))...).Inc()
+
+	if rt, ok := fields["request_time"].(float64); ok {
+		requestDuration.WithLabelValues(labels...).Observe(rt)
+	}
+	if ut, ok := upstreamTime(stringField(fields, "upstream_response_time")); ok {
+		upstreamDuration.WithLabelValues(labels...).Observe(ut)
+	}
+	if bs, ok := fields["bytes_sent"].(float64); ok {
+		responseBytes.WithLabelValues(labels...).Add(bs)
+	}
+}
+
+func stringField(fields map[string]interface{}, key string) string {
+	s, _ := fields[key].(string)
+	return s
+}
+
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// upstreamTime sums the times nginx spent on each upstream attempt. nginx
+// separates attempts with ", " and internal redirects with " : ", and uses
+// "-" when no upstream was contacted.
+func upstreamTime(val string) (float64, bool) {
+	var total float64
+	var found bool
+	for _, part := range strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || r == ':' || r == ' '
+	}) {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			continue
+		}
+		total += f
+		found = true
+	}
+	return total, found
+}
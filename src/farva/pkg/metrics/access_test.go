@@ -0,0 +1,61 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"testing"
+)
+
+func TestStatusClass(t *testing.T) {
+	tests := map[int]string{
+		101: "1xx",
+		200: "2xx",
+		204: "2xx",
+		304: "3xx",
+		404: "4xx",
+		499: "4xx",
+		503: "5xx",
+		0:   "unknown",
+		600: "unknown",
+	}
+
+	for status, want := range tests {
+		if got := statusClass(status); got != want {
+			t.Errorf("status %d: want=%s got=%s", status, want, got)
+		}
+	}
+}
+
+func TestUpstreamTime(t *testing.T) {
+	tests := []struct {
+		val    string
+		want   float64
+		wantOK bool
+	}{
+		{val: "0.004", want: 0.004, wantOK: true},
+		{val: "0.500, 0.250", want: 0.75, wantOK: true},
+		{val: "0.500, 0.250 : 0.125", want: 0.875, wantOK: true},
+		{val: "-", wantOK: false},
+		{val: "", wantOK: false},
+	}
+
+	for i, tt := range tests {
+		got, ok := upstreamTime(tt.val)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("case %d: want=%v,%t got=%v,%t", i, tt.want, tt.wantOK, got, ok)
+		}
+	}
+}
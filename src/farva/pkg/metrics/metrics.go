@@ -0,0 +1,63 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "farva"
+
+// Handler serves all registered metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return prometheus.Handler()
+}
+
+// RegisterLogPipeDropped exports the number of lines dropped by a log pipe
+// under the given stream name.
+func RegisterLogPipeDropped(stream string, dropped func() uint64) {
+	prometheus.MustRegister(prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   "logpipe",
+			Name:        "dropped_lines_total",
+			Help:        "Number of nginx log lines dropped because farva fell behind.",
+			ConstLabels: prometheus.Labels{"stream": stream},
+		},
+		func() float64 { return float64(dropped()) },
+	))
+}
+
+var leader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "leader",
+	Help:      "Whether this farva is the leader allowed to make cluster-wide writes.",
+})
+
+func init() {
+	prometheus.MustRegister(leader)
+}
+
+// SetLeader records whether this farva currently holds leadership.
+func SetLeader(isLeader bool) {
+	if isLeader {
+		leader.Set(1)
+	} else {
+		leader.Set(0)
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2016 Planet Labs
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NGINXStatus holds the values reported by the nginx stub_status module.
+type NGINXStatus struct {
+	Active   int64 `json:"active"`
+	Reading  int64 `json:"reading"`
+	Writing  int64 `json:"writing"`
+	Waiting  int64 `json:"waiting"`
+	Accepted int64 `json:"accepted"`
+	Handled  int64 `json:"handled"`
+	Requests int64 `json:"requests"`
+}
+
+var (
+	nginxStatusMu sync.Mutex
+	nginxStatus   NGINXStatus
+
+	nginxConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "nginx",
+			Name:      "connections",
+			Help:      "Number of client connections to nginx, by state.",
+		},
+		[]string{"state"},
+	)
+)
+
+func nginxStatusCounter(name, help string, value func(NGINXStatus) int64) prometheus.CounterFunc {
+	return prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "nginx",
+			Name:      name,
+			Help:      help,
+		},
+		func() float64 {
+			nginxStatusMu.Lock()
+			defer nginxStatusMu.Unlock()
+			return float64(value(nginxStatus))
+		},
+	)
+}
+
+func init() {
+	prometheus.MustRegister(nginxConnections)
+	prometheus.MustRegister(nginxStatusCounter("connections_accepted_total", "Number of client connections accepted by nginx.",
+		func(s NGINXStatus) int64 { return s.Accepted }))
+	prometheus.MustRegister(nginxStatusCounter("connections_handled_total", "Number of client connections handled by nginx.",
+		func(s NGINXStatus) int64 { return s.Handled }))
+	prometheus.MustRegister(nginxStatusCounter("requests_total", "Number of client requests served by nginx.",
+		func(s NGINXStatus) int64 { return s.Requests }))
+}
+
+// SetNGINXStatus records the most recent stub_status scrape.
+func SetNGINXStatus(s NGINXStatus) {
+	nginxStatusMu.Lock()
+	nginxStatus = s
+	nginxStatusMu.Unlock()
+
+	nginxConnections.WithLabelValues("active").Set(float64(s.Active))
+	nginxConnections.WithLabelValues("reading").Set(float64(s.Reading))
+	nginxConnections.WithLabelValues("writing").Set(float64(s.Writing))
+	nginxConnections.WithLabelValues("waiting").Set(float64(s.Waiting))
+}